@@ -0,0 +1,409 @@
+package spvchannels
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BatchContentType is the content type of the messages packing several events
+const BatchContentType = "application/vnd.spvchannels.batch+json"
+
+// BatchVersion is the version of the batch message format
+const BatchVersion = 1
+
+// batchEventOverhead bounds the JSON encoding overhead of an event in a batch message
+const batchEventOverhead = 32
+
+// ErrBatchWriterClosed is returned when writing to a closed BatchWriter
+var ErrBatchWriterClosed = errors.New("batch writer closed")
+
+// BatchEvent is an event packed in a batch message. Body is base64 encoded in JSON
+type BatchEvent struct {
+	ContentType string `json:"cty,omitempty"`
+	Body        []byte `json:"body"`
+}
+
+// BatchMessage is the message content of a batch message
+type BatchMessage struct {
+	Version int          `json:"v"`
+	Events  []BatchEvent `json:"events"`
+}
+
+// UnpackBatch return the events of a batch message as messages sharing the
+// batch sequence. Other messages are returned as is
+func UnpackBatch(msg MessageWriteReply) ([]MessageWriteReply, error) {
+	if mediaType(msg.ContentType) != BatchContentType {
+		return []MessageWriteReply{msg}, nil
+	}
+
+	payload, err := msg.DecodePayload()
+	if err != nil {
+		return nil, err
+	}
+
+	var b BatchMessage
+	if err := json.Unmarshal(payload, &b); err != nil {
+		return nil, fmt.Errorf("message %d has an invalid batch : %w", msg.Sequence, err)
+	}
+	if b.Version != BatchVersion {
+		return nil, fmt.Errorf("message %d has an unsupported batch version %d", msg.Sequence, b.Version)
+	}
+
+	res := make([]MessageWriteReply, 0, len(b.Events))
+	for _, e := range b.Events {
+		m := msg
+		m.ContentType = e.ContentType
+		m.Payload = base64.StdEncoding.EncodeToString(e.Body)
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// WriteFuture is the result of a write buffered by a BatchWriter
+type WriteFuture struct {
+	done  chan struct{}
+	reply *MessageWriteReply
+	err   error
+}
+
+func newWriteFuture() *WriteFuture {
+	return &WriteFuture{
+		done: make(chan struct{}),
+	}
+}
+
+func (f *WriteFuture) complete(reply *MessageWriteReply, err error) {
+	f.reply = reply
+	f.err = err
+	close(f.done)
+}
+
+// Done is closed once the write completed
+func (f *WriteFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits for the write to complete and return the reply of the message
+// holding the event, or the write error
+func (f *WriteFuture) Wait(ctx context.Context) (*MessageWriteReply, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-f.done:
+		return f.reply, f.err
+	}
+}
+
+// BatchCallbackFunc is called once an event is written, or failed
+type BatchCallbackFunc func(r MessageWriteRequest, reply *MessageWriteReply, err error)
+
+// batchConfig hold configuration of a batch writer
+type batchConfig struct {
+	maxCount    int
+	maxBytes    int
+	interval    time.Duration
+	concurrency int
+	pack        bool
+	callback    BatchCallbackFunc
+}
+
+// BatchConfigFunc set the batch writer configuration
+type BatchConfigFunc func(c *batchConfig)
+
+// WithBatchSize flush the events of a channel once count events or bytes
+// bytes are buffered. Default is 100 events or 65536 bytes
+func WithBatchSize(count, bytes int) BatchConfigFunc {
+	return func(c *batchConfig) {
+		c.maxCount = count
+		c.maxBytes = bytes
+	}
+}
+
+// WithBatchInterval flush the buffered events every interval. Default is 100 milliseconds.
+//
+// Zero or a negative value disables the periodic flush, the events are then
+// written once a batch is full, or by Flush and Close
+func WithBatchInterval(d time.Duration) BatchConfigFunc {
+	return func(c *batchConfig) {
+		c.interval = d
+	}
+}
+
+// WithBatchConcurrency set the maximum number of concurrent write requests. Default is 4
+func WithBatchConcurrency(n int) BatchConfigFunc {
+	return func(c *batchConfig) {
+		c.concurrency = n
+	}
+}
+
+// WithBatchPacking pack the events flushed together in as few BatchMessage
+// as the maximum message size allows, instead of one message per event
+func WithBatchPacking() BatchConfigFunc {
+	return func(c *batchConfig) {
+		c.pack = true
+	}
+}
+
+// WithBatchCallback call f for each event once written or failed
+func WithBatchCallback(f BatchCallbackFunc) BatchConfigFunc {
+	return func(c *batchConfig) {
+		c.callback = f
+	}
+}
+
+func defaultBatchConfig() *batchConfig {
+	return &batchConfig{
+		maxCount:    100,
+		maxBytes:    MaxMessageContentLength,
+		interval:    100 * time.Millisecond,
+		concurrency: 4,
+	}
+}
+
+// batchEvent is an event buffered by a BatchWriter
+type batchEvent struct {
+	req    MessageWriteRequest
+	future *WriteFuture
+}
+
+// batchChannel hold the buffered events of a channel
+type batchChannel struct {
+	events []*batchEvent
+	bytes  int
+	busy   bool
+}
+
+// BatchWriter buffers the writes of each channel and flushes them by count,
+// bytes or interval, over a bounded number of concurrent requests.
+//
+// The events of a channel are written in order: a channel has at most one
+// flush in flight. It is safe for concurrent use
+type BatchWriter struct {
+	mu       sync.Mutex
+	cfg      *batchConfig
+	client   *Client
+	channels map[string]*batchChannel
+	closed   bool
+	sem      chan struct{}
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stop     chan struct{}
+}
+
+// NewBatchWriter create a batch writer writing with client.
+// Close must be called to flush the buffered events and release resources
+func NewBatchWriter(client *Client, opts ...BatchConfigFunc) *BatchWriter {
+	cfg := defaultBatchConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.concurrency < 1 {
+		cfg.concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &BatchWriter{
+		cfg:      cfg,
+		client:   client,
+		channels: make(map[string]*batchChannel),
+		sem:      make(chan struct{}, cfg.concurrency),
+		ctx:      ctx,
+		cancel:   cancel,
+		stop:     make(chan struct{}),
+	}
+
+	if cfg.interval > 0 {
+		go w.tick()
+	}
+	return w
+}
+
+// tick flush all channels every interval
+func (w *BatchWriter) tick() {
+	ticker := time.NewTicker(w.cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.Flush()
+		}
+	}
+}
+
+// Write buffers a message and return its future
+func (w *BatchWriter) Write(r MessageWriteRequest) *WriteFuture {
+	ev := &batchEvent{
+		req:    r,
+		future: newWriteFuture(),
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		ev.future.complete(nil, ErrBatchWriterClosed)
+		return ev.future
+	}
+
+	ch, ok := w.channels[r.ChannelID]
+	if !ok {
+		ch = &batchChannel{}
+		w.channels[r.ChannelID] = ch
+	}
+	ch.events = append(ch.events, ev)
+	ch.bytes += len(r.Message)
+
+	if len(ch.events) >= w.cfg.maxCount || ch.bytes >= w.cfg.maxBytes {
+		w.flushLocked(r.ChannelID, ch)
+	}
+	return ev.future
+}
+
+// Flush sends the buffered events of all channels without waiting for the writes
+func (w *BatchWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for id, ch := range w.channels {
+		w.flushLocked(id, ch)
+	}
+}
+
+// flushLocked starts writing the buffered events of a channel, unless a
+// flush of the channel is in flight: it then flushes again once done
+func (w *BatchWriter) flushLocked(channelID string, ch *batchChannel) {
+	if ch.busy || len(ch.events) == 0 {
+		return
+	}
+
+	events := ch.events
+	ch.events = nil
+	ch.bytes = 0
+	ch.busy = true
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		w.sem <- struct{}{}
+		w.write(events)
+		<-w.sem
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		ch.busy = false
+		if len(ch.events) >= w.cfg.maxCount || ch.bytes >= w.cfg.maxBytes || w.closed {
+			w.flushLocked(channelID, ch)
+		}
+	}()
+}
+
+// write sends the events of a channel, one message per event or packed
+func (w *BatchWriter) write(events []*batchEvent) {
+	if !w.cfg.pack {
+		for _, ev := range events {
+			reply, err := w.client.MessageWrite(w.ctx, ev.req)
+			w.complete(ev, reply, err)
+		}
+		return
+	}
+
+	for len(events) > 0 {
+		n, size := 0, 16
+		for n < len(events) && n < w.cfg.maxCount {
+			s := base64.StdEncoding.EncodedLen(len(events[n].req.Message)) + len(events[n].req.ContentType) + batchEventOverhead
+			if n > 0 && size+s > w.client.cfg.maxMessageSize {
+				break
+			}
+			size += s
+			n++
+		}
+
+		w.writePack(events[:n])
+		events = events[n:]
+	}
+}
+
+// writePack sends events in one batch message
+func (w *BatchWriter) writePack(events []*batchEvent) {
+	if len(events) == 1 {
+		reply, err := w.client.MessageWrite(w.ctx, events[0].req)
+		w.complete(events[0], reply, err)
+		return
+	}
+
+	b := BatchMessage{
+		Version: BatchVersion,
+		Events:  make([]BatchEvent, 0, len(events)),
+	}
+	for _, ev := range events {
+		b.Events = append(b.Events, BatchEvent{
+			ContentType: ev.req.ContentType,
+			Body:        []byte(ev.req.Message),
+		})
+	}
+
+	data, err := json.Marshal(b)
+	var reply *MessageWriteReply
+	if err == nil {
+		reply, err = w.client.MessageWrite(w.ctx, MessageWriteRequest{
+			ChannelID:   events[0].req.ChannelID,
+			Message:     string(data),
+			ContentType: BatchContentType,
+		})
+	}
+
+	for _, ev := range events {
+		w.complete(ev, reply, err)
+	}
+}
+
+// complete resolves the future of an event and calls the callback
+func (w *BatchWriter) complete(ev *batchEvent, reply *MessageWriteReply, err error) {
+	ev.future.complete(reply, err)
+	if w.cfg.callback != nil {
+		w.cfg.callback(ev.req, reply, err)
+	}
+}
+
+// Close flushes the buffered events and waits for all writes to complete.
+// If the context is done first, the pending writes are cancelled.
+// Writes after Close fail with ErrBatchWriterClosed
+func (w *BatchWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.stop)
+	for id, ch := range w.channels {
+		w.flushLocked(id, ch)
+	}
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	defer w.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		w.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
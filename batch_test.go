@@ -0,0 +1,135 @@
+package spvchannels
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitBatchWriter(t *testing.T) {
+	tests := map[string]struct {
+		opts     []BatchConfigFunc
+		messages int
+	}{
+		"One message per event": {
+			opts:     []BatchConfigFunc{WithBatchSize(4, 1<<20), WithBatchInterval(0)},
+			messages: 10,
+		},
+		"Packed by count": {
+			opts:     []BatchConfigFunc{WithBatchSize(4, 1<<20), WithBatchInterval(0), WithBatchPacking()},
+			messages: 3,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newMockServer()
+			var mu sync.Mutex
+			called := 0
+			opts := append(test.opts, WithBatchCallback(func(r MessageWriteRequest, reply *MessageWriteReply, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				called++
+			}))
+			w := NewBatchWriter(newMockClient(s), opts...)
+
+			futures := []*WriteFuture{}
+			for i := 0; i < 10; i++ {
+				futures = append(futures, w.Write(MessageWriteRequest{
+					ChannelID:   "channel",
+					Message:     strconv.Itoa(i),
+					ContentType: "text/plain",
+				}))
+			}
+			assert.NoError(t, w.Close(context.Background()))
+
+			for _, f := range futures {
+				reply, err := f.Wait(context.Background())
+				assert.NoError(t, err)
+				assert.NotNil(t, reply)
+			}
+			assert.Equal(t, 10, called)
+
+			msgs := s.messages("channel")
+			assert.Len(t, msgs, test.messages)
+
+			events := []string{}
+			for _, m := range msgs {
+				unpacked, err := UnpackBatch(m.MessageWriteReply)
+				assert.NoError(t, err)
+				for _, e := range unpacked {
+					payload, _ := e.DecodePayload()
+					events = append(events, string(payload))
+					assert.Equal(t, "text/plain", e.ContentType)
+				}
+			}
+			assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}, events)
+
+			f := w.Write(MessageWriteRequest{ChannelID: "channel", Message: "late"})
+			_, err := f.Wait(context.Background())
+			assert.ErrorIs(t, err, ErrBatchWriterClosed)
+		})
+	}
+}
+
+func TestUnitBatchWriterPackSize(t *testing.T) {
+	s := newMockServer()
+	client := NewClient(WithBaseURL("somedomain"), WithMaxMessageSize(300))
+	client.HTTPClient = s
+
+	w := NewBatchWriter(client, WithBatchInterval(0), WithBatchPacking())
+	for i := 0; i < 6; i++ {
+		w.Write(MessageWriteRequest{ChannelID: "channel", Message: "0123456789012345678901234567890123456789"})
+	}
+	assert.NoError(t, w.Close(context.Background()))
+
+	msgs := s.messages("channel")
+	assert.Greater(t, len(msgs), 1)
+	total := 0
+	for _, m := range msgs {
+		payload, _ := m.DecodePayload()
+		assert.LessOrEqual(t, len(payload), 300)
+		unpacked, err := UnpackBatch(m.MessageWriteReply)
+		assert.NoError(t, err)
+		total += len(unpacked)
+	}
+	assert.Equal(t, 6, total)
+}
+
+func TestUnitBatchWriterInterval(t *testing.T) {
+	s := newMockServer()
+	w := NewBatchWriter(newMockClient(s), WithBatchInterval(5*time.Millisecond))
+	defer func() {
+		_ = w.Close(context.Background())
+	}()
+
+	f := w.Write(MessageWriteRequest{ChannelID: "a", Message: "1"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := f.Wait(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, s.messages("a"), 1)
+}
+
+func TestUnitBatchWriterFailure(t *testing.T) {
+	s := newMockServer()
+	s.failNext(http.MethodPost, 1)
+	w := NewBatchWriter(newMockClient(s), WithBatchInterval(0), WithBatchPacking())
+
+	first := w.Write(MessageWriteRequest{ChannelID: "a", Message: "1"})
+	second := w.Write(MessageWriteRequest{ChannelID: "b", Message: "2"})
+	assert.NoError(t, w.Close(context.Background()))
+
+	errs := 0
+	for _, f := range []*WriteFuture{first, second} {
+		if _, err := f.Wait(context.Background()); err != nil {
+			errs++
+		}
+	}
+	assert.Equal(t, 1, errs)
+}
@@ -0,0 +1,282 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrSequenceNotFound is reported for a sequence which is not in the channel
+var ErrSequenceNotFound = errors.New("sequence not found in channel")
+
+// ErrBulkPartial is returned by bulk operations when some sequences failed.
+// The failures are detailed in the report
+type ErrBulkPartial struct {
+	Failed int
+	Total  int
+}
+
+func (e ErrBulkPartial) Error() string {
+	return fmt.Sprintf("bulk operation failed for %d of %d sequences", e.Failed, e.Total)
+}
+
+// BulkReport hold the result of a bulk operation for each sequence it covered
+type BulkReport struct {
+	// Results map each sequence to its error, nil on success
+	Results map[int64]error
+	// Calls is the number of requests sent to the server
+	Calls int
+}
+
+// Succeeded return the sequences which succeeded, in ascending order
+func (r *BulkReport) Succeeded() []int64 {
+	res := []int64{}
+	for seq, err := range r.Results {
+		if err == nil {
+			res = append(res, seq)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
+
+// Failed return the sequences which failed with their error
+func (r *BulkReport) Failed() map[int64]error {
+	res := map[int64]error{}
+	for seq, err := range r.Results {
+		if err != nil {
+			res[seq] = err
+		}
+	}
+	return res
+}
+
+// err return ErrBulkPartial if any sequence failed
+func (r *BulkReport) err() error {
+	if n := len(r.Failed()); n > 0 {
+		return ErrBulkPartial{Failed: n, Total: len(r.Results)}
+	}
+	return nil
+}
+
+// bulkConfig hold configuration of bulk operations
+type bulkConfig struct {
+	concurrency int
+}
+
+// BulkConfigFunc set the bulk operations configuration
+type BulkConfigFunc func(c *bulkConfig)
+
+// WithBulkConcurrency set the maximum number of concurrent requests. Default is 8
+func WithBulkConcurrency(n int) BulkConfigFunc {
+	return func(c *bulkConfig) {
+		c.concurrency = n
+	}
+}
+
+// bulkCall is a request covering one or several sequences
+type bulkCall struct {
+	seqs []int64
+	do   func(ctx context.Context) error
+}
+
+// runBulk execute the calls with bounded concurrency and report the result of each sequence
+func runBulk(ctx context.Context, calls []bulkCall, report *BulkReport, opts ...BulkConfigFunc) (*BulkReport, error) {
+	cfg := &bulkConfig{
+		concurrency: 8,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.concurrency < 1 {
+		cfg.concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, cfg.concurrency)
+	for _, call := range calls {
+		call := call
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := ctx.Err()
+			if err == nil {
+				err = call.do(ctx)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Calls++
+			for _, seq := range call.seqs {
+				report.Results[seq] = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	return report, report.err()
+}
+
+// channelState list the sequences of a channel and tells which are read
+func (c *Client) channelState(ctx context.Context, channelID string) ([]int64, map[int64]bool, error) {
+	all, err := c.collect(ctx, channelID, MessageFilter{})
+	if err != nil {
+		return nil, nil, err
+	}
+	unread, err := c.Messages(ctx, MessagesRequest{ChannelID: channelID, UnRead: true})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	read := map[int64]bool{}
+	seqs := make([]int64, 0, len(all))
+	for _, msg := range all {
+		seqs = append(seqs, msg.Sequence)
+		read[msg.Sequence] = true
+	}
+	for _, msg := range unread {
+		read[msg.Sequence] = false
+	}
+	return seqs, read, nil
+}
+
+// MarkRange mark the messages of a channel from the sequence from to the
+// sequence to included as read or unread. See MarkSet
+func (c *Client) MarkRange(ctx context.Context, channelID string, from, to int64, read bool, opts ...BulkConfigFunc) (*BulkReport, error) {
+	seqs, state, err := c.channelState(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	set := []int64{}
+	for _, seq := range seqs {
+		if seq >= from && seq <= to {
+			set = append(set, seq)
+		}
+	}
+	return c.markSet(ctx, channelID, set, read, seqs, state, opts...)
+}
+
+// MarkSet mark the given messages of a channel as read or unread.
+//
+// The longest run of the channel, from its oldest message, made of marked
+// messages and messages already in the wanted state is marked by a single
+// request with Older set. The other messages are marked one request each.
+// Sequences not in the channel are reported with ErrSequenceNotFound.
+//
+// The returned error is ErrBulkPartial when some sequences failed, or the
+// error listing the channel
+func (c *Client) MarkSet(ctx context.Context, channelID string, sequences []int64, read bool, opts ...BulkConfigFunc) (*BulkReport, error) {
+	seqs, state, err := c.channelState(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	return c.markSet(ctx, channelID, sequences, read, seqs, state, opts...)
+}
+
+func (c *Client) markSet(ctx context.Context, channelID string, sequences []int64, read bool,
+	seqs []int64, state map[int64]bool, opts ...BulkConfigFunc) (*BulkReport, error) {
+	report := &BulkReport{Results: map[int64]error{}}
+	wanted := map[int64]bool{}
+	for _, seq := range sequences {
+		if _, ok := state[seq]; !ok {
+			report.Results[seq] = ErrSequenceNotFound
+			continue
+		}
+		wanted[seq] = true
+	}
+
+	// Find the run from the oldest message which can be marked with Older set
+	run := []int64{}
+	var cut int64
+	for _, seq := range seqs {
+		if wanted[seq] {
+			run = append(run, seq)
+			cut = seq
+			continue
+		}
+		if state[seq] != read {
+			break
+		}
+	}
+
+	calls := []bulkCall{}
+	if len(run) > 1 {
+		calls = append(calls, bulkCall{
+			seqs: run,
+			do: func(ctx context.Context) error {
+				return c.MessageMark(ctx, MessageMarkRequest{ChannelID: channelID, Sequence: cut, Older: true, Read: read})
+			},
+		})
+		for _, seq := range run {
+			delete(wanted, seq)
+		}
+	}
+	for _, seq := range seqs {
+		if !wanted[seq] {
+			continue
+		}
+		seq := seq
+		calls = append(calls, bulkCall{
+			seqs: []int64{seq},
+			do: func(ctx context.Context) error {
+				return c.MessageMark(ctx, MessageMarkRequest{ChannelID: channelID, Sequence: seq, Read: read})
+			},
+		})
+	}
+
+	return runBulk(ctx, calls, report, opts...)
+}
+
+// DeleteRange delete the messages of a channel from the sequence from to the
+// sequence to included. See DeleteWhere
+func (c *Client) DeleteRange(ctx context.Context, channelID string, from, to int64, opts ...BulkConfigFunc) (*BulkReport, error) {
+	return c.DeleteWhere(ctx, channelID, func(msg MessageWriteReply) bool {
+		return msg.Sequence >= from && msg.Sequence <= to
+	}, opts...)
+}
+
+// DeleteWhere delete the messages of a channel for which the predicate
+// return true, one request each.
+//
+// The returned error is ErrBulkPartial when some sequences failed, or the
+// error listing the channel
+func (c *Client) DeleteWhere(ctx context.Context, channelID string, predicate func(msg MessageWriteReply) bool,
+	opts ...BulkConfigFunc) (*BulkReport, error) {
+	it, err := c.MessageIterator(ctx, MessagesRequest{ChannelID: channelID}, MessageFilter{})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = it.Close()
+	}()
+
+	calls := []bulkCall{}
+	for it.Next() {
+		msg := it.Message()
+		if !predicate(msg) {
+			continue
+		}
+		calls = append(calls, bulkCall{
+			seqs: []int64{msg.Sequence},
+			do: func(ctx context.Context) error {
+				return c.MessageDelete(ctx, MessageDeleteRequest{ChannelID: channelID, Sequence: msg.Sequence})
+			},
+		})
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return runBulk(ctx, calls, &BulkReport{Results: map[int64]error{}}, opts...)
+}
@@ -0,0 +1,124 @@
+package spvchannels
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readSequences(s *mockServer, channelID string) []int64 {
+	res := []int64{}
+	for _, m := range s.messages(channelID) {
+		if m.read {
+			res = append(res, m.Sequence)
+		}
+	}
+	return res
+}
+
+func TestUnitMarkSet(t *testing.T) {
+	tests := map[string]struct {
+		preRead  []int64
+		seqs     []int64
+		expRead  []int64
+		expCalls int
+		expErr   error
+	}{
+		"Contiguous from the oldest": {
+			seqs:     []int64{1, 2, 3, 4},
+			expRead:  []int64{1, 2, 3, 4},
+			expCalls: 1,
+		},
+		"Run through already read messages": {
+			preRead:  []int64{2},
+			seqs:     []int64{1, 3, 5},
+			expRead:  []int64{1, 2, 3, 5},
+			expCalls: 2,
+		},
+		"Not from the oldest": {
+			seqs:     []int64{2, 3},
+			expRead:  []int64{2, 3},
+			expCalls: 2,
+		},
+		"Missing sequence": {
+			seqs:     []int64{1, 2, 9},
+			expRead:  []int64{1, 2},
+			expCalls: 1,
+			expErr:   ErrBulkPartial{Failed: 1, Total: 3},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newMockServer()
+			client := newMockClient(s)
+			ctx := context.Background()
+			for i := 0; i < 5; i++ {
+				s.add("channel", "text/plain", []byte("m"))
+			}
+			for _, seq := range test.preRead {
+				assert.NoError(t, client.MessageMark(ctx, MessageMarkRequest{ChannelID: "channel", Sequence: seq, Read: true}))
+			}
+
+			report, err := client.MarkSet(ctx, "channel", test.seqs, true)
+			if test.expErr != nil {
+				assert.Equal(t, test.expErr, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, test.expCalls, report.Calls)
+			assert.Equal(t, test.expRead, readSequences(s, "channel"))
+		})
+	}
+}
+
+func TestUnitMarkRange(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+	for i := 0; i < 6; i++ {
+		s.add("channel", "text/plain", []byte("m"))
+	}
+	assert.NoError(t, client.MessageDelete(ctx, MessageDeleteRequest{ChannelID: "channel", Sequence: 3}))
+	_, err := client.MarkSet(ctx, "channel", []int64{1, 2, 4, 5, 6}, true)
+	assert.NoError(t, err)
+
+	report, err := client.MarkRange(ctx, "channel", 2, 5, false, WithBulkConcurrency(2))
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2, 4, 5}, report.Succeeded())
+	assert.Equal(t, 3, report.Calls)
+	assert.Equal(t, []int64{1, 6}, readSequences(s, "channel"))
+}
+
+func TestUnitDeleteWhere(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+	for i := 0; i < 6; i++ {
+		s.add("channel", "text/plain", []byte("m"))
+	}
+
+	report, err := client.DeleteWhere(ctx, "channel", func(msg MessageWriteReply) bool {
+		return msg.Sequence%2 == 0
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2, 4, 6}, report.Succeeded())
+
+	s.failNext(http.MethodDelete, 1)
+	report, err = client.DeleteRange(ctx, "channel", 1, 4, WithBulkConcurrency(1))
+	assert.Equal(t, ErrBulkPartial{Failed: 1, Total: 2}, err)
+	assert.Equal(t, []int64{3}, report.Succeeded())
+	assert.EqualError(t, report.Failed()[1], "mock failure")
+
+	seqs := []int64{}
+	for _, m := range s.messages("channel") {
+		seqs = append(seqs, m.Sequence)
+	}
+	assert.Equal(t, []int64{1, 5}, seqs)
+
+	s.failNext(http.MethodGet, 1)
+	_, err = client.DeleteRange(ctx, "channel", 1, 4)
+	assert.Error(t, err)
+}
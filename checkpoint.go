@@ -0,0 +1,154 @@
+package spvchannels
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CheckpointStore persists the last processed sequence of a consumer
+// for each channel
+type CheckpointStore interface {
+	// Load return the last processed sequence of the channel, 0 if none
+	Load(ctx context.Context, channelID string) (int64, error)
+	// Save record seq as the last processed sequence of the channel
+	Save(ctx context.Context, channelID string, seq int64) error
+}
+
+// MemoryCheckpointStore is a CheckpointStore keeping checkpoints in memory.
+// Checkpoints are lost when the process exit
+type MemoryCheckpointStore struct {
+	mu          sync.Mutex
+	checkpoints map[string]int64
+}
+
+// NewMemoryCheckpointStore create an empty in memory checkpoint store
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{
+		checkpoints: make(map[string]int64),
+	}
+}
+
+// Load implements CheckpointStore
+func (s *MemoryCheckpointStore) Load(ctx context.Context, channelID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoints[channelID], nil
+}
+
+// Save implements CheckpointStore
+func (s *MemoryCheckpointStore) Save(ctx context.Context, channelID string, seq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[channelID] = seq
+	return nil
+}
+
+// FileCheckpointStore is a CheckpointStore keeping the checkpoints of all
+// channels in a JSON file.
+//
+// Every Save writes a temporary file, syncs it to disk and renames it over
+// the previous one, so the file always holds a complete set of checkpoints
+type FileCheckpointStore struct {
+	mu          sync.Mutex
+	path        string
+	checkpoints map[string]int64
+}
+
+// NewFileCheckpointStore create a checkpoint store backed by the file at path,
+// loading the checkpoints it already holds
+func NewFileCheckpointStore(path string) (*FileCheckpointStore, error) {
+	s := &FileCheckpointStore{
+		path:        path,
+		checkpoints: make(map[string]int64),
+	}
+
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.checkpoints); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load implements CheckpointStore
+func (s *FileCheckpointStore) Load(ctx context.Context, channelID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoints[channelID], nil
+}
+
+// Save implements CheckpointStore
+func (s *FileCheckpointStore) Save(ctx context.Context, channelID string, seq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.checkpoints[channelID]
+	s.checkpoints[channelID] = seq
+	if err := s.flush(); err != nil {
+		if ok {
+			s.checkpoints[channelID] = prev
+		} else {
+			delete(s.checkpoints, channelID)
+		}
+		return err
+	}
+	return nil
+}
+
+// flush atomically replace the file content with the checkpoints
+func (s *FileCheckpointStore) flush() error {
+	data, err := json.Marshal(s.checkpoints)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(s.path, data)
+}
+
+// writeFileSync write data to a temporary file, syncs it and renames it to path
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(filepath.Clean(tmp), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// syncDir syncs the directory of path so a rename to path is durable
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+	return dir.Sync()
+}
@@ -0,0 +1,56 @@
+package spvchannels
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitCheckpointStore(t *testing.T) {
+	fileStore, err := NewFileCheckpointStore(filepath.Join(t.TempDir(), "checkpoints.json"))
+	assert.NoError(t, err)
+
+	tests := map[string]struct {
+		store CheckpointStore
+	}{
+		"Memory store": {
+			store: NewMemoryCheckpointStore(),
+		},
+		"File store": {
+			store: fileStore,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			seq, err := test.store.Load(ctx, "channel")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), seq)
+
+			assert.NoError(t, test.store.Save(ctx, "channel", 12))
+			assert.NoError(t, test.store.Save(ctx, "other", 3))
+
+			seq, err = test.store.Load(ctx, "channel")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(12), seq)
+		})
+	}
+}
+
+func TestUnitFileCheckpointStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	ctx := context.Background()
+
+	s, err := NewFileCheckpointStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Save(ctx, "channel", 7))
+
+	s, err = NewFileCheckpointStore(path)
+	assert.NoError(t, err)
+	seq, err := s.Load(ctx, "channel")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), seq)
+}
@@ -0,0 +1,422 @@
+package spvchannels
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ChunkContentType is the content type of the parts of a chunked message
+const ChunkContentType = "application/vnd.spvchannels.chunk"
+
+// ChunkVersion is the version of the chunk header format
+const ChunkVersion = 1
+
+// maxChunkHeaderSize is an upper bound of the encoded size of a chunkHeader
+const maxChunkHeaderSize = 512
+
+// maxDoneTransfers is the number of assembled transfer ids remembered to ignore their parts
+const maxDoneTransfers = 1024
+
+// defaultMaxPendingTransfers is the default number of incomplete transfers
+// an assembler holds
+const defaultMaxPendingTransfers = 64
+
+var (
+	// ErrChunkHash is returned when an assembled payload does not match the hash of its parts
+	ErrChunkHash = errors.New("chunked message hash mismatch")
+	// ErrChunkTooLarge is returned when a chunked message exceeds the assembler maximum size
+	ErrChunkTooLarge = errors.New("chunked message exceeds the maximum size")
+)
+
+// ErrChunkCleanup is returned by MessagesAssembled when the parts of
+// assembled messages could not be marked or deleted. The assembled messages
+// are still returned, the parts left must be cleaned up by the caller
+type ErrChunkCleanup struct {
+	Sequences []int64
+	Err       error
+}
+
+func (e ErrChunkCleanup) Error() string {
+	return fmt.Sprintf("unable to clean up %d parts : %s", len(e.Sequences), e.Err)
+}
+
+// Unwrap return the first cleanup error
+func (e ErrChunkCleanup) Unwrap() error {
+	return e.Err
+}
+
+// chunkHeader is the header of a part of a chunked message.
+//
+// A part content is the JSON encoded header, a new line, then the part data
+type chunkHeader struct {
+	Version     int    `json:"v"`
+	TransferID  string `json:"id"`
+	Index       int    `json:"i"`
+	Total       int    `json:"n"`
+	Size        int    `json:"size"`
+	Hash        string `json:"hash"`
+	ContentType string `json:"cty,omitempty"`
+}
+
+// ChunkCleanup defines what happens to the parts of a chunked message once it is assembled
+type ChunkCleanup int
+
+const (
+	// ChunkKeep leave the parts untouched
+	ChunkKeep ChunkCleanup = iota
+	// ChunkMarkRead mark the parts as read
+	ChunkMarkRead
+	// ChunkDelete delete the parts
+	ChunkDelete
+)
+
+// MessageWriteChunked writes a message larger than the maximum message size
+// as several numbered parts. A message fitting in one message is written as is.
+//
+// Each part carries the transfer id, its index, the number of parts and the
+// hash of the whole message, so a ChunkAssembler can rebuild it.
+// It returns the replies of the written parts.
+func (c *Client) MessageWriteChunked(ctx context.Context, r MessageWriteRequest) ([]MessageWriteReply, error) {
+	if len(r.Message) <= c.cfg.maxMessageSize {
+		reply, err := c.MessageWrite(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		return []MessageWriteReply{*reply}, nil
+	}
+
+	if len(r.ContentType) > maxChunkHeaderSize/2 {
+		return nil, errors.New("content type too long for a chunked message")
+	}
+	chunkSize := c.cfg.maxMessageSize - maxChunkHeaderSize
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("maximum message size %d too small : %w", c.cfg.maxMessageSize, ErrMessageTooLarge)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(r.Message))
+
+	h := chunkHeader{
+		Version:     ChunkVersion,
+		TransferID:  hex.EncodeToString(id),
+		Total:       (len(r.Message) + chunkSize - 1) / chunkSize,
+		Size:        len(r.Message),
+		Hash:        hex.EncodeToString(hash[:]),
+		ContentType: r.ContentType,
+	}
+
+	replies := make([]MessageWriteReply, 0, h.Total)
+	for h.Index = 0; h.Index < h.Total; h.Index++ {
+		start := h.Index * chunkSize
+		end := start + chunkSize
+		if end > len(r.Message) {
+			end = len(r.Message)
+		}
+
+		header, err := json.Marshal(h)
+		if err != nil {
+			return replies, err
+		}
+
+		reply, err := c.MessageWrite(ctx, MessageWriteRequest{
+			ChannelID:   r.ChannelID,
+			Message:     string(header) + "\n" + r.Message[start:end],
+			ContentType: ChunkContentType,
+		})
+		if err != nil {
+			return replies, fmt.Errorf("unable to write part %d of %d : %w", h.Index+1, h.Total, err)
+		}
+		replies = append(replies, *reply)
+	}
+
+	return replies, nil
+}
+
+// ChunkedMessage is a message assembled from its parts.
+// Its sequence and received time are those of the last received part
+type ChunkedMessage struct {
+	MessageWriteReply
+	TransferID string
+	Sequences  []int64
+}
+
+// chunkTransfer hold the parts received for a transfer
+type chunkTransfer struct {
+	header    chunkHeader
+	parts     map[int][]byte
+	sequences []int64
+	size      int
+	last      MessageWriteReply
+	elem      *list.Element
+}
+
+type chunkAssemblerConfig struct {
+	maxPending int
+}
+
+// ChunkAssemblerConfigFunc set a ChunkAssembler option
+type ChunkAssemblerConfigFunc func(c *chunkAssemblerConfig)
+
+// WithMaxPendingTransfers set the number of incomplete transfers held by the
+// assembler. Once reached, the oldest transfer is dropped to make room for a
+// new one, its parts are assembled again if they are read again. Default is 64
+func WithMaxPendingTransfers(n int) ChunkAssemblerConfigFunc {
+	return func(c *chunkAssemblerConfig) {
+		c.maxPending = n
+	}
+}
+
+// ChunkAssembler rebuilds the chunked messages from their parts.
+//
+// Parts can arrive in any order, interleaved with other messages and across
+// several reads. It is safe for concurrent use
+type ChunkAssembler struct {
+	mu        sync.Mutex
+	cfg       *chunkAssemblerConfig
+	maxSize   int
+	transfers map[string]*chunkTransfer
+	pending   *list.List
+	done      map[string]bool
+	doneOrder []string
+}
+
+// NewChunkAssembler create an assembler accepting chunked messages up to maxSize bytes
+func NewChunkAssembler(maxSize int, opts ...ChunkAssemblerConfigFunc) *ChunkAssembler {
+	cfg := &chunkAssemblerConfig{
+		maxPending: defaultMaxPendingTransfers,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.maxPending < 1 {
+		cfg.maxPending = 1
+	}
+
+	return &ChunkAssembler{
+		cfg:       cfg,
+		maxSize:   maxSize,
+		transfers: make(map[string]*chunkTransfer),
+		pending:   list.New(),
+		done:      make(map[string]bool),
+	}
+}
+
+// drop forget an incomplete transfer
+func (a *ChunkAssembler) drop(id string) {
+	if t, ok := a.transfers[id]; ok {
+		a.pending.Remove(t.elem)
+		delete(a.transfers, id)
+	}
+}
+
+// Add a part to the assembler. It returns the assembled message when the part
+// is the last missing one, nil otherwise. Parts of already assembled messages are ignored
+func (a *ChunkAssembler) Add(msg MessageWriteReply) (*ChunkedMessage, error) {
+	content, err := msg.DecodePayload()
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.IndexByte(content, '\n')
+	if i < 0 {
+		return nil, fmt.Errorf("part %d has no header", msg.Sequence)
+	}
+
+	var h chunkHeader
+	if err := json.Unmarshal(content[:i], &h); err != nil {
+		return nil, fmt.Errorf("part %d has an invalid header : %w", msg.Sequence, err)
+	}
+	if h.Version != ChunkVersion || h.Index < 0 || h.Index >= h.Total {
+		return nil, fmt.Errorf("part %d has an invalid header", msg.Sequence)
+	}
+	if h.Size > a.maxSize {
+		return nil, fmt.Errorf("transfer %s of %d bytes : %w", h.TransferID, h.Size, ErrChunkTooLarge)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.done[h.TransferID] {
+		return nil, nil
+	}
+
+	t, ok := a.transfers[h.TransferID]
+	if !ok {
+		if a.pending.Len() >= a.cfg.maxPending {
+			a.drop(a.pending.Front().Value.(string))
+		}
+		t = &chunkTransfer{
+			header: h,
+			parts:  make(map[int][]byte),
+			elem:   a.pending.PushBack(h.TransferID),
+		}
+		a.transfers[h.TransferID] = t
+	}
+	if h.Total != t.header.Total || h.Size != t.header.Size || h.Hash != t.header.Hash {
+		return nil, fmt.Errorf("part %d does not match transfer %s", msg.Sequence, h.TransferID)
+	}
+	if _, ok := t.parts[h.Index]; ok {
+		return nil, nil
+	}
+
+	data := content[i+1:]
+	if t.size+len(data) > h.Size {
+		a.drop(h.TransferID)
+		return nil, fmt.Errorf("transfer %s : %w", h.TransferID, ErrChunkTooLarge)
+	}
+	t.parts[h.Index] = data
+	t.size += len(data)
+	t.sequences = append(t.sequences, msg.Sequence)
+	if msg.Sequence >= t.last.Sequence {
+		t.last = msg
+	}
+
+	if len(t.parts) < h.Total {
+		return nil, nil
+	}
+
+	a.drop(h.TransferID)
+	a.done[h.TransferID] = true
+	a.doneOrder = append(a.doneOrder, h.TransferID)
+	if len(a.doneOrder) > maxDoneTransfers {
+		delete(a.done, a.doneOrder[0])
+		a.doneOrder = a.doneOrder[1:]
+	}
+
+	payload := make([]byte, 0, t.size)
+	for idx := 0; idx < h.Total; idx++ {
+		payload = append(payload, t.parts[idx]...)
+	}
+
+	hash := sha256.Sum256(payload)
+	if hex.EncodeToString(hash[:]) != h.Hash {
+		return nil, fmt.Errorf("transfer %s : %w", h.TransferID, ErrChunkHash)
+	}
+
+	sort.Slice(t.sequences, func(i, j int) bool {
+		return t.sequences[i] < t.sequences[j]
+	})
+
+	cm := &ChunkedMessage{
+		MessageWriteReply: t.last,
+		TransferID:        h.TransferID,
+		Sequences:         t.sequences,
+	}
+	cm.ContentType = h.ContentType
+	cm.Payload = base64.StdEncoding.EncodeToString(payload)
+	return cm, nil
+}
+
+// Pending return the number of transfers waiting for parts
+func (a *ChunkAssembler) Pending() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.transfers)
+}
+
+// MessagesAssembled get messages list and rebuilds the chunked messages with a.
+//
+// Other messages are returned as is. Assembled messages are returned at the
+// position of their last part, parts of incomplete messages are held by the
+// assembler until the next call. Once a message is assembled, its parts are
+// kept, marked as read or deleted according to cleanup. The assembler drops
+// the parts it assembled, so if the cleanup fails the messages are still
+// returned, with ErrChunkCleanup listing the parts left.
+//
+// Parts which can not be assembled are skipped and the other messages still
+// returned, with ErrRejected holding the error of each skipped part. The
+// cleanup failures are then reported in ErrRejected too, as the
+// ErrChunkCleanup of each part left
+func (c *Client) MessagesAssembled(ctx context.Context, r MessagesRequest, a *ChunkAssembler, cleanup ChunkCleanup) (MessagesReply, error) {
+	msgs, err := c.Messages(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	res := MessagesReply{}
+	rejected := make(map[int64]error)
+	var cleanupErr *ErrChunkCleanup
+	for _, msg := range msgs {
+		if mediaType(msg.ContentType) != ChunkContentType {
+			res = append(res, msg)
+			continue
+		}
+
+		cm, err := a.Add(msg)
+		if err != nil {
+			rejected[msg.Sequence] = err
+			continue
+		}
+		if cm == nil {
+			continue
+		}
+
+		res = append(res, cm.MessageWriteReply)
+		if left, err := c.cleanupChunks(ctx, r.ChannelID, cm.Sequences, cleanup); err != nil {
+			if cleanupErr == nil {
+				cleanupErr = &ErrChunkCleanup{Err: err}
+			}
+			cleanupErr.Sequences = append(cleanupErr.Sequences, left...)
+		}
+	}
+
+	if len(rejected) > 0 {
+		if cleanupErr != nil {
+			for _, seq := range cleanupErr.Sequences {
+				rejected[seq] = ErrChunkCleanup{Sequences: []int64{seq}, Err: cleanupErr.Err}
+			}
+		}
+		return res, ErrRejected{Errors: rejected}
+	}
+	if cleanupErr != nil {
+		return res, *cleanupErr
+	}
+	return res, nil
+}
+
+// cleanupChunks marks or deletes the parts of an assembled message. It
+// return the parts which failed with the first error
+func (c *Client) cleanupChunks(ctx context.Context, channelID string, sequences []int64, cleanup ChunkCleanup) ([]int64, error) {
+	var left []int64
+	var first error
+	for _, seq := range sequences {
+		var err error
+		switch cleanup {
+		case ChunkMarkRead:
+			if err = c.MessageMark(ctx, MessageMarkRequest{
+				ChannelID: channelID,
+				Sequence:  seq,
+				Read:      true,
+			}); err != nil {
+				err = fmt.Errorf("unable mark part as read : %w", err)
+			}
+		case ChunkDelete:
+			if err = c.MessageDelete(ctx, MessageDeleteRequest{
+				ChannelID: channelID,
+				Sequence:  seq,
+			}); err != nil {
+				err = fmt.Errorf("unable to delete part : %w", err)
+			}
+		}
+		if err != nil {
+			left = append(left, seq)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return left, first
+}
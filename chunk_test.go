@@ -0,0 +1,188 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitMessageWriteChunked(t *testing.T) {
+	tests := map[string]struct {
+		cleanup ChunkCleanup
+		parts   int
+		remain  int
+		read    bool
+	}{
+		"Keep parts": {
+			cleanup: ChunkKeep,
+			parts:   3,
+			remain:  5,
+		},
+		"Mark parts as read": {
+			cleanup: ChunkMarkRead,
+			parts:   3,
+			remain:  5,
+			read:    true,
+		},
+		"Delete parts": {
+			cleanup: ChunkDelete,
+			parts:   3,
+			remain:  2,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newMockServer()
+			client := NewClient(WithBaseURL("somedomain"), WithMaxMessageSize(1024))
+			client.HTTPClient = s
+			ctx := context.Background()
+
+			payload := strings.Repeat("0123456789", 150)
+			s.add("channel", "text/plain", []byte("before"))
+			replies, err := client.MessageWriteChunked(ctx, MessageWriteRequest{
+				ChannelID:   "channel",
+				Message:     payload,
+				ContentType: "text/plain",
+			})
+			assert.NoError(t, err)
+			assert.Len(t, replies, test.parts)
+			s.add("channel", "text/plain", []byte("after"))
+
+			for _, m := range s.messages("channel") {
+				assert.LessOrEqual(t, len(m.Payload)*3/4, 1024)
+			}
+
+			a := NewChunkAssembler(1 << 20)
+			msgs, err := client.MessagesAssembled(ctx, MessagesRequest{ChannelID: "channel"}, a, test.cleanup)
+			assert.NoError(t, err)
+			assert.Len(t, msgs, 3)
+
+			assembled, err := msgs[1].DecodePayload()
+			assert.NoError(t, err)
+			assert.Equal(t, payload, string(assembled))
+			assert.Equal(t, "text/plain", msgs[1].ContentType)
+			assert.Equal(t, int64(4), msgs[1].Sequence)
+
+			stored := s.messages("channel")
+			assert.Len(t, stored, test.remain)
+			if test.cleanup == ChunkMarkRead {
+				assert.True(t, stored[1].read)
+			}
+		})
+	}
+}
+
+func TestUnitMessagesAssembledCleanupFailure(t *testing.T) {
+	s := newMockServer()
+	client := NewClient(WithBaseURL("somedomain"), WithMaxMessageSize(1024))
+	client.HTTPClient = s
+	ctx := context.Background()
+
+	payload := strings.Repeat("0123456789", 150)
+	_, err := client.MessageWriteChunked(ctx, MessageWriteRequest{
+		ChannelID:   "channel",
+		Message:     payload,
+		ContentType: "text/plain",
+	})
+	assert.NoError(t, err)
+
+	// The first part can not be deleted, the message is returned anyway
+	s.failNext(http.MethodDelete, 1)
+	a := NewChunkAssembler(1 << 20)
+	msgs, err := client.MessagesAssembled(ctx, MessagesRequest{ChannelID: "channel"}, a, ChunkDelete)
+	var cleanupErr ErrChunkCleanup
+	assert.True(t, errors.As(err, &cleanupErr))
+	assert.Equal(t, []int64{1}, cleanupErr.Sequences)
+	assert.Len(t, msgs, 1)
+	assembled, err := msgs[0].DecodePayload()
+	assert.NoError(t, err)
+	assert.Equal(t, payload, string(assembled))
+	assert.Len(t, s.messages("channel"), 1)
+}
+
+func TestUnitMessagesAssembledBadPart(t *testing.T) {
+	s := newMockServer()
+	client := NewClient(WithBaseURL("somedomain"), WithMaxMessageSize(1024))
+	client.HTTPClient = s
+	ctx := context.Background()
+
+	bad := s.add("channel", ChunkContentType, []byte("no header"))
+	payload := strings.Repeat("0123456789", 150)
+	_, err := client.MessageWriteChunked(ctx, MessageWriteRequest{
+		ChannelID:   "channel",
+		Message:     payload,
+		ContentType: "text/plain",
+	})
+	assert.NoError(t, err)
+
+	// The bad part is skipped, the other message is still assembled
+	msgs, err := client.MessagesAssembled(ctx, MessagesRequest{ChannelID: "channel"}, NewChunkAssembler(1<<20), ChunkKeep)
+	var rejected ErrRejected
+	assert.True(t, errors.As(err, &rejected))
+	assert.Len(t, rejected.Errors, 1)
+	assert.Error(t, rejected.Errors[bad])
+	assert.Len(t, msgs, 1)
+	assembled, err := msgs[0].DecodePayload()
+	assert.NoError(t, err)
+	assert.Equal(t, payload, string(assembled))
+}
+
+func TestUnitChunkAssembler(t *testing.T) {
+	s := newMockServer()
+	client := NewClient(WithBaseURL("somedomain"), WithMaxMessageSize(612))
+	client.HTTPClient = s
+
+	_, err := client.MessageWriteChunked(context.Background(), MessageWriteRequest{
+		ChannelID: "channel",
+		Message:   strings.Repeat("a", 650),
+	})
+	assert.NoError(t, err)
+
+	stored := s.messages("channel")
+	assert.Len(t, stored, 7)
+
+	// Parts are accepted in any order
+	a := NewChunkAssembler(1 << 20)
+	for i := len(stored) - 1; i > 0; i-- {
+		cm, err := a.Add(stored[i].MessageWriteReply)
+		assert.NoError(t, err)
+		assert.Nil(t, cm)
+	}
+	assert.Equal(t, 1, a.Pending())
+
+	cm, err := a.Add(stored[0].MessageWriteReply)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2, 3, 4, 5, 6, 7}, cm.Sequences)
+	assert.Equal(t, 0, a.Pending())
+
+	// The oldest incomplete transfer is dropped once the assembler is full
+	a = NewChunkAssembler(1<<20, WithMaxPendingTransfers(1))
+	_, err = a.Add(stored[1].MessageWriteReply)
+	assert.NoError(t, err)
+	_, err = client.MessageWriteChunked(context.Background(), MessageWriteRequest{
+		ChannelID: "channel",
+		Message:   strings.Repeat("b", 650),
+	})
+	assert.NoError(t, err)
+	_, err = a.Add(s.messages("channel")[7].MessageWriteReply)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, a.Pending())
+	for _, msg := range stored[2:] {
+		cm, err := a.Add(msg.MessageWriteReply)
+		assert.NoError(t, err)
+		assert.Nil(t, cm)
+	}
+	assert.Equal(t, 1, a.Pending())
+	cm, err = a.Add(stored[0].MessageWriteReply)
+	assert.NoError(t, err)
+	assert.Nil(t, cm)
+
+	// Transfers larger than the maximum size are rejected
+	_, err = NewChunkAssembler(100).Add(stored[0].MessageWriteReply)
+	assert.True(t, errors.Is(err, ErrChunkTooLarge))
+}
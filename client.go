@@ -35,7 +35,6 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -79,6 +78,22 @@ type spvConfig struct {
 	channelID  string
 	procces    NotificationHandlerFunc
 	errHandler ErrorHandlerFunc
+
+	maxMessageSize int
+
+	compression          CompressionCodec
+	compressionMinSize   int
+	codecs               map[string]CompressionCodec
+	maxDecompressedSize  int
+	decompressErrHandler ErrorHandlerFunc
+	decryptErrHandler    ErrorHandlerFunc
+
+	handlerMode    HandlerMode
+	workers        int
+	queueSize      int
+	overflow       OverflowPolicy
+	handlerTimeout time.Duration
+	keyFunc        NotificationKeyFunc
 }
 
 func (s spvConfig) httpScheme() string {
@@ -178,6 +193,102 @@ func WithErrorHandler(e ErrorHandlerFunc) SPVConfigFunc {
 	}
 }
 
+// WithMaxMessageSize set the maximum size in bytes of a message content
+// accepted by the server (MaxMessageContentLength in the server settings).
+// Default is 65536
+func WithMaxMessageSize(n int) SPVConfigFunc {
+	return func(c *spvConfig) {
+		c.maxMessageSize = n
+	}
+}
+
+// WithCompression compresses the messages written with MessageWrite with the
+// codec, when they are at least minSize bytes long and compression reduces their size.
+//
+// The codec is recorded in the content type of the message, Messages decompresses
+// them transparently
+func WithCompression(codec CompressionCodec, minSize int) SPVConfigFunc {
+	return func(c *spvConfig) {
+		c.compression = codec
+		c.compressionMinSize = minSize
+		c.codecs[codec.Name()] = codec
+	}
+}
+
+// WithCompressionCodecs register additional codecs used by Messages to
+// decompress messages. GzipCodec and ZstdCodec are registered by default
+func WithCompressionCodecs(codecs ...CompressionCodec) SPVConfigFunc {
+	return func(c *spvConfig) {
+		for _, codec := range codecs {
+			c.codecs[codec.Name()] = codec
+		}
+	}
+}
+
+// WithMaxDecompressedSize set the maximum size of a decompressed message,
+// to guard against decompression bombs. Default is 16MiB
+func WithMaxDecompressedSize(n int) SPVConfigFunc {
+	return func(c *spvConfig) {
+		c.maxDecompressedSize = n
+	}
+}
+
+// WithDecompressErrorHandler provide the function receiving the ErrDecompress
+// of the messages Messages and MessageIterator can not decompress. Such
+// messages are returned still compressed, their content type keeping the codec
+func WithDecompressErrorHandler(e ErrorHandlerFunc) SPVConfigFunc {
+	return func(c *spvConfig) {
+		c.decompressErrHandler = e
+	}
+}
+
+// WithDecryptErrorHandler provide the function receiving the ErrDecrypt of
+// the messages MessagesDecrypted can not decrypt. Such messages are returned
+// still encrypted
+func WithDecryptErrorHandler(e ErrorHandlerFunc) SPVConfigFunc {
+	return func(c *spvConfig) {
+		c.decryptErrHandler = e
+	}
+}
+
+// WithHandlerMode set how notifications are dispatched to the callback function.
+//
+// HandlerModeSerial (default) process notifications one at a time.
+// HandlerModePool process notifications with the given number of workers.
+// HandlerModePerChannel process notifications of a same channel one at a time.
+func WithHandlerMode(m HandlerMode, workers int) SPVConfigFunc {
+	return func(c *spvConfig) {
+		c.handlerMode = m
+		c.workers = workers
+	}
+}
+
+// WithHandlerQueue set the size of the notification queue sitting between
+// the websocket reader and the callback function, and what to do when it is full
+func WithHandlerQueue(size int, p OverflowPolicy) SPVConfigFunc {
+	return func(c *spvConfig) {
+		c.queueSize = size
+		c.overflow = p
+	}
+}
+
+// WithHandlerTimeout set the deadline of the context given to the callback function
+// for each notification. Zero means no deadline
+func WithHandlerTimeout(d time.Duration) SPVConfigFunc {
+	return func(c *spvConfig) {
+		c.handlerTimeout = d
+	}
+}
+
+// WithNotificationKeyFunc provide the function used by HandlerModePerChannel
+// to group notifications by channel. By default all notifications belong to
+// the channel set by WithChannelID
+func WithNotificationKeyFunc(f NotificationKeyFunc) SPVConfigFunc {
+	return func(c *spvConfig) {
+		c.keyFunc = f
+	}
+}
+
 func defaultSPVConfig() *spvConfig {
 	// Set the default options
 	cfg := &spvConfig{
@@ -195,6 +306,19 @@ func defaultSPVConfig() *spvConfig {
 		errHandler: func(err error) {
 			fmt.Printf("received err: %s\n", err)
 		},
+		maxMessageSize: MaxMessageContentLength,
+		codecs: map[string]CompressionCodec{
+			GzipCodec.Name(): GzipCodec,
+			ZstdCodec.Name(): ZstdCodec,
+		},
+		maxDecompressedSize: defaultMaxDecompressedSize,
+		handlerMode:         HandlerModeSerial,
+		workers:             1,
+		queueSize:           64,
+		overflow:            OverflowBlock,
+	}
+	cfg.keyFunc = func(t int, msg []byte) string {
+		return cfg.channelID
 	}
 	return cfg
 }
@@ -274,6 +398,17 @@ type errorResponse struct {
 	Message string `json:"message"`
 }
 
+// ErrHTTPStatus is returned when the server replies with an error status code.
+// Message is the error message of the server response
+type ErrHTTPStatus struct {
+	Code    int
+	Message string
+}
+
+func (e ErrHTTPStatus) Error() string {
+	return e.Message
+}
+
 // successResponse hold structure of success rest call
 type successResponse struct {
 	Code int         `json:"code"`
@@ -282,16 +417,7 @@ type successResponse struct {
 
 // sendRequest send the http request and receive the response
 func (c *Client) sendRequest(req *http.Request, out interface{}) error {
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	req.Header.Set("Accept", "application/json; charset=utf-8")
-
-	if c.cfg.token == "" {
-		req.SetBasicAuth(c.cfg.user, c.cfg.passwd)
-	} else {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.cfg.token))
-	}
-
-	res, err := c.HTTPClient.Do(req)
+	res, err := c.doRequest(req)
 	if err != nil {
 		return err
 	}
@@ -300,15 +426,6 @@ func (c *Client) sendRequest(req *http.Request, out interface{}) error {
 		_ = res.Body.Close()
 	}()
 
-	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusBadRequest {
-		var errRes errorResponse
-		if err = json.NewDecoder(res.Body).Decode(&errRes); err == nil {
-			return errors.New(errRes.Message)
-		}
-
-		return fmt.Errorf("unknown error, status code: %d", res.StatusCode)
-	}
-
 	fullResponse := successResponse{
 		Code: res.StatusCode,
 		Data: out,
@@ -323,6 +440,47 @@ func (c *Client) sendRequest(req *http.Request, out interface{}) error {
 	return nil
 }
 
+// doRequest send the http request and return the response if its status is
+// a success. The caller must close the response body
+func (c *Client) doRequest(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	req.Header.Set("Accept", "application/json; charset=utf-8")
+
+	if c.cfg.token == "" {
+		req.SetBasicAuth(c.cfg.user, c.cfg.passwd)
+	} else {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.cfg.token))
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusBadRequest {
+		defer func() {
+			_ = res.Body.Close()
+		}()
+
+		var errRes errorResponse
+		if err = json.NewDecoder(res.Body).Decode(&errRes); err == nil {
+			return nil, ErrHTTPStatus{
+				Code:    res.StatusCode,
+				Message: errRes.Message,
+			}
+		}
+
+		return nil, ErrHTTPStatus{
+			Code:    res.StatusCode,
+			Message: fmt.Sprintf("unknown error, status code: %d", res.StatusCode),
+		}
+	}
+
+	return res, nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////
 
@@ -337,6 +495,7 @@ func (c *Client) sendRequest(req *http.Request, out interface{}) error {
 //    - number of received notifications
 type WSClient struct {
 	mu      sync.Mutex
+	closeMu sync.Mutex
 	cfg     *spvConfig
 	ws      *ws.Conn
 	close   chan bool
@@ -383,6 +542,18 @@ type WSClient struct {
 // To specify a callback function to process the notification
 //
 //   WithWebsocketCallBack(p PullUnreadMessages)
+//
+// To set the concurrency of the callback function (serial, pool of workers or per channel)
+//
+//   WithHandlerMode(m HandlerMode, workers int)
+//
+// To set the size and the overflow policy of the notification queue
+//
+//   WithHandlerQueue(size int, p OverflowPolicy)
+//
+// To set a deadline to the context of each callback call
+//
+//   WithHandlerTimeout(d time.Duration)
 func NewWSClient(opts ...SPVConfigFunc) (*WSClient, error) {
 	// Start with the defaults then overwrite config with any set by user
 	cfg := defaultSPVConfig()
@@ -449,6 +620,8 @@ func (c *WSClient) connectServer() error {
 // Close stops reading any notification and closes the websocket
 // Usually it is called from a separate goroutine
 func (c *WSClient) Close() {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
 	if c.close == nil {
 		return
 	}
@@ -461,7 +634,14 @@ func (c *WSClient) Close() {
 
 // Run establishes the connection and start listening the notification stream
 // process the notification if a callback is provided
+//
+// Notifications are queued and handed to the callback according to the
+// handler mode, so a slow callback does not stall the websocket reader
+// until the queue is full.
 func (c *WSClient) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := newDispatcher(ctx, c.cfg, c.Close)
+
 	go func() {
 		defer func() {
 			_ = recover()
@@ -472,16 +652,18 @@ func (c *WSClient) Run() {
 		c.mu.Unlock()
 		for {
 			t, msg, err := c.ws.ReadMessage()
-			if c.cfg.procces != nil {
-				if err2 := c.cfg.procces(context.Background(), t, msg, err); err2 != nil {
-					if errors.Is(err2, ErrWSClose{}) {
-						return
-					}
-					c.cfg.errHandler(err2)
-				}
+			if !d.dispatch(t, msg, err) {
+				return
+			}
+			if err != nil {
+				// The connection is failed, let the handler see the error then close
+				d.drain()
+				return
 			}
 		}
 	}()
 
 	<-c.close
+	cancel()
+	d.close()
 }
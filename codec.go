@@ -0,0 +1,167 @@
+package spvchannels
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrContentTypeMismatch is returned when decoding a message whose content type is not the codec one
+var ErrContentTypeMismatch = errors.New("message content type does not match the codec")
+
+// Codec encodes and decodes typed values to and from message contents.
+// JSONCodec and RawCodec are provided here, the protobuf and CBOR codecs are
+// in the codec/protobufcodec and codec/cborcodec packages
+type Codec interface {
+	// ContentType return the content type of the encoded messages
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// jsonCodec is the JSON Codec
+type jsonCodec struct{}
+
+// JSONCodec encodes values with encoding/json
+var JSONCodec Codec = jsonCodec{}
+
+// ContentType implements Codec
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+// Marshal implements Codec
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements Codec
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// rawCodec is the raw bytes Codec
+type rawCodec struct{}
+
+// RawCodec writes []byte and string values as is, and reads them into *[]byte or *string
+var RawCodec Codec = rawCodec{}
+
+// ContentType implements Codec
+func (rawCodec) ContentType() string {
+	return "application/octet-stream"
+}
+
+// Marshal implements Codec
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return b, nil
+	case string:
+		return []byte(b), nil
+	}
+	return nil, fmt.Errorf("%T is not []byte or string", v)
+}
+
+// Unmarshal implements Codec
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch b := v.(type) {
+	case *[]byte:
+		*b = append([]byte{}, data...)
+		return nil
+	case *string:
+		*b = string(data)
+		return nil
+	}
+	return fmt.Errorf("%T is not *[]byte or *string", v)
+}
+
+// TypedMessage is a message decoded by a TypedChannel.
+// Err holds the error met decoding this message, Value is the zero value then
+type TypedMessage[T any] struct {
+	MessageWriteReply
+	Value T
+	Err   error
+}
+
+// TypedChannel writes and reads values of type T to a channel, encoded with a Codec
+type TypedChannel[T any] struct {
+	client    *Client
+	channelID string
+	codec     Codec
+}
+
+// NewTypedChannel create a TypedChannel of the channel channelID, encoding the values with codec
+func NewTypedChannel[T any](client *Client, channelID string, codec Codec) *TypedChannel[T] {
+	return &TypedChannel[T]{
+		client:    client,
+		channelID: channelID,
+		codec:     codec,
+	}
+}
+
+// Write encodes v and writes it to the channel with the codec content type
+func (t *TypedChannel[T]) Write(ctx context.Context, v T) (*MessageWriteReply, error) {
+	data, err := t.codec.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode message : %w", err)
+	}
+
+	return t.client.MessageWrite(ctx, MessageWriteRequest{
+		ChannelID:   t.channelID,
+		Message:     string(data),
+		ContentType: t.codec.ContentType(),
+	})
+}
+
+// Read get the unread messages of the channel and decodes them.
+//
+// A message which can not be decoded, or does not have the codec content type,
+// is returned with its decoding error in Err, the other messages are still decoded
+func (t *TypedChannel[T]) Read(ctx context.Context) ([]TypedMessage[T], error) {
+	msgs, err := t.client.Messages(ctx, MessagesRequest{
+		ChannelID: t.channelID,
+		UnRead:    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]TypedMessage[T], 0, len(msgs))
+	for _, msg := range msgs {
+		v, err := t.Decode(msg)
+		res = append(res, TypedMessage[T]{
+			MessageWriteReply: msg,
+			Value:             v,
+			Err:               err,
+		})
+	}
+	return res, nil
+}
+
+// Decode return the value encoded in a message
+func (t *TypedChannel[T]) Decode(msg MessageWriteReply) (T, error) {
+	var v T
+	if mediaType(msg.ContentType) != mediaType(t.codec.ContentType()) {
+		return v, fmt.Errorf("message %d of type %s : %w", msg.Sequence, msg.ContentType, ErrContentTypeMismatch)
+	}
+
+	payload, err := msg.DecodePayload()
+	if err != nil {
+		return v, err
+	}
+
+	// Pointer types are allocated, so codecs such as protobuf decode into the value itself
+	var target interface{} = &v
+	if rv := reflect.ValueOf(&v).Elem(); rv.Kind() == reflect.Pointer {
+		rv.Set(reflect.New(rv.Type().Elem()))
+		target = v
+	}
+
+	if err := t.codec.Unmarshal(payload, target); err != nil {
+		var zero T
+		return zero, fmt.Errorf("unable to decode message %d : %w", msg.Sequence, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,30 @@
+// Package cborcodec provides a spvchannels.Codec encoding values in CBOR
+// (RFC 8949). It is a separate package so the CBOR library is only a
+// dependency of the programs using it
+package cborcodec
+
+import (
+	"github.com/fxamacker/cbor/v2"
+	spv "github.com/libsv/go-spvchannels"
+)
+
+// codec is the CBOR Codec
+type codec struct{}
+
+// Codec encodes values in CBOR
+var Codec spv.Codec = codec{}
+
+// ContentType implements spvchannels.Codec
+func (codec) ContentType() string {
+	return "application/cbor"
+}
+
+// Marshal implements spvchannels.Codec
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+// Unmarshal implements spvchannels.Codec
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
@@ -0,0 +1,28 @@
+package cborcodec
+
+import (
+	"encoding/base64"
+	"testing"
+
+	spv "github.com/libsv/go-spvchannels"
+	"github.com/stretchr/testify/assert"
+)
+
+type value struct {
+	Name  string `cbor:"name"`
+	Count int    `cbor:"count"`
+}
+
+func TestUnitCBORCodec(t *testing.T) {
+	data, err := Codec.Marshal(&value{Name: "b", Count: 2})
+	assert.NoError(t, err)
+
+	ch := spv.NewTypedChannel[*value](nil, "channel", Codec)
+	v, err := ch.Decode(spv.MessageWriteReply{
+		Sequence:    1,
+		ContentType: Codec.ContentType(),
+		Payload:     base64.StdEncoding.EncodeToString(data),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &value{Name: "b", Count: 2}, v)
+}
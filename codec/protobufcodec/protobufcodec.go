@@ -0,0 +1,40 @@
+// Package protobufcodec provides a spvchannels.Codec encoding values in the
+// protobuf wire format. It is a separate package so the protobuf runtime is
+// only a dependency of the programs using it
+package protobufcodec
+
+import (
+	"fmt"
+
+	spv "github.com/libsv/go-spvchannels"
+	"google.golang.org/protobuf/proto"
+)
+
+// codec is the protobuf wire format Codec
+type codec struct{}
+
+// Codec encodes values implementing proto.Message in the protobuf wire format
+var Codec spv.Codec = codec{}
+
+// ContentType implements spvchannels.Codec
+func (codec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+// Marshal implements spvchannels.Codec
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal implements spvchannels.Codec
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
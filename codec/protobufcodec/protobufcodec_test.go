@@ -0,0 +1,29 @@
+package protobufcodec
+
+import (
+	"encoding/base64"
+	"testing"
+
+	spv "github.com/libsv/go-spvchannels"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestUnitProtobufCodec(t *testing.T) {
+	data, err := Codec.Marshal(wrapperspb.String("hello"))
+	assert.NoError(t, err)
+
+	ch := spv.NewTypedChannel[*wrapperspb.StringValue](nil, "channel", Codec)
+	v, err := ch.Decode(spv.MessageWriteReply{
+		Sequence:    1,
+		ContentType: Codec.ContentType(),
+		Payload:     base64.StdEncoding.EncodeToString(data),
+	})
+	assert.NoError(t, err)
+	assert.True(t, proto.Equal(wrapperspb.String("hello"), v))
+
+	_, err = Codec.Marshal(struct{}{})
+	assert.Error(t, err)
+	assert.Error(t, Codec.Unmarshal(data, &struct{}{}))
+}
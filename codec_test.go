@@ -0,0 +1,82 @@
+package spvchannels
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type codecTestValue struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestUnitTypedChannelCodecs(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("JSON", func(t *testing.T) {
+		s := newMockServer()
+		ch := NewTypedChannel[codecTestValue](newMockClient(s), "channel", JSONCodec)
+		_, err := ch.Write(ctx, codecTestValue{Name: "a", Count: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, "application/json", s.messages("channel")[0].ContentType)
+
+		msgs, err := ch.Read(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, msgs, 1)
+		assert.NoError(t, msgs[0].Err)
+		assert.Equal(t, codecTestValue{Name: "a", Count: 1}, msgs[0].Value)
+	})
+
+	t.Run("JSON pointer", func(t *testing.T) {
+		s := newMockServer()
+		ch := NewTypedChannel[*codecTestValue](newMockClient(s), "channel", JSONCodec)
+		_, err := ch.Write(ctx, &codecTestValue{Name: "b", Count: 2})
+		assert.NoError(t, err)
+
+		msgs, err := ch.Read(ctx)
+		assert.NoError(t, err)
+		assert.NoError(t, msgs[0].Err)
+		assert.Equal(t, &codecTestValue{Name: "b", Count: 2}, msgs[0].Value)
+	})
+
+	t.Run("Raw", func(t *testing.T) {
+		s := newMockServer()
+		ch := NewTypedChannel[[]byte](newMockClient(s), "channel", RawCodec)
+		_, err := ch.Write(ctx, []byte{0, 1, 2})
+		assert.NoError(t, err)
+
+		msgs, err := ch.Read(ctx)
+		assert.NoError(t, err)
+		assert.NoError(t, msgs[0].Err)
+		assert.Equal(t, []byte{0, 1, 2}, msgs[0].Value)
+	})
+
+	t.Run("Raw rejects other types", func(t *testing.T) {
+		ch := NewTypedChannel[codecTestValue](newMockClient(newMockServer()), "channel", RawCodec)
+		_, err := ch.Write(ctx, codecTestValue{})
+		assert.Error(t, err)
+	})
+}
+
+func TestUnitTypedChannelDecodeErrors(t *testing.T) {
+	s := newMockServer()
+	s.add("channel", "application/json", []byte(`{"name":"a","count":1}`))
+	s.add("channel", "application/json", []byte(`{"name":`))
+	s.add("channel", "text/plain", []byte("hello"))
+	s.add("channel", "application/json; charset=utf-8", []byte(`{"name":"d","count":4}`))
+
+	ch := NewTypedChannel[codecTestValue](newMockClient(s), "channel", JSONCodec)
+	msgs, err := ch.Read(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 4)
+
+	assert.NoError(t, msgs[0].Err)
+	assert.Equal(t, "a", msgs[0].Value.Name)
+	assert.Error(t, msgs[1].Err)
+	assert.Equal(t, codecTestValue{}, msgs[1].Value)
+	assert.ErrorIs(t, msgs[2].Err, ErrContentTypeMismatch)
+	assert.NoError(t, msgs[3].Err)
+	assert.Equal(t, 4, msgs[3].Value.Count)
+}
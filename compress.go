@@ -0,0 +1,221 @@
+package spvchannels
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// contentEncodingParam is the content type parameter recording the compression codec
+const contentEncodingParam = "content-encoding"
+
+// defaultMaxDecompressedSize bounds the size of a decompressed message
+const defaultMaxDecompressedSize = 16 << 20
+
+// ErrDecompressedTooLarge is returned when a message decompresses to more than the maximum decompressed size
+var ErrDecompressedTooLarge = errors.New("decompressed message exceeds the maximum size")
+
+// ErrDecompress is reported for a message which can not be decompressed
+type ErrDecompress struct {
+	Sequence int64
+	Err      error
+}
+
+func (e ErrDecompress) Error() string {
+	return fmt.Sprintf("unable to decompress message %d : %s", e.Sequence, e.Err)
+}
+
+// Unwrap return the decompression error
+func (e ErrDecompress) Unwrap() error {
+	return e.Err
+}
+
+// CompressionCodec compresses and decompresses message contents.
+//
+// The codec name is recorded in the content-encoding parameter of the message
+// content type, i.e "application/json; content-encoding=gzip"
+type CompressionCodec interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	// Decompress return the decompressed data, or ErrDecompressedTooLarge
+	// if it is larger than maxSize bytes
+	Decompress(data []byte, maxSize int) ([]byte, error)
+}
+
+// readLimited read r up to maxSize bytes
+func readLimited(r io.Reader, maxSize int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return data, nil
+}
+
+// gzipCodec is the gzip CompressionCodec
+type gzipCodec struct{}
+
+// GzipCodec is the gzip CompressionCodec
+var GzipCodec CompressionCodec = gzipCodec{}
+
+// Name implements CompressionCodec
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+// Compress implements CompressionCodec
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements CompressionCodec
+func (gzipCodec) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return readLimited(r, maxSize)
+}
+
+// zstdCodec is the zstd CompressionCodec
+type zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	err     error
+}
+
+// ZstdCodec is the zstd CompressionCodec
+var ZstdCodec CompressionCodec = &zstdCodec{}
+
+// Name implements CompressionCodec
+func (*zstdCodec) Name() string {
+	return "zstd"
+}
+
+// Compress implements CompressionCodec
+func (z *zstdCodec) Compress(data []byte) ([]byte, error) {
+	z.once.Do(func() {
+		z.encoder, z.err = zstd.NewWriter(nil)
+	})
+	if z.err != nil {
+		return nil, z.err
+	}
+	return z.encoder.EncodeAll(data, nil), nil
+}
+
+// Decompress implements CompressionCodec
+func (*zstdCodec) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r, err := zstd.NewReader(bytes.NewReader(data),
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxMemory(uint64(maxSize)+1),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	res, err := readLimited(r, maxSize)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, ErrDecompressedTooLarge
+	}
+	return res, err
+}
+
+// compressMessage compresses the message of a write request with the client
+// codec if it is large enough and compression reduces its size
+func (c *Client) compressMessage(r MessageWriteRequest) (MessageWriteRequest, error) {
+	codec := c.cfg.compression
+	if codec == nil || len(r.Message) < c.cfg.compressionMinSize {
+		return r, nil
+	}
+
+	data, err := codec.Compress([]byte(r.Message))
+	if err != nil {
+		return r, fmt.Errorf("unable to compress message : %w", err)
+	}
+	if len(data) >= len(r.Message) {
+		return r, nil
+	}
+
+	ct := r.ContentType
+	if ct == "" {
+		ct = "application/json; charset=utf-8"
+	}
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return r, fmt.Errorf("invalid content type %s : %w", ct, err)
+	}
+	params[contentEncodingParam] = codec.Name()
+
+	r.Message = string(data)
+	r.ContentType = mime.FormatMediaType(mt, params)
+	return r, nil
+}
+
+// decompressMessage decompresses a message whose content type records a
+// known codec, and removes the codec from its content type
+func (c *Client) decompressMessage(msg MessageWriteReply) (MessageWriteReply, error) {
+	mt, params, err := mime.ParseMediaType(msg.ContentType)
+	if err != nil {
+		return msg, nil
+	}
+
+	name, ok := params[contentEncodingParam]
+	if !ok {
+		return msg, nil
+	}
+
+	codec, ok := c.cfg.codecs[name]
+	if !ok {
+		return msg, nil
+	}
+
+	payload, err := msg.DecodePayload()
+	if err != nil {
+		return msg, ErrDecompress{Sequence: msg.Sequence, Err: err}
+	}
+
+	data, err := codec.Decompress(payload, c.cfg.maxDecompressedSize)
+	if err != nil {
+		return msg, ErrDecompress{Sequence: msg.Sequence, Err: err}
+	}
+
+	delete(params, contentEncodingParam)
+	msg.ContentType = mime.FormatMediaType(mt, params)
+	msg.Payload = base64.StdEncoding.EncodeToString(data)
+	return msg, nil
+}
+
+// decompressOrKeep decompresses a message. A message which can not be
+// decompressed is returned as is and its error given to the handler set by
+// WithDecompressErrorHandler
+func (c *Client) decompressOrKeep(msg MessageWriteReply) MessageWriteReply {
+	res, err := c.decompressMessage(msg)
+	if err != nil {
+		if c.cfg.decompressErrHandler != nil {
+			c.cfg.decompressErrHandler(err)
+		}
+		return msg
+	}
+	return res
+}
@@ -0,0 +1,173 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitCompression(t *testing.T) {
+	tests := map[string]struct {
+		codec       CompressionCodec
+		minSize     int
+		message     string
+		contentType string
+		compressed  bool
+		expectedCty string
+	}{
+		"Gzip": {
+			codec:       GzipCodec,
+			message:     strings.Repeat(`{"key":"value"}`, 100),
+			contentType: "application/json",
+			compressed:  true,
+			expectedCty: "application/json",
+		},
+		"Zstd": {
+			codec:       ZstdCodec,
+			message:     strings.Repeat(`{"key":"value"}`, 100),
+			contentType: "application/json",
+			compressed:  true,
+			expectedCty: "application/json",
+		},
+		"Default content type": {
+			codec:       GzipCodec,
+			message:     strings.Repeat(`{"key":"value"}`, 100),
+			compressed:  true,
+			expectedCty: "application/json; charset=utf-8",
+		},
+		"Below minimum size": {
+			codec:       GzipCodec,
+			minSize:     4096,
+			message:     strings.Repeat(`{"key":"value"}`, 100),
+			contentType: "application/json",
+			expectedCty: "application/json",
+		},
+		"Not reduced": {
+			codec:       GzipCodec,
+			message:     "a",
+			contentType: "text/plain",
+			expectedCty: "text/plain",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newMockServer()
+			client := NewClient(WithBaseURL("somedomain"), WithCompression(test.codec, test.minSize))
+			client.HTTPClient = s
+			ctx := context.Background()
+
+			_, err := client.MessageWrite(ctx, MessageWriteRequest{
+				ChannelID:   "channel",
+				Message:     test.message,
+				ContentType: test.contentType,
+			})
+			assert.NoError(t, err)
+
+			stored := s.messages("channel")
+			assert.Len(t, stored, 1)
+			assert.Equal(t, test.compressed, strings.Contains(stored[0].ContentType, "content-encoding="+test.codec.Name()))
+
+			msgs, err := client.Messages(ctx, MessagesRequest{ChannelID: "channel"})
+			assert.NoError(t, err)
+			assert.Len(t, msgs, 1)
+			assert.Equal(t, test.expectedCty, msgs[0].ContentType)
+			payload, err := msgs[0].DecodePayload()
+			assert.NoError(t, err)
+			assert.Equal(t, test.message, string(payload))
+		})
+	}
+}
+
+func TestUnitDecompressionLimit(t *testing.T) {
+	for _, codec := range []CompressionCodec{GzipCodec, ZstdCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			s := newMockServer()
+			bomb, err := codec.Compress(make([]byte, 1<<20))
+			assert.NoError(t, err)
+			s.add("channel", "application/octet-stream; content-encoding="+codec.Name(), bomb)
+
+			var errs []error
+			client := NewClient(WithBaseURL("somedomain"), WithMaxDecompressedSize(1024), WithDecompressErrorHandler(func(err error) {
+				errs = append(errs, err)
+			}))
+			client.HTTPClient = s
+
+			msgs, err := client.Messages(context.Background(), MessagesRequest{ChannelID: "channel"})
+			assert.NoError(t, err)
+			assert.Equal(t, "application/octet-stream; content-encoding="+codec.Name(), msgs[0].ContentType)
+			assert.Len(t, errs, 1)
+			assert.ErrorIs(t, errs[0], ErrDecompressedTooLarge)
+
+			client = NewClient(WithBaseURL("somedomain"))
+			client.HTTPClient = s
+
+			msgs, err = client.Messages(context.Background(), MessagesRequest{ChannelID: "channel"})
+			assert.NoError(t, err)
+			assert.Equal(t, "application/octet-stream", msgs[0].ContentType)
+			payload, err := msgs[0].DecodePayload()
+			assert.NoError(t, err)
+			assert.Len(t, payload, 1<<20)
+		})
+	}
+}
+
+func TestUnitDecompressionCorruptMessage(t *testing.T) {
+	for _, codec := range []CompressionCodec{GzipCodec, ZstdCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			s := newMockServer()
+			valid, err := codec.Compress([]byte("valid"))
+			assert.NoError(t, err)
+			s.add("channel", "text/plain; content-encoding="+codec.Name(), valid)
+			s.add("channel", "text/plain; content-encoding="+codec.Name(), []byte("corrupt"))
+			s.add("channel", "text/plain", []byte("plain"))
+
+			var errs []error
+			client := NewClient(WithBaseURL("somedomain"), WithDecompressErrorHandler(func(err error) {
+				errs = append(errs, err)
+			}))
+			client.HTTPClient = s
+
+			msgs, err := client.Messages(context.Background(), MessagesRequest{ChannelID: "channel"})
+			assert.NoError(t, err)
+			assert.Len(t, msgs, 3)
+			for i, want := range []string{"valid", "corrupt", "plain"} {
+				payload, err := msgs[i].DecodePayload()
+				assert.NoError(t, err)
+				assert.Equal(t, want, string(payload))
+			}
+			assert.Equal(t, "text/plain", msgs[0].ContentType)
+			assert.Equal(t, "text/plain; content-encoding="+codec.Name(), msgs[1].ContentType)
+
+			assert.Len(t, errs, 1)
+			var decompressErr ErrDecompress
+			assert.True(t, errors.As(errs[0], &decompressErr))
+			assert.Equal(t, int64(2), decompressErr.Sequence)
+
+			// The iterator reports the message the same way
+			errs = nil
+			it, err := client.MessageIterator(context.Background(), MessagesRequest{ChannelID: "channel"}, MessageFilter{})
+			assert.NoError(t, err)
+			n := 0
+			for it.Next() {
+				n++
+			}
+			assert.NoError(t, it.Err())
+			assert.Equal(t, 3, n)
+			assert.Len(t, errs, 1)
+		})
+	}
+}
+
+func TestUnitDecompressionUnknownCodec(t *testing.T) {
+	s := newMockServer()
+	s.add("channel", "text/plain; content-encoding=br", []byte("raw"))
+	client := newMockClient(s)
+
+	msgs, err := client.Messages(context.Background(), MessagesRequest{ChannelID: "channel"})
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain; content-encoding=br", msgs[0].ContentType)
+}
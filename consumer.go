@@ -0,0 +1,375 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// consumerConfig hold configuration of a channel consumer
+type consumerConfig struct {
+	store       CheckpointStore
+	markRead    bool
+	atMostOnce  bool
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	deadLetter  *deadLetterTarget
+	seen        SeenSet
+	gaps        *gapConfig
+	poison      *poisonConfig
+}
+
+// ConsumerConfigFunc set the consumer configuration
+type ConsumerConfigFunc func(c *consumerConfig)
+
+// WithCheckpointStore provide the store persisting the last processed sequence.
+// By default checkpoints are kept in memory
+func WithCheckpointStore(s CheckpointStore) ConsumerConfigFunc {
+	return func(c *consumerConfig) {
+		c.store = s
+	}
+}
+
+// WithMarkRead mark the processed messages as read on the server.
+// By default the consumer does not touch the server read flags
+func WithMarkRead() ConsumerConfigFunc {
+	return func(c *consumerConfig) {
+		c.markRead = true
+	}
+}
+
+// WithAtMostOnce save the checkpoint before calling the handler instead of after.
+//
+// A crash while the handler is running then loses the message instead of
+// delivering it again after restart
+func WithAtMostOnce() ConsumerConfigFunc {
+	return func(c *consumerConfig) {
+		c.atMostOnce = true
+	}
+}
+
+// WithMaxAttempts set the number of handler calls for a message before
+// giving up. Default is 1
+func WithMaxAttempts(n int) ConsumerConfigFunc {
+	return func(c *consumerConfig) {
+		c.maxAttempts = n
+	}
+}
+
+// WithAttemptBackoff set the delay between two handler calls for the same
+// message, doubled after each failure up to max. Default is 100 milliseconds
+// up to 5 seconds
+func WithAttemptBackoff(backoff, max time.Duration) ConsumerConfigFunc {
+	return func(c *consumerConfig) {
+		c.backoff = backoff
+		c.maxBackoff = max
+	}
+}
+
+// WithDeadLetter copy the messages still failing after the max attempts to
+// the channel channelID with the client, in a DeadLetter envelope.
+// The original message is then marked as read and the consumer moves on
+func WithDeadLetter(client *Client, channelID string) ConsumerConfigFunc {
+	return func(c *consumerConfig) {
+		c.deadLetter = &deadLetterTarget{
+			client:    client,
+			channelID: channelID,
+		}
+	}
+}
+
+// WithDeduplication skip the enveloped messages whose id is already in the
+// seen set, see Deduplicate
+func WithDeduplication(set SeenSet) ConsumerConfigFunc {
+	return func(c *consumerConfig) {
+		c.seen = set
+	}
+}
+
+func defaultConsumerConfig() *consumerConfig {
+	return &consumerConfig{
+		store:       NewMemoryCheckpointStore(),
+		maxAttempts: 1,
+		backoff:     100 * time.Millisecond,
+		maxBackoff:  5 * time.Second,
+	}
+}
+
+// Consumer process the messages of a channel in sequence order and records
+// the last processed sequence in a CheckpointStore.
+//
+// The consumer relies on its checkpoint only, it reads all the messages of
+// the channel whatever their read flag, so several consumers with their own
+// checkpoint store can process the same channel independently.
+// After a restart, it resumes after the saved checkpoint.
+//
+// The checkpoint is saved after each successful handler call: a sequence is
+// never delivered again once its checkpoint is saved. A crash between the
+// handler return and the checkpoint save delivers the message again, use
+// WithAtMostOnce to reverse this trade-off.
+type Consumer struct {
+	mu        sync.Mutex
+	cfg       *consumerConfig
+	client    *Client
+	channelID string
+	handler   MessageHandlerFunc
+	last      int64
+	loaded    bool
+	gap       gapState
+}
+
+// NewConsumer create a consumer of the channel channelID calling h for each message.
+//
+// Example of usage :
+//
+//	store, err := spv.NewFileCheckpointStore("/var/lib/app/checkpoints.json")
+//	consumer := spv.NewConsumer(client, channelid, router.Route,
+//		spv.WithCheckpointStore(store),
+//	)
+//	err = consumer.Run(ctx, 10*time.Second, nil)
+func NewConsumer(client *Client, channelID string, h MessageHandlerFunc, opts ...ConsumerConfigFunc) *Consumer {
+	cfg := defaultConsumerConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if cfg.seen != nil {
+		h = Deduplicate(cfg.seen, h)
+	}
+	if cfg.poison != nil {
+		if cfg.poison.store == nil {
+			cfg.poison.store = NewMemoryAttemptStore()
+		}
+		if cfg.poison.maxAttempts < 1 {
+			cfg.poison.maxAttempts = defaultPoisonAttempts
+		}
+	}
+
+	return &Consumer{
+		cfg:       cfg,
+		client:    client,
+		channelID: channelID,
+		handler:   h,
+	}
+}
+
+// Checkpoint return the last processed sequence
+func (c *Consumer) Checkpoint(ctx context.Context) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.load(ctx); err != nil {
+		return 0, err
+	}
+	return c.last, nil
+}
+
+// load read the checkpoint from the store on first use
+func (c *Consumer) load(ctx context.Context) error {
+	if c.loaded {
+		return nil
+	}
+
+	last, err := c.cfg.store.Load(ctx, c.channelID)
+	if err != nil {
+		return fmt.Errorf("unable to load checkpoint : %w", err)
+	}
+	c.last = last
+	c.loaded = true
+	return nil
+}
+
+// commit save seq as the last processed sequence
+func (c *Consumer) commit(ctx context.Context, seq int64) error {
+	if err := c.cfg.store.Save(ctx, c.channelID, seq); err != nil {
+		return fmt.Errorf("unable to save checkpoint : %w", err)
+	}
+	c.last = seq
+	return nil
+}
+
+// Pull fetch the channel messages and process the ones after the checkpoint.
+// It stops at the first error, the failed message is processed again by
+// the next call
+func (c *Consumer) Pull(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.load(ctx); err != nil {
+		return err
+	}
+
+	msgs, err := c.client.Messages(ctx, MessagesRequest{
+		ChannelID: c.channelID,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read messages : %w", err)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Sequence < msgs[j].Sequence
+	})
+
+	if c.cfg.gaps == nil {
+		for _, msg := range msgs {
+			if msg.Sequence <= c.last {
+				continue
+			}
+
+			if err := c.process(ctx, msg); err != nil {
+				if errors.Is(err, errAttemptDelayed) {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	}
+
+	var oldest int64
+	if len(msgs) > 0 {
+		oldest = msgs[0].Sequence
+	}
+	for _, msg := range c.merge(msgs) {
+		if msg.Sequence > c.last+1 && !c.skipGap(ctx, msg, oldest) {
+			return nil
+		}
+
+		if err := c.process(ctx, msg); err != nil {
+			if errors.Is(err, errAttemptDelayed) {
+				return nil
+			}
+			return err
+		}
+		delete(c.gap.buffer, msg.Sequence)
+	}
+	c.gap.since = time.Time{}
+
+	return nil
+}
+
+// process hand a message to the handler and saves the checkpoint
+func (c *Consumer) process(ctx context.Context, msg MessageWriteReply) error {
+	if c.cfg.poison != nil {
+		quarantined, err := c.poisonPending(ctx, msg)
+		if err != nil {
+			return err
+		}
+		if quarantined {
+			return c.commit(ctx, msg.Sequence)
+		}
+	}
+
+	var deadLettered bool
+	var err error
+	if c.cfg.atMostOnce {
+		if err = c.commit(ctx, msg.Sequence); err != nil {
+			return err
+		}
+		if deadLettered, err = c.handle(ctx, msg); err != nil {
+			return err
+		}
+	} else {
+		if deadLettered, err = c.handle(ctx, msg); err != nil {
+			return err
+		}
+		if err = c.commit(ctx, msg.Sequence); err != nil {
+			return err
+		}
+	}
+
+	if !c.cfg.markRead || deadLettered {
+		return nil
+	}
+
+	if err := c.client.MessageMark(ctx, MessageMarkRequest{
+		ChannelID: c.channelID,
+		Sequence:  msg.Sequence,
+		Read:      true,
+	}); err != nil {
+		return fmt.Errorf("unable mark message as read : %w", err)
+	}
+	return nil
+}
+
+// handle call the handler up to the max attempts, then forwards the message
+// to the dead letter channel if any, or records the failed delivery when
+// poison detection is set. Return true if the message was dead lettered or
+// quarantined
+func (c *Consumer) handle(ctx context.Context, msg MessageWriteReply) (bool, error) {
+	attempts := c.cfg.maxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	backoff := c.cfg.backoff
+	for i := 0; i < attempts; i++ {
+		if i > 0 && backoff > 0 {
+			select {
+			case <-ctx.Done():
+				return false, err
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > c.cfg.maxBackoff {
+				backoff = c.cfg.maxBackoff
+			}
+		}
+		if err = c.handler(ctx, c.channelID, msg); err == nil {
+			return false, c.poisonSucceeded(ctx, msg)
+		}
+		if ctx.Err() != nil {
+			return false, err
+		}
+	}
+
+	if c.cfg.poison != nil {
+		return c.poisonFailed(ctx, msg, err, attempts)
+	}
+
+	if c.cfg.deadLetter == nil {
+		return false, err
+	}
+
+	if err := c.writeDeadLetter(ctx, msg, err, attempts); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// NotificationHandler return a websocket callback pulling the channel on every notification
+func (c *Consumer) NotificationHandler() NotificationHandlerFunc {
+	return func(ctx context.Context, t int, msg []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		return c.Pull(ctx)
+	}
+}
+
+// Run pull the channel every interval until the context is done.
+// Errors are given to errHandler if not nil.
+// It returns ErrInvalidInterval if interval is not positive
+func (c *Consumer) Run(ctx context.Context, interval time.Duration, errHandler ErrorHandlerFunc) error {
+	if interval <= 0 {
+		return ErrInvalidInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Pull(ctx); err != nil && errHandler != nil {
+			errHandler(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitConsumerPull(t *testing.T) {
+	tests := map[string]struct {
+		opts      []ConsumerConfigFunc
+		failSeq   int64
+		delivered []int64
+		retried   []int64
+		read      []bool
+	}{
+		"Resume after failure": {
+			failSeq:   2,
+			delivered: []int64{1, 2},
+			retried:   []int64{2, 3},
+			read:      []bool{false, false, false},
+		},
+		"Mark read": {
+			opts:      []ConsumerConfigFunc{WithMarkRead()},
+			failSeq:   2,
+			delivered: []int64{1, 2},
+			retried:   []int64{2, 3},
+			read:      []bool{true, true, true},
+		},
+		"At most once": {
+			opts:      []ConsumerConfigFunc{WithAtMostOnce()},
+			failSeq:   2,
+			delivered: []int64{1, 2},
+			retried:   []int64{3},
+			read:      []bool{false, false, false},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newMockServer()
+			for _, p := range []string{"one", "two", "three"} {
+				s.add("channel", "text/plain", []byte(p))
+			}
+
+			var delivered []int64
+			fail := true
+			h := func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+				delivered = append(delivered, msg.Sequence)
+				if msg.Sequence == test.failSeq && fail {
+					fail = false
+					return errors.New("handler failed")
+				}
+				return nil
+			}
+
+			store := NewMemoryCheckpointStore()
+			opts := append([]ConsumerConfigFunc{WithCheckpointStore(store)}, test.opts...)
+			consumer := NewConsumer(newMockClient(s), "channel", h, opts...)
+
+			assert.EqualError(t, consumer.Pull(context.Background()), "handler failed")
+			assert.Equal(t, test.delivered, delivered)
+
+			// A new consumer sharing the store resumes from the checkpoint
+			delivered = nil
+			consumer = NewConsumer(newMockClient(s), "channel", h, opts...)
+			assert.NoError(t, consumer.Pull(context.Background()))
+			assert.Equal(t, test.retried, delivered)
+
+			delivered = nil
+			assert.NoError(t, consumer.Pull(context.Background()))
+			assert.Empty(t, delivered)
+
+			seq, err := consumer.Checkpoint(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, int64(3), seq)
+
+			var read []bool
+			for _, m := range s.messages("channel") {
+				read = append(read, m.read)
+			}
+			assert.Equal(t, test.read, read)
+		})
+	}
+}
+
+func TestUnitConsumerRunInvalidInterval(t *testing.T) {
+	consumer := NewConsumer(newMockClient(newMockServer()), "channel", func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		return nil
+	})
+	assert.ErrorIs(t, consumer.Run(context.Background(), -time.Second, nil), ErrInvalidInterval)
+}
@@ -0,0 +1,158 @@
+package spvchannels
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// DeadLetterContentType is the content type of the messages written to a dead letter channel
+const DeadLetterContentType = "application/vnd.spvchannels.deadletter+json"
+
+// maxDeadLetterError bounds the handler error kept in a dead letter
+const maxDeadLetterError = 1024
+
+// DeadLetter is the envelope written to the dead letter channel for a message
+// the handler failed to process.
+//
+// When the payload does not fit in the dead letter channel it is omitted,
+// and the dead letter only references the original message by its channel
+// and sequence
+type DeadLetter struct {
+	ChannelID      string `json:"channel_id"`
+	Sequence       int64  `json:"sequence"`
+	Received       string `json:"received"`
+	ContentType    string `json:"content_type"`
+	Payload        string `json:"payload"`
+	PayloadOmitted bool   `json:"payload_omitted,omitempty"`
+	Error          string `json:"error"`
+	Attempts       int    `json:"attempts"`
+}
+
+// deadLetterTarget hold the channel receiving the dead letters
+type deadLetterTarget struct {
+	client    *Client
+	channelID string
+}
+
+// writeDeadLetter copy a message to the dead letter channel and mark the original as read
+func (c *Consumer) writeDeadLetter(ctx context.Context, msg MessageWriteReply, handlerErr error, attempts int) error {
+	errMsg := handlerErr.Error()
+	if len(errMsg) > maxDeadLetterError {
+		errMsg = errMsg[:maxDeadLetterError]
+	}
+	dl := DeadLetter{
+		ChannelID:   c.channelID,
+		Sequence:    msg.Sequence,
+		Received:    msg.Received,
+		ContentType: msg.ContentType,
+		Payload:     msg.Payload,
+		Error:       errMsg,
+		Attempts:    attempts,
+	}
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	if len(data) > c.cfg.deadLetter.client.cfg.maxMessageSize {
+		dl.Payload = ""
+		dl.PayloadOmitted = true
+		if data, err = json.Marshal(dl); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.cfg.deadLetter.client.MessageWrite(ctx, MessageWriteRequest{
+		ChannelID:   c.cfg.deadLetter.channelID,
+		Message:     string(data),
+		ContentType: DeadLetterContentType,
+	}); err != nil {
+		return fmt.Errorf("unable to write dead letter : %w", err)
+	}
+
+	if err := c.client.MessageMark(ctx, MessageMarkRequest{
+		ChannelID: c.channelID,
+		Sequence:  msg.Sequence,
+		Read:      true,
+	}); err != nil {
+		return fmt.Errorf("unable mark message as read : %w", err)
+	}
+	return nil
+}
+
+// ReplayDeadLetters write the unread messages of the dead letter channel back
+// to their source channel with the source client, then marks them as read.
+//
+// The source client must be allowed to write to the source channels, and to
+// read them for the dead letters whose payload was omitted.
+// Only the dead letters accepted by filter are replayed, a nil filter accepts them all.
+// It returns the number of replayed messages.
+func ReplayDeadLetters(ctx context.Context, dlq *Client, dlqChannelID string, source *Client, filter func(DeadLetter) bool) (int, error) {
+	msgs, err := dlq.Messages(ctx, MessagesRequest{
+		ChannelID: dlqChannelID,
+		UnRead:    true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to read dead letters : %w", err)
+	}
+
+	replayed := 0
+	for _, msg := range msgs {
+		payload, err := msg.DecodePayload()
+		if err != nil {
+			return replayed, fmt.Errorf("unable to decode dead letter %d : %w", msg.Sequence, err)
+		}
+
+		var dl DeadLetter
+		if err := json.Unmarshal(payload, &dl); err != nil {
+			return replayed, fmt.Errorf("unable to decode dead letter %d : %w", msg.Sequence, err)
+		}
+
+		if filter != nil && !filter(dl) {
+			continue
+		}
+
+		original, err := deadLetterPayload(ctx, source, dl)
+		if err != nil {
+			return replayed, fmt.Errorf("unable to decode dead letter %d : %w", msg.Sequence, err)
+		}
+
+		if _, err := source.MessageWrite(ctx, MessageWriteRequest{
+			ChannelID:   dl.ChannelID,
+			Message:     string(original),
+			ContentType: dl.ContentType,
+		}); err != nil {
+			return replayed, fmt.Errorf("unable to replay dead letter %d : %w", msg.Sequence, err)
+		}
+
+		if err := dlq.MessageMark(ctx, MessageMarkRequest{
+			ChannelID: dlqChannelID,
+			Sequence:  msg.Sequence,
+			Read:      true,
+		}); err != nil {
+			return replayed, fmt.Errorf("unable mark dead letter as read : %w", err)
+		}
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+// deadLetterPayload return the original content of a dead letter, read from
+// the source channel when it was omitted
+func deadLetterPayload(ctx context.Context, source *Client, dl DeadLetter) ([]byte, error) {
+	if !dl.PayloadOmitted {
+		return MessageWriteReply{Payload: dl.Payload}.DecodePayload()
+	}
+
+	msgs, err := source.Messages(ctx, MessagesRequest{ChannelID: dl.ChannelID})
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		if msg.Sequence == dl.Sequence {
+			return msg.DecodePayload()
+		}
+	}
+	return nil, fmt.Errorf("original message %d not found in channel %s", dl.Sequence, dl.ChannelID)
+}
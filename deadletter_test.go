@@ -0,0 +1,141 @@
+package spvchannels
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitConsumerDeadLetter(t *testing.T) {
+	s := newMockServer()
+	s.add("channel", "text/plain", []byte("poison"))
+	s.add("channel", "text/plain", []byte("ok"))
+	client := newMockClient(s)
+
+	calls := map[int64]int{}
+	h := func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		calls[msg.Sequence]++
+		if msg.Sequence == 1 {
+			return errors.New("cannot process")
+		}
+		return nil
+	}
+
+	consumer := NewConsumer(client, "channel", h,
+		WithMaxAttempts(3),
+		WithDeadLetter(client, "dlq"),
+	)
+	assert.NoError(t, consumer.Pull(context.Background()))
+	assert.Equal(t, map[int64]int{1: 3, 2: 1}, calls)
+
+	msgs := s.messages("channel")
+	assert.True(t, msgs[0].read)
+
+	dlq := s.messages("dlq")
+	assert.Len(t, dlq, 1)
+	assert.Equal(t, DeadLetterContentType, dlq[0].ContentType)
+
+	payload, err := dlq[0].DecodePayload()
+	assert.NoError(t, err)
+	var dl DeadLetter
+	assert.NoError(t, json.Unmarshal(payload, &dl))
+	assert.Equal(t, DeadLetter{
+		ChannelID:   "channel",
+		Sequence:    1,
+		Received:    msgs[0].Received,
+		ContentType: "text/plain",
+		Payload:     msgs[0].Payload,
+		Error:       "cannot process",
+		Attempts:    3,
+	}, dl)
+
+	// Replay the dead letter back to its source channel
+	n, err := ReplayDeadLetters(context.Background(), client, "dlq", client, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	msgs = s.messages("channel")
+	assert.Len(t, msgs, 3)
+	assert.Equal(t, "text/plain", msgs[2].ContentType)
+	assert.Equal(t, msgs[0].Payload, msgs[2].Payload)
+	assert.True(t, s.messages("dlq")[0].read)
+
+	n, err = ReplayDeadLetters(context.Background(), client, "dlq", client, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestUnitConsumerDeadLetterWriteFailure(t *testing.T) {
+	s := newMockServer()
+	s.add("channel", "text/plain", []byte("poison"))
+	client := newMockClient(s)
+
+	consumer := NewConsumer(client, "channel", func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		return errors.New("cannot process")
+	}, WithDeadLetter(client, "dlq"))
+
+	s.failNext(http.MethodPost, 1)
+	assert.EqualError(t, consumer.Pull(context.Background()), "unable to write dead letter : mock failure")
+	seq, err := consumer.Checkpoint(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), seq)
+	assert.False(t, s.messages("channel")[0].read)
+}
+
+func TestUnitConsumerDeadLetterOversized(t *testing.T) {
+	s := newMockServer()
+	large := bytes.Repeat([]byte("x"), MaxMessageContentLength-16)
+	s.add("channel", "text/plain", large)
+	client := newMockClient(s)
+
+	consumer := NewConsumer(client, "channel", func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		return errors.New(strings.Repeat("e", 4096))
+	}, WithDeadLetter(client, "dlq"))
+	assert.NoError(t, consumer.Pull(context.Background()))
+
+	payload, err := s.messages("dlq")[0].DecodePayload()
+	assert.NoError(t, err)
+	var dl DeadLetter
+	assert.NoError(t, json.Unmarshal(payload, &dl))
+	assert.True(t, dl.PayloadOmitted)
+	assert.Empty(t, dl.Payload)
+	assert.Len(t, dl.Error, maxDeadLetterError)
+
+	// The payload is read back from the source channel
+	n, err := ReplayDeadLetters(context.Background(), client, "dlq", client, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	replayed, err := s.messages("channel")[1].DecodePayload()
+	assert.NoError(t, err)
+	assert.Equal(t, large, replayed)
+}
+
+func TestUnitConsumerAttemptBackoff(t *testing.T) {
+	s := newMockServer()
+	s.add("channel", "text/plain", []byte("poison"))
+
+	var calls []time.Time
+	consumer := NewConsumer(newMockClient(s), "channel", func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		calls = append(calls, time.Now())
+		return errors.New("cannot process")
+	}, WithMaxAttempts(3), WithAttemptBackoff(20*time.Millisecond, 30*time.Millisecond))
+
+	assert.Error(t, consumer.Pull(context.Background()))
+	assert.Len(t, calls, 3)
+	assert.GreaterOrEqual(t, calls[1].Sub(calls[0]), 20*time.Millisecond)
+	assert.GreaterOrEqual(t, calls[2].Sub(calls[1]), 30*time.Millisecond)
+
+	// A cancelled context stops the retries
+	calls = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, consumer.Pull(ctx))
+	assert.LessOrEqual(t, len(calls), 1)
+}
@@ -0,0 +1,391 @@
+package spvchannels
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// producerConfig hold configuration of an idempotent producer
+type producerConfig struct {
+	attempts int
+	backoff  time.Duration
+	lookback int
+}
+
+// ProducerConfigFunc set the idempotent producer configuration
+type ProducerConfigFunc func(c *producerConfig)
+
+// WithProducerRetry set the number of write attempts and the delay between
+// them. Default is 3 attempts, 500 milliseconds apart
+func WithProducerRetry(attempts int, backoff time.Duration) ProducerConfigFunc {
+	return func(c *producerConfig) {
+		c.attempts = attempts
+		c.backoff = backoff
+	}
+}
+
+// WithProducerLookback set the number of most recent messages searched for
+// the message id before retrying a write. Default is 100
+func WithProducerLookback(n int) ProducerConfigFunc {
+	return func(c *producerConfig) {
+		c.lookback = n
+	}
+}
+
+func defaultProducerConfig() *producerConfig {
+	return &producerConfig{
+		attempts: 3,
+		backoff:  500 * time.Millisecond,
+		lookback: 100,
+	}
+}
+
+// IdempotencyID return the deterministic message id of the message key
+// written by the producer producerID
+func IdempotencyID(producerID, key string) string {
+	h := sha256.Sum256([]byte(producerID + "\x00" + key))
+	return hex.EncodeToString(h[:16])
+}
+
+// IdempotentProducer writes envelopes whose id is derived from an application
+// key, so the same message always carries the same id.
+//
+// A failed write may still have reached the server, i.e on a timeout. Before
+// retrying, the producer searches the most recent messages of the channel for
+// the message id and returns the existing message if found. Its token must
+// then be able to read the channel. A duplicate can still be written if the
+// search fails, consumers should use a dedupe filter such as Deduplicate
+type IdempotentProducer struct {
+	cfg        *producerConfig
+	client     *Client
+	channelID  string
+	producerID string
+}
+
+// NewIdempotentProducer create an idempotent producer writing to channelID.
+// producerID identifies the producer in the message ids and the envelope sender
+func NewIdempotentProducer(client *Client, channelID, producerID string, opts ...ProducerConfigFunc) *IdempotentProducer {
+	cfg := defaultProducerConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.attempts < 1 {
+		cfg.attempts = 1
+	}
+
+	return &IdempotentProducer{
+		cfg:        cfg,
+		client:     client,
+		channelID:  channelID,
+		producerID: producerID,
+	}
+}
+
+// Write writes an envelope of body with the id of key, retrying failed writes.
+// A write rejected by the server (4xx status) or too large is not retried
+func (p *IdempotentProducer) Write(ctx context.Context, key string, body []byte, contentType string) (*MessageWriteReply, error) {
+	e := &Envelope{
+		ID:          IdempotencyID(p.producerID, key),
+		Sender:      p.producerID,
+		ContentType: contentType,
+		Body:        body,
+	}
+
+	var err error
+	for attempt := 0; attempt < p.cfg.attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(p.cfg.backoff):
+			}
+
+			if reply, ferr := p.find(ctx, e.ID); ferr == nil && reply != nil {
+				return reply, nil
+			}
+		}
+
+		var reply *MessageWriteReply
+		if reply, err = p.client.MessageWriteEnvelope(ctx, p.channelID, e); err == nil {
+			return reply, nil
+		}
+		if permanentReplyError(err) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("unable to write message after %d attempts : %w", p.cfg.attempts, err)
+}
+
+// find search the most recent messages of the channel for the envelope id
+func (p *IdempotentProducer) find(ctx context.Context, id string) (*MessageWriteReply, error) {
+	msgs, err := p.client.Messages(ctx, MessagesRequest{
+		ChannelID: p.channelID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Sequence > msgs[j].Sequence
+	})
+	if len(msgs) > p.cfg.lookback {
+		msgs = msgs[:p.cfg.lookback]
+	}
+
+	for i := range msgs {
+		if EnvelopeMessageID(msgs[i]) == id {
+			return &msgs[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// EnvelopeMessageID return the envelope id of a message, or an empty string
+// if the message is not an envelope
+func EnvelopeMessageID(msg MessageWriteReply) string {
+	if mediaType(msg.ContentType) != EnvelopeContentType {
+		return ""
+	}
+	e, err := OpenEnvelope(msg)
+	if err != nil {
+		return ""
+	}
+	return e.ID
+}
+
+// SeenSet records the ids of the processed messages
+type SeenSet interface {
+	// Contains tells if the id was recorded
+	Contains(ctx context.Context, id string) (bool, error)
+	// Add record the id
+	Add(ctx context.Context, id string) error
+}
+
+// LRUSeenSet is a SeenSet keeping the most recently used ids in memory
+type LRUSeenSet struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+// NewLRUSeenSet create an in memory seen set holding up to size ids
+func NewLRUSeenSet(size int) *LRUSeenSet {
+	return &LRUSeenSet{
+		size:  size,
+		order: list.New(),
+		ids:   make(map[string]*list.Element),
+	}
+}
+
+// Contains implements SeenSet
+func (s *LRUSeenSet) Contains(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.ids[id]
+	if ok {
+		s.order.MoveToFront(e)
+	}
+	return ok, nil
+}
+
+// Add implements SeenSet
+func (s *LRUSeenSet) Add(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(id)
+	return nil
+}
+
+func (s *LRUSeenSet) add(id string) {
+	if e, ok := s.ids[id]; ok {
+		s.order.MoveToFront(e)
+		return
+	}
+
+	s.ids[id] = s.order.PushFront(id)
+	for s.order.Len() > s.size {
+		last := s.order.Back()
+		s.order.Remove(last)
+		delete(s.ids, last.Value.(string))
+	}
+}
+
+// Len return the number of ids held
+func (s *LRUSeenSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+// FileSeenSet is a SeenSet persisting the ids in a file, one per line.
+//
+// Every Add appends the id to the file and syncs it. Once the file holds
+// twice the maximum number of ids, it is rewritten with the most recent ones
+type FileSeenSet struct {
+	mu    sync.Mutex
+	path  string
+	lru   *LRUSeenSet
+	lines int
+	f     *os.File
+}
+
+// NewFileSeenSet create a seen set holding up to size ids, backed by the file
+// at path and loading the ids it already holds
+func NewFileSeenSet(path string, size int) (*FileSeenSet, error) {
+	s := &FileSeenSet{
+		path: path,
+		lru:  NewLRUSeenSet(size),
+	}
+
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			s.lru.add(id)
+			s.lines++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Contains implements SeenSet
+func (s *FileSeenSet) Contains(ctx context.Context, id string) (bool, error) {
+	return s.lru.Contains(ctx, id)
+}
+
+// Add implements SeenSet. The id is recorded once written to the file, a
+// failed compaction is not an error and is tried again on the next Add
+func (s *FileSeenSet) Add(ctx context.Context, id string) error {
+	if strings.ContainsAny(id, "\r\n") {
+		return fmt.Errorf("invalid message id %q", id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if _, err := s.f.WriteString(id + "\n"); err != nil {
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	_ = s.lru.Add(ctx, id)
+	s.lines++
+
+	if s.lines >= 2*s.lru.size {
+		_ = s.compact()
+	}
+	return nil
+}
+
+// compact rewrites the file with the ids held in memory, oldest first, and
+// keeps the new file open for appending. The new file replaces the current
+// one only once fully written, so on failure the set keeps appending to the
+// current file and compaction is tried again on the next Add
+func (s *FileSeenSet) compact() error {
+	s.lru.mu.Lock()
+	var buf bytes.Buffer
+	for e := s.lru.order.Back(); e != nil; e = e.Prev() {
+		buf.WriteString(e.Value.(string) + "\n")
+	}
+	lines := s.lru.order.Len()
+	s.lru.mu.Unlock()
+
+	// The handle on the temporary file remains valid once renamed
+	tmp := filepath.Clean(s.path + ".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to compact seen ids : %w", err)
+	}
+	fail := func(err error) error {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to compact seen ids : %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fail(err)
+	}
+
+	if s.f != nil {
+		_ = s.f.Close()
+	}
+	s.f = f
+	s.lines = lines
+	return syncDir(s.path)
+}
+
+// Close closes the file
+func (s *FileSeenSet) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// Deduplicate wraps a message handler to skip the enveloped messages whose
+// id was already processed. The id is recorded once the handler succeeds.
+// Messages which are not envelopes are always handled
+func Deduplicate(set SeenSet, h MessageHandlerFunc) MessageHandlerFunc {
+	return func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		id := EnvelopeMessageID(msg)
+		if id == "" {
+			return h(ctx, channelID, msg)
+		}
+
+		seen, err := set.Contains(ctx, id)
+		if err != nil {
+			return fmt.Errorf("unable to check message id : %w", err)
+		}
+		if seen {
+			return nil
+		}
+
+		if err := h(ctx, channelID, msg); err != nil {
+			return err
+		}
+		if err := set.Add(ctx, id); err != nil {
+			return fmt.Errorf("unable to record message id : %w", err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,199 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lostReplyClient forwards the requests to the mock server but loses the
+// replies of the first n writes, as a timeout would
+type lostReplyClient struct {
+	s *mockServer
+	n int
+}
+
+func (c *lostReplyClient) Do(req *http.Request) (*http.Response, error) {
+	res, err := c.s.Do(req)
+	if req.Method == http.MethodPost && c.n > 0 {
+		c.n--
+		return nil, errors.New("timeout")
+	}
+	return res, err
+}
+
+func TestUnitIdempotentProducer(t *testing.T) {
+	tests := map[string]struct {
+		lost     int
+		failures int
+		missing  bool
+		attempts int
+		expErr   bool
+		messages int
+		requests int
+	}{
+		"Write succeeds": {
+			attempts: 3,
+			messages: 1,
+		},
+		"Reply lost, message found": {
+			lost:     1,
+			attempts: 3,
+			messages: 1,
+		},
+		"Write failed, retried": {
+			failures: 1,
+			attempts: 3,
+			messages: 1,
+		},
+		"Attempts exhausted": {
+			failures: 3,
+			attempts: 3,
+			expErr:   true,
+		},
+		"Rejected by the server, not retried": {
+			missing:  true,
+			attempts: 3,
+			expErr:   true,
+			requests: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newMockServer()
+			client := NewClient(WithBaseURL("somedomain"))
+			client.HTTPClient = &lostReplyClient{s: s, n: test.lost}
+			s.failNext(http.MethodPost, test.failures)
+			s.missing["channel"] = test.missing
+
+			p := NewIdempotentProducer(client, "channel", "producer", WithProducerRetry(test.attempts, time.Millisecond))
+			reply, err := p.Write(context.Background(), "order-1", []byte("data"), "text/plain")
+			if test.expErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, IdempotencyID("producer", "order-1"), EnvelopeMessageID(*reply))
+			}
+			assert.Len(t, s.messages("channel"), test.messages)
+			if test.requests > 0 {
+				assert.Len(t, s.requests, test.requests)
+			}
+		})
+	}
+}
+
+func TestUnitDeduplicate(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+
+	p := NewIdempotentProducer(client, "channel", "producer")
+	_, err := p.Write(ctx, "a", []byte("1"), "text/plain")
+	assert.NoError(t, err)
+	_, err = p.Write(ctx, "a", []byte("1"), "text/plain")
+	assert.NoError(t, err)
+	_, err = p.Write(ctx, "b", []byte("2"), "text/plain")
+	assert.NoError(t, err)
+	s.add("channel", "text/plain", []byte("plain"))
+	s.add("channel", "text/plain", []byte("plain"))
+
+	handled := 0
+	fail := true
+	h := func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		if fail {
+			fail = false
+			return errors.New("fail")
+		}
+		handled++
+		return nil
+	}
+
+	c := NewConsumer(client, "channel", h, WithDeduplication(NewLRUSeenSet(10)))
+	assert.Error(t, c.Pull(ctx))
+	assert.NoError(t, c.Pull(ctx))
+	assert.Equal(t, 4, handled)
+}
+
+func TestUnitLRUSeenSet(t *testing.T) {
+	ctx := context.Background()
+	set := NewLRUSeenSet(2)
+	assert.NoError(t, set.Add(ctx, "a"))
+	assert.NoError(t, set.Add(ctx, "b"))
+
+	seen, _ := set.Contains(ctx, "a")
+	assert.True(t, seen)
+	assert.NoError(t, set.Add(ctx, "c"))
+
+	seen, _ = set.Contains(ctx, "b")
+	assert.False(t, seen)
+	seen, _ = set.Contains(ctx, "a")
+	assert.True(t, seen)
+	assert.Equal(t, 2, set.Len())
+}
+
+func TestUnitFileSeenSet(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "seen")
+
+	set, err := NewFileSeenSet(path, 3)
+	assert.NoError(t, err)
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		assert.NoError(t, set.Add(ctx, id))
+	}
+	assert.Error(t, set.Add(ctx, "bad\nid"))
+	assert.NoError(t, set.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "d\ne\nf\n", string(data))
+
+	set, err = NewFileSeenSet(path, 3)
+	assert.NoError(t, err)
+	defer func() {
+		_ = set.Close()
+	}()
+	for id, want := range map[string]bool{"a": false, "c": false, "d": true, "f": true} {
+		seen, err := set.Contains(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, want, seen, id)
+	}
+}
+
+func TestUnitFileSeenSetCompactFailure(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "seen")
+
+	set, err := NewFileSeenSet(path, 2)
+	assert.NoError(t, err)
+	defer func() {
+		_ = set.Close()
+	}()
+
+	// The temporary file can not be created, the set keeps the current file
+	assert.NoError(t, os.Mkdir(path+".tmp", 0o700))
+	assert.NoError(t, set.Add(ctx, "a"))
+	assert.NoError(t, set.Add(ctx, "b"))
+	assert.NoError(t, set.Add(ctx, "c"))
+	assert.NoError(t, set.Add(ctx, "d"))
+	assert.NoError(t, set.Add(ctx, "e"))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "a\nb\nc\nd\ne\n", string(data))
+
+	assert.NoError(t, os.Remove(path+".tmp"))
+	assert.NoError(t, set.Add(ctx, "f"))
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "e\nf\n", string(data))
+	assert.NoError(t, set.Add(ctx, "g"))
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "e\nf\ng\n", string(data))
+}
@@ -0,0 +1,355 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"sync"
+)
+
+// HandlerMode defines how websocket notifications are dispatched to the
+// NotificationHandlerFunc
+type HandlerMode int
+
+const (
+	// HandlerModeSerial process one notification at a time, in arrival order
+	HandlerModeSerial HandlerMode = iota
+	// HandlerModePool process notifications concurrently with a fixed number of workers
+	HandlerModePool
+	// HandlerModePerChannel process notifications of a same channel serially,
+	// notifications from different channels are processed concurrently
+	HandlerModePerChannel
+)
+
+// OverflowPolicy defines what happens when a notification arrives and the
+// handler queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock stop reading the websocket until there is room in the queue
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discard the oldest queued notification to make room for the new one
+	OverflowDropOldest
+	// OverflowCoalesce keep at most one pending notification per queue.
+	//
+	// A notification only tells that new messages are available, so a single
+	// pending pull is enough to fetch all of them. Notification errors are
+	// never coalesced.
+	OverflowCoalesce
+)
+
+// NotificationKeyFunc return the channel key of a notification.
+// It is used by HandlerModePerChannel to group notifications
+type NotificationKeyFunc func(t int, msg []byte) string
+
+// notification hold a message read from the websocket
+type notification struct {
+	t   int
+	msg []byte
+	err error
+	key string
+}
+
+// notificationQueue is a bounded fifo of notification.
+//
+// A reapable queue stops its worker once it is empty and no notification
+// is being pushed, see dispatcher.reap
+type notificationQueue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	items    []notification
+	size     int
+	policy   OverflowPolicy
+	closed   bool
+	draining bool
+	reapable bool
+	pushers  int
+}
+
+func newNotificationQueue(size int, policy OverflowPolicy) *notificationQueue {
+	if size < 1 {
+		size = 1
+	}
+	q := &notificationQueue{
+		size:   size,
+		policy: policy,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push add a notification to the queue, applying the overflow policy.
+// Return false if the notification was dropped
+func (q *notificationQueue) push(n notification) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.policy == OverflowCoalesce && n.err == nil {
+		for _, item := range q.items {
+			if item.err == nil {
+				return false
+			}
+		}
+	}
+
+	for len(q.items) >= q.size && !q.closed {
+		if q.policy == OverflowDropOldest {
+			q.items = q.items[1:]
+			break
+		}
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		return false
+	}
+
+	q.items = append(q.items, n)
+	q.cond.Broadcast()
+	return true
+}
+
+// pop wait for the next notification. Return false when the queue is
+// closed, once emptied if it is draining, or when a reapable queue is idle
+func (q *notificationQueue) pop() (notification, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		if q.reapable && q.pushers == 0 {
+			return notification{}, false
+		}
+		q.cond.Wait()
+	}
+
+	if q.closed && (!q.draining || len(q.items) == 0) {
+		return notification{}, false
+	}
+
+	n := q.items[0]
+	q.items = q.items[1:]
+	q.cond.Broadcast()
+	return n, true
+}
+
+// pushed end a push announced while the queue was returned by dispatcher.queue
+func (q *notificationQueue) pushed() {
+	q.mu.Lock()
+	q.pushers--
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// close release every goroutine waiting on the queue, dropping the queued notifications
+func (q *notificationQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.draining = false
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// drain refuse new notifications, the queued ones are still handed to the worker
+func (q *notificationQueue) drain() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		q.draining = true
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// dispatcher deliver notifications from the websocket read loop to the
+// notification handler according to the configured HandlerMode
+type dispatcher struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	cfg     *spvConfig
+	queues  map[string]*notificationQueue
+	wg      sync.WaitGroup
+	closed  bool
+	closeFn func()
+}
+
+// newDispatcher create a dispatcher. closeFn is called when the handler
+// return ErrWSClose
+func newDispatcher(ctx context.Context, cfg *spvConfig, closeFn func()) *dispatcher {
+	d := &dispatcher{
+		ctx:     ctx,
+		cfg:     cfg,
+		queues:  make(map[string]*notificationQueue),
+		closeFn: closeFn,
+	}
+
+	switch cfg.handlerMode {
+	case HandlerModePool:
+		q := newNotificationQueue(cfg.queueSize, cfg.overflow)
+		d.queues[""] = q
+		workers := cfg.workers
+		if workers < 1 {
+			workers = 1
+		}
+		for i := 0; i < workers; i++ {
+			d.startWorker("", q)
+		}
+	case HandlerModePerChannel:
+		// queues are created on demand and reaped once idle
+	default:
+		q := newNotificationQueue(cfg.queueSize, cfg.overflow)
+		d.queues[""] = q
+		d.startWorker("", q)
+	}
+
+	return d
+}
+
+// queue return the queue a notification should be pushed into, pushed must
+// be called on it once the push is done.
+// Return nil if the dispatcher is closed
+func (d *dispatcher) queue(n notification) *notificationQueue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil
+	}
+
+	key := ""
+	if d.cfg.handlerMode == HandlerModePerChannel {
+		key = n.key
+	}
+
+	q, ok := d.queues[key]
+	if !ok {
+		q = newNotificationQueue(d.cfg.queueSize, d.cfg.overflow)
+		q.reapable = d.cfg.handlerMode == HandlerModePerChannel
+		d.queues[key] = q
+		d.startWorker(key, q)
+	}
+
+	q.mu.Lock()
+	q.pushers++
+	q.mu.Unlock()
+	return q
+}
+
+// dispatch push a notification to the handler queue
+// It blocks when the queue is full and the overflow policy is OverflowBlock.
+// Return false if the dispatcher is closed
+func (d *dispatcher) dispatch(t int, msg []byte, err error) bool {
+	n := notification{
+		t:   t,
+		msg: msg,
+		err: err,
+	}
+	if d.cfg.handlerMode == HandlerModePerChannel {
+		n.key = d.cfg.keyFunc(t, msg)
+	}
+	q := d.queue(n)
+	if q == nil {
+		return false
+	}
+	q.push(n)
+	q.pushed()
+	return true
+}
+
+func (d *dispatcher) startWorker(key string, q *notificationQueue) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			n, ok := q.pop()
+			if !ok {
+				if d.reap(key, q) {
+					return
+				}
+				continue
+			}
+			d.handle(n)
+		}
+	}()
+}
+
+// drain stops accepting notifications and waits for the workers to handle
+// the queued ones
+func (d *dispatcher) drain() {
+	d.mu.Lock()
+	d.closed = true
+	for _, q := range d.queues {
+		q.drain()
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+// reap tells if the worker of q must stop. A closed queue stops its worker,
+// an idle reapable queue is closed and removed from the dispatcher
+func (d *dispatcher) reap(key string, q *notificationQueue) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return true
+	}
+	if len(q.items) > 0 || q.pushers > 0 {
+		return false
+	}
+
+	q.closed = true
+	if d.queues[key] == q {
+		delete(d.queues, key)
+	}
+	return true
+}
+
+// handle call the notification handler with a context bounded by the handler timeout
+// A panicking handler is reported to the error handler as ErrHandlerPanic
+// and closes the websocket client. Use the Recovery middleware to keep the
+// client running instead
+func (d *dispatcher) handle(n notification) {
+	if d.cfg.procces == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			d.cfg.errHandler(ErrHandlerPanic{
+				Value: r,
+				Stack: debug.Stack(),
+			})
+			d.closeFn()
+		}
+	}()
+
+	ctx := d.ctx
+	if d.cfg.handlerTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(d.ctx, d.cfg.handlerTimeout)
+		defer cancel()
+	}
+
+	if err := d.cfg.procces(ctx, n.t, n.msg, n.err); err != nil {
+		if errors.Is(err, ErrWSClose{}) {
+			d.closeFn()
+			return
+		}
+		d.cfg.errHandler(err)
+	}
+}
+
+// close stop the workers and wait for the running handlers to return
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	d.closed = true
+	for _, q := range d.queues {
+		q.close()
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
@@ -0,0 +1,249 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitNotificationQueue(t *testing.T) {
+	tests := map[string]struct {
+		policy   OverflowPolicy
+		pushes   []notification
+		expected []notification
+	}{
+		"Drop oldest keeps the newest notifications": {
+			policy: OverflowDropOldest,
+			pushes: []notification{
+				{msg: []byte("1")},
+				{msg: []byte("2")},
+				{msg: []byte("3")},
+			},
+			expected: []notification{
+				{msg: []byte("2")},
+				{msg: []byte("3")},
+			},
+		},
+		"Coalesce keeps one pending notification": {
+			policy: OverflowCoalesce,
+			pushes: []notification{
+				{msg: []byte("1")},
+				{msg: []byte("2")},
+				{err: errors.New("read error")},
+			},
+			expected: []notification{
+				{msg: []byte("1")},
+				{err: errors.New("read error")},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			q := newNotificationQueue(2, test.policy)
+			for _, n := range test.pushes {
+				q.push(n)
+			}
+			assert.Equal(t, test.expected, q.items)
+		})
+	}
+}
+
+func TestUnitNotificationQueueBlock(t *testing.T) {
+	q := newNotificationQueue(1, OverflowBlock)
+	assert.True(t, q.push(notification{msg: []byte("1")}))
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.push(notification{msg: []byte("2")})
+	}()
+
+	select {
+	case <-pushed:
+		assert.Fail(t, "push should block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	n, ok := q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), n.msg)
+	assert.True(t, <-pushed)
+
+	q.close()
+	_, ok = q.pop()
+	assert.False(t, ok)
+}
+
+func TestUnitDispatcher(t *testing.T) {
+	tests := map[string]struct {
+		mode          HandlerMode
+		workers       int
+		keys          []string
+		maxConcurrent int32
+	}{
+		"Serial": {
+			mode:          HandlerModeSerial,
+			keys:          []string{"a", "a", "b", "b"},
+			maxConcurrent: 1,
+		},
+		"Pool": {
+			mode:          HandlerModePool,
+			workers:       4,
+			keys:          []string{"a", "a", "a", "a"},
+			maxConcurrent: 4,
+		},
+		"Per channel": {
+			mode:          HandlerModePerChannel,
+			keys:          []string{"a", "b", "a", "b"},
+			maxConcurrent: 2,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var running, max int32
+			var wg sync.WaitGroup
+			wg.Add(len(test.keys))
+
+			cfg := defaultSPVConfig()
+			WithHandlerMode(test.mode, test.workers)(cfg)
+			WithNotificationKeyFunc(func(t int, msg []byte) string {
+				return string(msg)
+			})(cfg)
+			WithWebsocketCallBack(func(ctx context.Context, t int, msg []byte, err error) error {
+				defer wg.Done()
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&max)
+					if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+						break
+					}
+				}
+				time.Sleep(50 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			})(cfg)
+
+			d := newDispatcher(context.Background(), cfg, func() {})
+			for _, k := range test.keys {
+				assert.True(t, d.dispatch(1, []byte(k), nil))
+			}
+			wg.Wait()
+			d.close()
+
+			assert.Equal(t, test.maxConcurrent, atomic.LoadInt32(&max))
+			assert.False(t, d.dispatch(1, []byte("a"), nil))
+		})
+	}
+}
+
+func TestUnitDispatcherTimeoutAndClose(t *testing.T) {
+	closed := make(chan struct{})
+	cfg := defaultSPVConfig()
+	WithHandlerTimeout(10 * time.Millisecond)(cfg)
+	WithWebsocketCallBack(func(ctx context.Context, _ int, msg []byte, err error) error {
+		<-ctx.Done()
+		assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+		return ErrWSClose{}
+	})(cfg)
+
+	d := newDispatcher(context.Background(), cfg, func() {
+		close(closed)
+	})
+	d.dispatch(1, []byte("notification"), nil)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		assert.Fail(t, "handler returning ErrWSClose should close the client")
+	}
+	d.close()
+}
+
+func TestUnitDispatcherReapsIdleChannels(t *testing.T) {
+	var wg sync.WaitGroup
+	cfg := defaultSPVConfig()
+	WithHandlerMode(HandlerModePerChannel, 0)(cfg)
+	WithNotificationKeyFunc(func(t int, msg []byte) string {
+		return string(msg)
+	})(cfg)
+	WithWebsocketCallBack(func(ctx context.Context, t int, msg []byte, err error) error {
+		wg.Done()
+		return nil
+	})(cfg)
+
+	d := newDispatcher(context.Background(), cfg, func() {})
+	defer d.close()
+	for round := 0; round < 3; round++ {
+		wg.Add(100)
+		for i := 0; i < 100; i++ {
+			assert.True(t, d.dispatch(1, []byte(fmt.Sprintf("channel-%d", i)), nil))
+		}
+		wg.Wait()
+	}
+
+	assert.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.queues) == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestUnitWSClientStopsOnReadError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&ws.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		_ = conn.WriteMessage(ws.TextMessage, []byte("notification"))
+		_ = conn.Close()
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var msgs []string
+	var errs []error
+	client, err := NewWSClient(
+		WithBaseURL(strings.TrimPrefix(server.URL, "http://")),
+		WithNoTLS(),
+		WithHandlerQueue(4, OverflowDropOldest),
+		WithWebsocketCallBack(func(ctx context.Context, t int, msg []byte, err error) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return nil
+			}
+			msgs = append(msgs, string(msg))
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		client.Run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		client.Close()
+		assert.Fail(t, "a read error should stop the client")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"notification"}, msgs)
+	assert.Len(t, errs, 1)
+}
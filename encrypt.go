@@ -0,0 +1,337 @@
+package spvchannels
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// EncryptedContentType is the content type of the messages holding an EncryptedEnvelope
+const EncryptedContentType = "application/vnd.spvchannels.encrypted+json"
+
+// EncryptedEnvelopeVersion is the version of the EncryptedEnvelope format
+const EncryptedEnvelopeVersion = 1
+
+// AlgX25519AESGCM is the X25519 key agreement, HKDF-SHA256 key derivation
+// and AES-256-GCM encryption algorithm
+const AlgX25519AESGCM = "X25519-HKDF-SHA256-A256GCM"
+
+// ErrKeyMismatch is returned when decrypting an envelope encrypted for another key
+var ErrKeyMismatch = errors.New("envelope is encrypted for another key")
+
+// ErrDecrypt is reported for a message which can not be decrypted
+type ErrDecrypt struct {
+	Sequence int64
+	Err      error
+}
+
+func (e ErrDecrypt) Error() string {
+	return fmt.Sprintf("unable to decrypt message %d : %s", e.Sequence, e.Err)
+}
+
+// Unwrap return the decryption error
+func (e ErrDecrypt) Unwrap() error {
+	return e.Err
+}
+
+// X25519PublicKey is a 32 bytes X25519 public key
+type X25519PublicKey []byte
+
+// Bytes return the encoding of the key
+func (k X25519PublicKey) Bytes() []byte {
+	return k
+}
+
+// ParseX25519PublicKey return the X25519 public key encoded in b
+func ParseX25519PublicKey(b []byte) (X25519PublicKey, error) {
+	if len(b) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid X25519 public key length %d", len(b))
+	}
+	return append(X25519PublicKey{}, b...), nil
+}
+
+// X25519PrivateKey is a 32 bytes X25519 private key
+type X25519PrivateKey []byte
+
+// GenerateX25519Key create a random X25519 private key
+func GenerateX25519Key() (X25519PrivateKey, error) {
+	k := make(X25519PrivateKey, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// PublicKey return the public key matching the private key
+func (k X25519PrivateKey) PublicKey() X25519PublicKey {
+	pub, err := curve25519.X25519(k, curve25519.Basepoint)
+	if err != nil {
+		panic(err) // the base point is never a low order point
+	}
+	return pub
+}
+
+// ECDH return the secret shared with the owner of the public key.
+// It fails if the public key is a low order point
+func (k X25519PrivateKey) ECDH(pub X25519PublicKey) ([]byte, error) {
+	return curve25519.X25519(k, pub)
+}
+
+// EncryptedEnvelope is the message content of an encrypted message.
+//
+// It records the algorithm, the recipient key id, the ephemeral public key
+// and the nonce needed to decrypt the ciphertext, and the content type of
+// the original message. Binary fields are base64 encoded in JSON
+type EncryptedEnvelope struct {
+	Version      int    `json:"v"`
+	Algorithm    string `json:"alg"`
+	KeyID        string `json:"kid"`
+	EphemeralKey []byte `json:"epk"`
+	Nonce        []byte `json:"nonce"`
+	ContentType  string `json:"cty,omitempty"`
+	Ciphertext   []byte `json:"ct"`
+}
+
+// aad return the envelope header authenticated along with the ciphertext
+func (e EncryptedEnvelope) aad() []byte {
+	h := fmt.Sprintf("%d|%s|%s|%s|", e.Version, e.Algorithm, e.KeyID, e.ContentType)
+	return append([]byte(h), e.EphemeralKey...)
+}
+
+// PayloadEncrypter encrypts a message content for a recipient.
+//
+// The X25519 implementation is provided by NewX25519Encrypter, other schemes
+// such as secp256k1 ECIES can be plugged by implementing this interface
+type PayloadEncrypter interface {
+	Encrypt(plaintext []byte, contentType string) (*EncryptedEnvelope, error)
+}
+
+// PayloadDecrypter decrypts the envelopes encrypted for its private key
+type PayloadDecrypter interface {
+	// KeyID return the id of the public key matching the private key
+	KeyID() string
+	Decrypt(e *EncryptedEnvelope) ([]byte, error)
+}
+
+// KeyID return the id of a public key, the hex encoding of the first 8
+// bytes of its sha256 hash
+func KeyID(pub []byte) string {
+	h := sha256.Sum256(pub)
+	return hex.EncodeToString(h[:8])
+}
+
+// x25519Encrypter is a PayloadEncrypter using AlgX25519AESGCM
+type x25519Encrypter struct {
+	recipient X25519PublicKey
+}
+
+// NewX25519Encrypter create a PayloadEncrypter for the X25519 public key of the recipient
+func NewX25519Encrypter(recipient X25519PublicKey) PayloadEncrypter {
+	return &x25519Encrypter{
+		recipient: recipient,
+	}
+}
+
+// Encrypt implements PayloadEncrypter
+func (x *x25519Encrypter) Encrypt(plaintext []byte, contentType string) (*EncryptedEnvelope, error) {
+	eph, err := GenerateX25519Key()
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := eph.ECDH(x.recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &EncryptedEnvelope{
+		Version:      EncryptedEnvelopeVersion,
+		Algorithm:    AlgX25519AESGCM,
+		KeyID:        KeyID(x.recipient.Bytes()),
+		EphemeralKey: eph.PublicKey().Bytes(),
+		ContentType:  contentType,
+	}
+
+	key := hkdfSHA256(shared, nil, append(e.EphemeralKey, x.recipient.Bytes()...), 32)
+	if e.Nonce, e.Ciphertext, err = sealAESGCM(key, plaintext, e.aad()); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// x25519Decrypter is a PayloadDecrypter using AlgX25519AESGCM
+type x25519Decrypter struct {
+	key X25519PrivateKey
+}
+
+// NewX25519Decrypter create a PayloadDecrypter for the X25519 private key of the recipient
+func NewX25519Decrypter(key X25519PrivateKey) PayloadDecrypter {
+	return &x25519Decrypter{
+		key: key,
+	}
+}
+
+// KeyID implements PayloadDecrypter
+func (x *x25519Decrypter) KeyID() string {
+	return KeyID(x.key.PublicKey().Bytes())
+}
+
+// Decrypt implements PayloadDecrypter
+func (x *x25519Decrypter) Decrypt(e *EncryptedEnvelope) ([]byte, error) {
+	if e.Version != EncryptedEnvelopeVersion || e.Algorithm != AlgX25519AESGCM {
+		return nil, fmt.Errorf("unsupported envelope version %d algorithm %s", e.Version, e.Algorithm)
+	}
+	if e.KeyID != x.KeyID() {
+		return nil, ErrKeyMismatch
+	}
+
+	eph, err := ParseX25519PublicKey(e.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := x.key.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+
+	key := hkdfSHA256(shared, nil, append(e.EphemeralKey, x.key.PublicKey().Bytes()...), 32)
+	return openAESGCM(key, e.Nonce, e.Ciphertext, e.aad())
+}
+
+// MessageWriteEncrypted encrypts the message with enc and writes the
+// resulting EncryptedEnvelope to the channel.
+//
+// The ciphertext is base64 encoded in the envelope, so the message must stay
+// under about 3/4 of the maximum message size
+func (c *Client) MessageWriteEncrypted(ctx context.Context, r MessageWriteRequest, enc PayloadEncrypter) (*MessageWriteReply, error) {
+	e, err := enc.Encrypt([]byte(r.Message), r.ContentType)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt message : %w", err)
+	}
+	return c.writeSized(ctx, r.ChannelID, EncryptedContentType, e, "encrypted message")
+}
+
+// MessagesDecrypted get messages list and decrypts the messages encrypted
+// for the key of dec, individually or as a group member. Their payload and
+// content type are replaced by the original ones.
+//
+// Messages which are not encrypted, or encrypted for another key, are returned as is.
+// Messages which can not be decrypted are returned as is too and their
+// ErrDecrypt given to the handler set by WithDecryptErrorHandler
+func (c *Client) MessagesDecrypted(ctx context.Context, r MessagesRequest, dec PayloadDecrypter) (MessagesReply, error) {
+	msgs, err := c.Messages(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, msg := range msgs {
+		mt := mediaType(msg.ContentType)
+		if mt != EncryptedContentType && mt != GroupContentType {
+			continue
+		}
+
+		plaintext, cty, err := decryptMessage(msg, dec)
+		if errors.Is(err, ErrKeyMismatch) || errors.Is(err, ErrNotGroupMember) {
+			continue
+		}
+		if err != nil {
+			if c.cfg.decryptErrHandler != nil {
+				c.cfg.decryptErrHandler(ErrDecrypt{Sequence: msg.Sequence, Err: err})
+			}
+			continue
+		}
+
+		msgs[i].Payload = base64.StdEncoding.EncodeToString(plaintext)
+		msgs[i].ContentType = cty
+	}
+
+	return msgs, nil
+}
+
+// decryptMessage return the plaintext and original content type of an
+// encrypted or group encrypted message
+func decryptMessage(msg MessageWriteReply, dec PayloadDecrypter) ([]byte, string, error) {
+	payload, err := msg.DecodePayload()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if mediaType(msg.ContentType) == GroupContentType {
+		var e GroupEnvelope
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil, "", err
+		}
+
+		plaintext, err := DecryptGroup(&e, dec)
+		if err != nil {
+			return nil, "", err
+		}
+		return plaintext, e.ContentType, nil
+	}
+
+	var e EncryptedEnvelope
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, "", err
+	}
+
+	plaintext, err := dec.Decrypt(&e)
+	if err != nil {
+		return nil, "", err
+	}
+	return plaintext, e.ContentType, nil
+}
+
+// sealAESGCM encrypts plaintext with AES-GCM and a random nonce
+func sealAESGCM(key, plaintext, aad []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, aad), nil
+}
+
+// openAESGCM decrypts and authenticates an AES-GCM ciphertext
+func openAESGCM(key, nonce, ciphertext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+	return gcm.Open(nil, nonce, ciphertext, aad)
+}
+
+// hkdfSHA256 derives a key of n bytes from secret (RFC 5869)
+func hkdfSHA256(secret, salt, info []byte, n int) []byte {
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), out); err != nil {
+		panic(err) // only fails above 255 * 32 bytes
+	}
+	return out
+}
@@ -0,0 +1,143 @@
+package spvchannels
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitX25519EncryptDecrypt(t *testing.T) {
+	key, err := GenerateX25519Key()
+	assert.NoError(t, err)
+	other, err := GenerateX25519Key()
+	assert.NoError(t, err)
+
+	e, err := NewX25519Encrypter(key.PublicKey()).Encrypt([]byte("secret"), "text/plain")
+	assert.NoError(t, err)
+	assert.Equal(t, EncryptedEnvelopeVersion, e.Version)
+	assert.Equal(t, AlgX25519AESGCM, e.Algorithm)
+	assert.NotContains(t, string(e.Ciphertext), "secret")
+
+	plaintext, err := NewX25519Decrypter(key).Decrypt(e)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), plaintext)
+
+	_, err = NewX25519Decrypter(other).Decrypt(e)
+	assert.True(t, errors.Is(err, ErrKeyMismatch))
+
+	// The header is authenticated
+	e.ContentType = "application/json"
+	_, err = NewX25519Decrypter(key).Decrypt(e)
+	assert.Error(t, err)
+}
+
+func TestUnitMessageWriteEncrypted(t *testing.T) {
+	key, err := GenerateX25519Key()
+	assert.NoError(t, err)
+	other, err := GenerateX25519Key()
+	assert.NoError(t, err)
+
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+
+	_, err = client.MessageWriteEncrypted(ctx, MessageWriteRequest{
+		ChannelID:   "channel",
+		Message:     "secret",
+		ContentType: "text/plain",
+	}, NewX25519Encrypter(key.PublicKey()))
+	assert.NoError(t, err)
+	_, err = client.MessageWriteEncrypted(ctx, MessageWriteRequest{
+		ChannelID: "channel",
+		Message:   "not for me",
+	}, NewX25519Encrypter(other.PublicKey()))
+	assert.NoError(t, err)
+	s.add("channel", "text/plain", []byte("clear"))
+
+	stored := s.messages("channel")
+	assert.Equal(t, EncryptedContentType, stored[0].ContentType)
+	payload, err := stored[0].DecodePayload()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(payload), "secret")
+	var e EncryptedEnvelope
+	assert.NoError(t, json.Unmarshal(payload, &e))
+
+	msgs, err := client.MessagesDecrypted(ctx, MessagesRequest{ChannelID: "channel"}, NewX25519Decrypter(key))
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 3)
+
+	plaintext, err := msgs[0].DecodePayload()
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", string(plaintext))
+	assert.Equal(t, "text/plain", msgs[0].ContentType)
+	assert.Equal(t, EncryptedContentType, msgs[1].ContentType)
+	plaintext, err = msgs[2].DecodePayload()
+	assert.NoError(t, err)
+	assert.Equal(t, "clear", string(plaintext))
+}
+
+func TestUnitMessagesDecryptedMalformed(t *testing.T) {
+	key, err := GenerateX25519Key()
+	assert.NoError(t, err)
+
+	s := newMockServer()
+	var errs []error
+	client := NewClient(WithBaseURL("somedomain"), WithDecryptErrorHandler(func(err error) {
+		errs = append(errs, err)
+	}))
+	client.HTTPClient = s
+	ctx := context.Background()
+
+	bad := s.add("channel", EncryptedContentType, []byte("not an envelope"))
+	_, err = client.MessageWriteEncrypted(ctx, MessageWriteRequest{
+		ChannelID: "channel",
+		Message:   "secret",
+	}, NewX25519Encrypter(key.PublicKey()))
+	assert.NoError(t, err)
+
+	msgs, err := client.MessagesDecrypted(ctx, MessagesRequest{ChannelID: "channel"}, NewX25519Decrypter(key))
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+
+	assert.Equal(t, EncryptedContentType, msgs[0].ContentType)
+	plaintext, err := msgs[1].DecodePayload()
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", string(plaintext))
+
+	assert.Len(t, errs, 1)
+	var decryptErr ErrDecrypt
+	assert.True(t, errors.As(errs[0], &decryptErr))
+	assert.Equal(t, bad, decryptErr.Sequence)
+}
+
+func TestUnitMessageWriteEncryptedTooLarge(t *testing.T) {
+	key, err := GenerateX25519Key()
+	assert.NoError(t, err)
+
+	client := NewClient(WithBaseURL("somedomain"), WithMaxMessageSize(1024))
+	_, err = client.MessageWriteEncrypted(context.Background(), MessageWriteRequest{
+		ChannelID: "channel",
+		Message:   strings.Repeat("a", 1024),
+	}, NewX25519Encrypter(key.PublicKey()))
+	assert.True(t, errors.Is(err, ErrMessageTooLarge))
+}
+
+func TestUnitParseX25519PublicKey(t *testing.T) {
+	key, err := GenerateX25519Key()
+	assert.NoError(t, err)
+
+	pub, err := ParseX25519PublicKey(key.PublicKey().Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, key.PublicKey(), pub)
+
+	_, err = ParseX25519PublicKey([]byte("short"))
+	assert.Error(t, err)
+
+	// Low order points are rejected
+	_, err = key.ECDH(make(X25519PublicKey, 32))
+	assert.Error(t, err)
+}
@@ -0,0 +1,169 @@
+package spvchannels
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EnvelopeContentType is the content type of the messages holding an Envelope
+const EnvelopeContentType = "application/vnd.spvchannels.envelope+json"
+
+// EnvelopeVersion is the version of the Envelope format
+const EnvelopeVersion = 1
+
+// Envelope is a message content carrying metadata along with the body.
+//
+// ID identifies the message, so consumers can recognise duplicates.
+// CorrelationID links a message to another one, i.e a reply to its request,
+// and ReplyTo names the channel where replies are expected.
+// Headers holds any other application metadata. The body is base64 encoded in JSON
+type Envelope struct {
+	Version       int               `json:"v"`
+	ID            string            `json:"id"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	ReplyTo       string            `json:"reply_to,omitempty"`
+	Sender        string            `json:"sender,omitempty"`
+	SchemaVersion string            `json:"schema_version,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	ContentType   string            `json:"cty,omitempty"`
+	Body          []byte            `json:"body"`
+}
+
+// NewMessageID return a random message id
+func NewMessageID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// NewEnvelope create an envelope of body with a new message id
+func NewEnvelope(body []byte, contentType string) (*Envelope, error) {
+	id, err := NewMessageID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		Version:     EnvelopeVersion,
+		ID:          id,
+		CreatedAt:   time.Now().UTC(),
+		ContentType: contentType,
+		Body:        body,
+	}, nil
+}
+
+// Reply create an envelope answering e: its correlation id is the id of e
+func (e *Envelope) Reply(body []byte, contentType string) (*Envelope, error) {
+	r, err := NewEnvelope(body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	r.CorrelationID = e.ID
+	return r, nil
+}
+
+// Header return the value of an application header
+func (e *Envelope) Header(key string) string {
+	return e.Headers[key]
+}
+
+// SetHeader set the value of an application header
+func (e *Envelope) SetHeader(key, value string) {
+	if e.Headers == nil {
+		e.Headers = make(map[string]string)
+	}
+	e.Headers[key] = value
+}
+
+// MessageWriteEnvelope writes an envelope to the channel.
+//
+// The id, creation time and version are set if they are missing, so e can
+// be written again to retry with the same id
+func (c *Client) MessageWriteEnvelope(ctx context.Context, channelID string, e *Envelope) (*MessageWriteReply, error) {
+	if e.ID == "" {
+		id, err := NewMessageID()
+		if err != nil {
+			return nil, err
+		}
+		e.ID = id
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	e.Version = EnvelopeVersion
+	return c.writeSized(ctx, channelID, EnvelopeContentType, e, "envelope")
+}
+
+// OpenEnvelope return the envelope held by a message
+func OpenEnvelope(msg MessageWriteReply) (*Envelope, error) {
+	if mediaType(msg.ContentType) != EnvelopeContentType {
+		return nil, fmt.Errorf("message %d of type %s is not an envelope", msg.Sequence, msg.ContentType)
+	}
+
+	payload, err := msg.DecodePayload()
+	if err != nil {
+		return nil, err
+	}
+
+	var e Envelope
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, fmt.Errorf("message %d has an invalid envelope : %w", msg.Sequence, err)
+	}
+	if e.Version != EnvelopeVersion {
+		return nil, fmt.Errorf("message %d has an unsupported envelope version %d", msg.Sequence, e.Version)
+	}
+	return &e, nil
+}
+
+// EnvelopedMessage is a message read by MessagesEnveloped.
+// Its payload and content type are the envelope body ones
+type EnvelopedMessage struct {
+	MessageWriteReply
+	// Envelope is nil for the messages which are not enveloped
+	Envelope *Envelope
+	// Err holds the error met opening the envelope of this message
+	Err error
+}
+
+// MessagesEnveloped get messages list and opens the enveloped messages.
+//
+// Messages which are not enveloped are returned as is, with a nil Envelope.
+// Messages whose envelope can not be opened are returned as is too, with
+// the error in Err, the other messages are still opened
+func (c *Client) MessagesEnveloped(ctx context.Context, r MessagesRequest) ([]EnvelopedMessage, error) {
+	msgs, err := c.Messages(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]EnvelopedMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		if mediaType(msg.ContentType) != EnvelopeContentType {
+			res = append(res, EnvelopedMessage{MessageWriteReply: msg})
+			continue
+		}
+
+		e, err := OpenEnvelope(msg)
+		if err != nil {
+			res = append(res, EnvelopedMessage{MessageWriteReply: msg, Err: err})
+			continue
+		}
+
+		msg.Payload = base64.StdEncoding.EncodeToString(e.Body)
+		msg.ContentType = e.ContentType
+		res = append(res, EnvelopedMessage{
+			MessageWriteReply: msg,
+			Envelope:          e,
+		})
+	}
+
+	return res, nil
+}
@@ -0,0 +1,98 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitEnvelope(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+
+	e, err := NewEnvelope([]byte(`{"a":1}`), "application/json")
+	assert.NoError(t, err)
+	e.ReplyTo = "replies"
+	e.Sender = "alice"
+	e.SchemaVersion = "2"
+	e.SetHeader("trace-id", "abc")
+
+	_, err = client.MessageWriteEnvelope(ctx, "channel", e)
+	assert.NoError(t, err)
+	s.add("channel", "text/plain", []byte("plain"))
+
+	r, err := e.Reply([]byte("ok"), "text/plain")
+	assert.NoError(t, err)
+	_, err = client.MessageWriteEnvelope(ctx, "channel", r)
+	assert.NoError(t, err)
+
+	assert.Equal(t, EnvelopeContentType, s.messages("channel")[0].ContentType)
+
+	msgs, err := client.MessagesEnveloped(ctx, MessagesRequest{ChannelID: "channel"})
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 3)
+
+	assert.NotNil(t, msgs[0].Envelope)
+	assert.Equal(t, e.ID, msgs[0].Envelope.ID)
+	assert.Equal(t, "replies", msgs[0].Envelope.ReplyTo)
+	assert.Equal(t, "alice", msgs[0].Envelope.Sender)
+	assert.Equal(t, "2", msgs[0].Envelope.SchemaVersion)
+	assert.Equal(t, "abc", msgs[0].Envelope.Header("trace-id"))
+	assert.False(t, msgs[0].Envelope.CreatedAt.IsZero())
+	assert.Equal(t, "application/json", msgs[0].ContentType)
+	payload, err := msgs[0].DecodePayload()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, string(payload))
+
+	assert.Nil(t, msgs[1].Envelope)
+	assert.Equal(t, "text/plain", msgs[1].ContentType)
+
+	assert.Equal(t, e.ID, msgs[2].Envelope.CorrelationID)
+	assert.NotEqual(t, e.ID, msgs[2].Envelope.ID)
+}
+
+func TestUnitEnvelopeDefaults(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+
+	e := &Envelope{Body: []byte("x")}
+	_, err := client.MessageWriteEnvelope(context.Background(), "channel", e)
+	assert.NoError(t, err)
+	assert.Len(t, e.ID, 32)
+	assert.False(t, e.CreatedAt.IsZero())
+	assert.Equal(t, EnvelopeVersion, e.Version)
+
+	_, err = client.MessageWriteEnvelope(context.Background(), "channel", &Envelope{
+		Body: []byte(strings.Repeat("x", MaxMessageContentLength)),
+	})
+	assert.True(t, errors.Is(err, ErrMessageTooLarge))
+}
+
+func TestUnitEnvelopeInvalid(t *testing.T) {
+	s := newMockServer()
+	s.add("channel", EnvelopeContentType, []byte(`{"v":`))
+	client := newMockClient(s)
+	ctx := context.Background()
+	e, err := NewEnvelope([]byte("hello"), "text/plain")
+	assert.NoError(t, err)
+	_, err = client.MessageWriteEnvelope(ctx, "channel", e)
+	assert.NoError(t, err)
+
+	// The malformed envelope is returned as is, the others are still opened
+	msgs, err := client.MessagesEnveloped(ctx, MessagesRequest{ChannelID: "channel"})
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+	assert.Error(t, msgs[0].Err)
+	assert.Nil(t, msgs[0].Envelope)
+	assert.Equal(t, EnvelopeContentType, msgs[0].ContentType)
+	assert.NoError(t, msgs[1].Err)
+	assert.Equal(t, e.ID, msgs[1].Envelope.ID)
+	assert.Equal(t, "text/plain", msgs[1].ContentType)
+
+	_, err = OpenEnvelope(MessageWriteReply{ContentType: "text/plain"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,344 @@
+package spvchannels
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// EventContentType is the content type of the messages holding events
+	EventContentType = "application/vnd.spvchannels.events+json"
+	// SnapshotContentType is the content type of the messages holding snapshots
+	SnapshotContentType = "application/vnd.spvchannels.snapshot+json"
+)
+
+// ErrSharedToken is returned by EventStore.Subscribe when the subscription
+// would read the channel with the store token
+var ErrSharedToken = errors.New("subscription must not share the event store token")
+
+// ErrVersionConflict is returned by EventStore when another writer appended
+// to the channel since the version known by the store. Load the new events
+// and retry
+type ErrVersionConflict struct {
+	Expected int64
+	Err      error
+}
+
+func (e ErrVersionConflict) Error() string {
+	return fmt.Sprintf("channel changed since version %d : %s", e.Expected, e.Err)
+}
+
+// Unwrap return the conflict error
+func (e ErrVersionConflict) Unwrap() error {
+	return e.Err
+}
+
+// Event is a domain event appended to an EventStore
+type Event struct {
+	Type     string            `json:"type"`
+	Data     json.RawMessage   `json:"data"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// RecordedEvent is an event read from the channel. The events appended
+// together share the sequence of their message and are ordered by index
+type RecordedEvent struct {
+	Event
+	Sequence int64
+	Index    int
+	Received string
+}
+
+// Snapshot is the state built from the events up to Version included
+type Snapshot struct {
+	Version  int64           `json:"version"`
+	State    json.RawMessage `json:"state"`
+	Sequence int64           `json:"-"`
+}
+
+// EventHandlerFunc is called by a subscription for each event
+type EventHandlerFunc func(ctx context.Context, e RecordedEvent) error
+
+// EventStore is an append-only event log on a channel created with Sequenced set.
+//
+// The version of the store is the last sequence it read or wrote. Append and
+// SaveSnapshot succeed only if no other writer appended since this version,
+// otherwise they return ErrVersionConflict and the store must Load the new
+// events first. The events of one Append are written in a single message, so
+// they are appended all together or not at all.
+//
+// AppendAt checks the version against the channel head instead, for callers
+// keeping the version along with the state they rebuilt.
+//
+// Subscribe must read the channel with another token than the store: the
+// server read flags are per token, and a subscription marking the events as
+// read with the store token would hide the writes of the other writers from
+// the conflict check.
+//
+// Example of usage :
+//
+//	store := spv.NewEventStore(client, channelid)
+//	snapshot, events, err := store.LoadSnapshot(ctx)
+//	state := rebuild(snapshot, events)
+//	_, err = store.Append(ctx, spv.Event{Type: "deposited", Data: data})
+//	if errors.As(err, &spv.ErrVersionConflict{}) {
+//		// load the new events and retry
+//	}
+type EventStore struct {
+	mu        sync.Mutex
+	client    *Client
+	channelID string
+	writer    *SequencedWriter
+	version   int64
+}
+
+// NewEventStore create an event store on the sequenced channel channelID
+func NewEventStore(client *Client, channelID string) *EventStore {
+	return &EventStore{
+		client:    client,
+		channelID: channelID,
+		writer:    NewSequencedWriter(client, channelID, nil, 1),
+	}
+}
+
+// Version return the last sequence read or written by the store
+func (s *EventStore) Version() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// Append writes the events in a single message and return its sequence
+func (s *EventStore) Append(ctx context.Context, events ...Event) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(events) == 0 {
+		return s.version, nil
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		return 0, err
+	}
+	return s.write(ctx, data, EventContentType)
+}
+
+// AppendAt writes the events in a single message if the last sequence of the
+// channel is expectedVersion, and return its sequence. It returns
+// ErrVersionConflict if the channel head moved past expectedVersion.
+//
+// The messages up to expectedVersion are marked as read, since the caller
+// has seen them, and the store version moves to expectedVersion first
+func (s *EventStore) AppendAt(ctx context.Context, expectedVersion int64, events ...Event) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	head, err := s.client.messageHeadSequence(ctx, s.channelID)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read channel head : %w", err)
+	}
+	if head != expectedVersion {
+		return 0, ErrVersionConflict{
+			Expected: expectedVersion,
+			Err:      fmt.Errorf("channel head is %d", head),
+		}
+	}
+
+	if head > 0 {
+		if err := s.client.MessageMark(ctx, MessageMarkRequest{
+			ChannelID: s.channelID,
+			Sequence:  head,
+			Older:     true,
+			Read:      true,
+		}); err != nil {
+			return 0, fmt.Errorf("unable mark messages as read : %w", err)
+		}
+	}
+	s.version = head
+
+	if len(events) == 0 {
+		return s.version, nil
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		return 0, err
+	}
+	return s.write(ctx, data, EventContentType)
+}
+
+// SaveSnapshot writes the state built from the events up to the store
+// version and return the sequence of the snapshot
+func (s *EventStore) SaveSnapshot(ctx context.Context, state interface{}) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(Snapshot{
+		Version: s.version,
+		State:   raw,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return s.write(ctx, data, SnapshotContentType)
+}
+
+// write appends a message and moves the version to its sequence
+func (s *EventStore) write(ctx context.Context, data []byte, cty string) (int64, error) {
+	reply, err := s.writer.Write(ctx, MessageWriteRequest{
+		Message:     string(data),
+		ContentType: cty,
+	})
+	var conflict ErrWriteConflict
+	if errors.As(err, &conflict) {
+		return 0, ErrVersionConflict{
+			Expected: s.version,
+			Err:      conflict.Err,
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	s.version = reply.Sequence
+	return reply.Sequence, nil
+}
+
+// Load return the events from the sequence fromSeq and moves the store
+// version to the last sequence of the channel
+func (s *EventStore) Load(ctx context.Context, fromSeq int64) ([]RecordedEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, events, err := s.load(ctx, fromSeq, false)
+	return events, err
+}
+
+// LoadSnapshot return the last snapshot, nil if none, with the events after
+// it, and moves the store version to the last sequence of the channel
+func (s *EventStore) LoadSnapshot(ctx context.Context) (*Snapshot, []RecordedEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.load(ctx, 0, true)
+}
+
+// load streams the channel, keeping the events after the last snapshot if
+// useSnapshot is set, then marks the channel as read up to its last sequence
+func (s *EventStore) load(ctx context.Context, fromSeq int64, useSnapshot bool) (*Snapshot, []RecordedEvent, error) {
+	it, err := s.client.MessageIterator(ctx, MessagesRequest{ChannelID: s.channelID}, MessageFilter{})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = it.Close()
+	}()
+
+	var snapshot *Snapshot
+	var head int64
+	events := []RecordedEvent{}
+	for it.Next() {
+		msg := it.Message()
+		if msg.Sequence > head {
+			head = msg.Sequence
+		}
+
+		switch {
+		case useSnapshot && mediaType(msg.ContentType) == SnapshotContentType:
+			if snapshot, err = decodeSnapshot(msg); err != nil {
+				return nil, nil, err
+			}
+			events = events[:0]
+		case mediaType(msg.ContentType) == EventContentType && msg.Sequence >= fromSeq:
+			decoded, err := decodeEvents(msg)
+			if err != nil {
+				return nil, nil, err
+			}
+			events = append(events, decoded...)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if head > s.version {
+		if err := s.client.MessageMark(ctx, MessageMarkRequest{
+			ChannelID: s.channelID,
+			Sequence:  head,
+			Older:     true,
+			Read:      true,
+		}); err != nil {
+			return nil, nil, fmt.Errorf("unable mark messages as read : %w", err)
+		}
+		s.version = head
+	}
+	return snapshot, events, nil
+}
+
+// decodeSnapshot read the snapshot held by a message
+func decodeSnapshot(msg MessageWriteReply) (*Snapshot, error) {
+	payload, err := msg.DecodePayload()
+	if err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(payload, &snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot at sequence %d : %w", msg.Sequence, err)
+	}
+	snapshot.Sequence = msg.Sequence
+	return &snapshot, nil
+}
+
+// decodeEvents read the events held by a message
+func decodeEvents(msg MessageWriteReply) ([]RecordedEvent, error) {
+	payload, err := msg.DecodePayload()
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	if err := json.Unmarshal(payload, &events); err != nil {
+		return nil, fmt.Errorf("invalid events at sequence %d : %w", msg.Sequence, err)
+	}
+
+	res := make([]RecordedEvent, 0, len(events))
+	for i, e := range events {
+		res = append(res, RecordedEvent{
+			Event:    e,
+			Sequence: msg.Sequence,
+			Index:    i,
+			Received: msg.Received,
+		})
+	}
+	return res, nil
+}
+
+// Subscribe return a consumer reading the channel with client and calling h
+// for each event, in order. Snapshots and other messages are skipped. The
+// consumer is driven by its Pull, Run or NotificationHandler methods.
+//
+// It returns ErrSharedToken if client authenticates as the store client
+func (s *EventStore) Subscribe(client *Client, h EventHandlerFunc, opts ...ConsumerConfigFunc) (*Consumer, error) {
+	if client.cfg.token == s.client.cfg.token && (client.cfg.token != "" || client.cfg.user == s.client.cfg.user) {
+		return nil, ErrSharedToken
+	}
+	return NewConsumer(client, s.channelID, func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		if mediaType(msg.ContentType) != EventContentType {
+			return nil
+		}
+		events, err := decodeEvents(msg)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			if err := h(ctx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, opts...), nil
+}
@@ -0,0 +1,190 @@
+package spvchannels
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEventStores(s *mockServer) (*EventStore, *EventStore) {
+	s.mu.Lock()
+	s.sequenced["events"] = true
+	s.mu.Unlock()
+	client := newMockClient(s)
+	return NewEventStore(client.withToken("a"), "events"), NewEventStore(client.withToken("b"), "events")
+}
+
+func eventTypes(events []RecordedEvent) []string {
+	res := []string{}
+	for _, e := range events {
+		res = append(res, e.Type)
+	}
+	return res
+}
+
+func TestUnitEventStoreAppendLoad(t *testing.T) {
+	s := newMockServer()
+	a, b := newEventStores(s)
+	ctx := context.Background()
+
+	seq, err := a.Append(ctx,
+		Event{Type: "opened", Data: json.RawMessage(`{}`)},
+		Event{Type: "deposited", Data: json.RawMessage(`{"amount":10}`)},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), seq)
+	seq, err = a.Append(ctx, Event{Type: "withdrawn", Data: json.RawMessage(`{"amount":5}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), seq)
+
+	// b has not seen the events of a
+	_, err = b.Append(ctx, Event{Type: "closed", Data: json.RawMessage(`{}`)})
+	var conflict ErrVersionConflict
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, int64(0), conflict.Expected)
+	assert.True(t, IsConflict(err))
+
+	events, err := b.Load(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"opened", "deposited", "withdrawn"}, eventTypes(events))
+	assert.Equal(t, 1, events[1].Index)
+	assert.Equal(t, json.RawMessage(`{"amount":10}`), events[1].Data)
+	assert.Equal(t, int64(2), b.Version())
+
+	seq, err = b.Append(ctx, Event{Type: "closed", Data: json.RawMessage(`{}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), seq)
+
+	events, err = a.Load(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"withdrawn", "closed"}, eventTypes(events))
+}
+
+func TestUnitEventStoreSnapshot(t *testing.T) {
+	s := newMockServer()
+	a, b := newEventStores(s)
+	ctx := context.Background()
+
+	snapshot, events, err := a.LoadSnapshot(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, snapshot)
+	assert.Empty(t, events)
+
+	_, err = a.Append(ctx, Event{Type: "deposited", Data: json.RawMessage(`{"amount":10}`)})
+	assert.NoError(t, err)
+	seq, err := a.SaveSnapshot(ctx, map[string]int{"balance": 10})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), seq)
+	_, err = a.Append(ctx, Event{Type: "deposited", Data: json.RawMessage(`{"amount":5}`)})
+	assert.NoError(t, err)
+
+	snapshot, events, err = b.LoadSnapshot(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, &Snapshot{Version: 1, State: json.RawMessage(`{"balance":10}`), Sequence: 2}, snapshot)
+	assert.Equal(t, []string{"deposited"}, eventTypes(events))
+	assert.Equal(t, int64(3), events[0].Sequence)
+
+	// Load skips the snapshots
+	events, err = b.Load(ctx, 0)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+}
+
+func TestUnitEventStoreSubscribe(t *testing.T) {
+	s := newMockServer()
+	a, _ := newEventStores(s)
+	ctx := context.Background()
+
+	_, err := a.Append(ctx, Event{Type: "opened"}, Event{Type: "deposited"})
+	assert.NoError(t, err)
+	_, err = a.SaveSnapshot(ctx, map[string]int{})
+	assert.NoError(t, err)
+	_, err = a.Append(ctx, Event{Type: "closed"})
+	assert.NoError(t, err)
+
+	got := []string{}
+	consumer, err := a.Subscribe(newMockClient(s).withToken("reader"), func(ctx context.Context, e RecordedEvent) error {
+		got = append(got, e.Type)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, consumer.Pull(ctx))
+	assert.Equal(t, []string{"opened", "deposited", "closed"}, got)
+
+	checkpoint, err := consumer.Checkpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), checkpoint)
+}
+
+func TestUnitEventStoreAppendAt(t *testing.T) {
+	s := newMockServer()
+	a, b := newEventStores(s)
+	ctx := context.Background()
+
+	seq, err := a.AppendAt(ctx, 0, Event{Type: "opened"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), seq)
+
+	// b carries the version of the state it rebuilt, not the store one
+	_, err = b.AppendAt(ctx, 0, Event{Type: "closed"})
+	var conflict ErrVersionConflict
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, int64(0), conflict.Expected)
+
+	seq, err = b.AppendAt(ctx, 1, Event{Type: "deposited"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), seq)
+	assert.Equal(t, int64(2), b.Version())
+
+	// a store behind the channel is checked against the head too
+	_, err = a.AppendAt(ctx, 1, Event{Type: "withdrawn"})
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, int64(1), conflict.Expected)
+	events, err := a.Load(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"opened", "deposited"}, eventTypes(events))
+}
+
+func TestUnitEventStoreSubscribeWhileAppending(t *testing.T) {
+	s := newMockServer()
+	a, _ := newEventStores(s)
+	ctx := context.Background()
+
+	_, err := a.Subscribe(newMockClient(s).withToken("a"), func(ctx context.Context, e RecordedEvent) error {
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrSharedToken)
+
+	got := []string{}
+	consumer, err := a.Subscribe(newMockClient(s).withToken("reader"), func(ctx context.Context, e RecordedEvent) error {
+		got = append(got, e.Type)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 10; i++ {
+			if _, err := a.Append(ctx, Event{Type: "deposited"}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for pulling := true; pulling; {
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+			pulling = false
+		default:
+		}
+		assert.NoError(t, consumer.Pull(ctx))
+	}
+
+	assert.Len(t, got, 10)
+	assert.Equal(t, int64(10), a.Version())
+}
@@ -87,7 +87,7 @@ func main() {
 		spv.WithChannelID(channelid),
 		spv.WithToken(tok),
 		spv.WithInsecure(),
-		spv.WithWebsocketCallBack(PullUnreadMessages),
+		spv.WithWebsocketCallBack(spv.Chain(PullUnreadMessages, spv.Recovery())),
 	)
 
 	if err != nil {
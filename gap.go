@@ -0,0 +1,125 @@
+package spvchannels
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// GapCause is the likely cause of a sequence gap
+type GapCause int
+
+const (
+	// GapPruned the missing messages are older than every message left on the
+	// channel, they were likely removed by the channel retention
+	GapPruned GapCause = iota
+	// GapDeleted the missing messages are between messages left on the
+	// channel, they were likely deleted
+	GapDeleted
+)
+
+func (c GapCause) String() string {
+	switch c {
+	case GapPruned:
+		return "pruned"
+	case GapDeleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("GapCause(%d)", int(c))
+}
+
+// SequenceGap reports missing sequences, from From to To included, skipped by a consumer
+type SequenceGap struct {
+	ChannelID string
+	From      int64
+	To        int64
+	Cause     GapCause
+}
+
+func (g SequenceGap) String() string {
+	return fmt.Sprintf("channel %s missing sequences %d to %d (%s)", g.ChannelID, g.From, g.To, g.Cause)
+}
+
+// GapHandlerFunc is called when a consumer skips a sequence gap
+type GapHandlerFunc func(ctx context.Context, gap SequenceGap)
+
+// gapConfig hold configuration of the consumer gap detection
+type gapConfig struct {
+	wait    time.Duration
+	handler GapHandlerFunc
+}
+
+// WithGapDetection check the processed sequences are contiguous.
+//
+// When a message after the checkpoint is missing, the following messages are
+// buffered and not delivered, until the missing message shows up or wait is
+// elapsed. The gap is then reported to h and the consumer moves on. The
+// handler is always called in strictly ascending sequence order
+func WithGapDetection(wait time.Duration, h GapHandlerFunc) ConsumerConfigFunc {
+	return func(c *consumerConfig) {
+		c.gaps = &gapConfig{
+			wait:    wait,
+			handler: h,
+		}
+	}
+}
+
+// gapState hold the messages buffered by a consumer waiting for a gap to fill
+type gapState struct {
+	buffer map[int64]MessageWriteReply
+	since  time.Time
+}
+
+// merge adds msgs to the buffered messages after last, and return all of
+// them in ascending sequence order
+func (c *Consumer) merge(msgs MessagesReply) MessagesReply {
+	if c.gap.buffer == nil {
+		c.gap.buffer = make(map[int64]MessageWriteReply)
+	}
+	for _, msg := range msgs {
+		if msg.Sequence > c.last {
+			c.gap.buffer[msg.Sequence] = msg
+		}
+	}
+
+	res := make(MessagesReply, 0, len(c.gap.buffer))
+	for seq, msg := range c.gap.buffer {
+		if seq <= c.last {
+			delete(c.gap.buffer, seq)
+			continue
+		}
+		res = append(res, msg)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Sequence < res[j].Sequence
+	})
+	return res
+}
+
+// skipGap tells if the consumer should move on past the missing messages
+// before msg, reporting the gap. oldest is the lowest sequence read from the channel
+func (c *Consumer) skipGap(ctx context.Context, msg MessageWriteReply, oldest int64) bool {
+	if c.gap.since.IsZero() {
+		c.gap.since = time.Now()
+	}
+	if time.Since(c.gap.since) < c.cfg.gaps.wait {
+		return false
+	}
+
+	gap := SequenceGap{
+		ChannelID: c.channelID,
+		From:      c.last + 1,
+		To:        msg.Sequence - 1,
+		Cause:     GapDeleted,
+	}
+	if msg.Sequence <= oldest {
+		gap.Cause = GapPruned
+	}
+	c.gap.since = time.Time{}
+
+	if c.cfg.gaps.handler != nil {
+		c.cfg.gaps.handler(ctx, gap)
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package spvchannels
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitConsumerGapDetection(t *testing.T) {
+	tests := map[string]struct {
+		deleteSeqs []int64
+		expGaps    []SequenceGap
+		expSeqs    []int64
+	}{
+		"Contiguous": {
+			expSeqs: []int64{1, 2, 3, 4},
+		},
+		"Deleted in the middle": {
+			deleteSeqs: []int64{2, 3},
+			expGaps:    []SequenceGap{{ChannelID: "channel", From: 2, To: 3, Cause: GapDeleted}},
+			expSeqs:    []int64{1, 4},
+		},
+		"Pruned at the start": {
+			deleteSeqs: []int64{1, 2},
+			expGaps:    []SequenceGap{{ChannelID: "channel", From: 1, To: 2, Cause: GapPruned}},
+			expSeqs:    []int64{3, 4},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newMockServer()
+			client := newMockClient(s)
+			ctx := context.Background()
+			for i := 0; i < 4; i++ {
+				s.add("channel", "text/plain", []byte("m"))
+			}
+			for _, seq := range test.deleteSeqs {
+				assert.NoError(t, client.MessageDelete(ctx, MessageDeleteRequest{ChannelID: "channel", Sequence: seq}))
+			}
+
+			gaps := []SequenceGap{}
+			seqs := []int64{}
+			consumer := NewConsumer(client, "channel", func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+				seqs = append(seqs, msg.Sequence)
+				return nil
+			}, WithGapDetection(0, func(ctx context.Context, gap SequenceGap) {
+				gaps = append(gaps, gap)
+			}))
+
+			assert.NoError(t, consumer.Pull(ctx))
+			if test.expGaps == nil {
+				assert.Empty(t, gaps)
+			} else {
+				assert.Equal(t, test.expGaps, gaps)
+			}
+			assert.Equal(t, test.expSeqs, seqs)
+		})
+	}
+}
+
+func TestUnitConsumerGapWait(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		s.add("channel", "text/plain", []byte("m"))
+	}
+	assert.NoError(t, client.MessageDelete(ctx, MessageDeleteRequest{ChannelID: "channel", Sequence: 2}))
+
+	gaps := []SequenceGap{}
+	seqs := []int64{}
+	consumer := NewConsumer(client, "channel", func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		seqs = append(seqs, msg.Sequence)
+		return nil
+	}, WithGapDetection(20*time.Millisecond, func(ctx context.Context, gap SequenceGap) {
+		gaps = append(gaps, gap)
+	}))
+
+	// Sequence 3 is held until the wait is over
+	assert.NoError(t, consumer.Pull(ctx))
+	assert.Equal(t, []int64{1}, seqs)
+	assert.Empty(t, gaps)
+
+	// Sequence 3 is buffered, it is delivered even if it is no longer listed
+	assert.NoError(t, client.MessageDelete(ctx, MessageDeleteRequest{ChannelID: "channel", Sequence: 3}))
+	time.Sleep(30 * time.Millisecond)
+	assert.NoError(t, consumer.Pull(ctx))
+	assert.Equal(t, []int64{1, 3}, seqs)
+	assert.Equal(t, []SequenceGap{{ChannelID: "channel", From: 2, To: 2, Cause: GapDeleted}}, gaps)
+	assert.Equal(t, "channel channel missing sequences 2 to 2 (deleted)", gaps[0].String())
+}
+
+func TestUnitConsumerGapReadError(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	for i := 0; i < 2; i++ {
+		s.add("channel", "text/plain", []byte("m"))
+	}
+
+	seqs := []int64{}
+	consumer := NewConsumer(client, "channel", func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		seqs = append(seqs, msg.Sequence)
+		return nil
+	}, WithGapDetection(time.Hour, nil))
+
+	s.failNext(http.MethodGet, 1)
+	assert.Error(t, consumer.Pull(context.Background()))
+	assert.NoError(t, consumer.Pull(context.Background()))
+	assert.Equal(t, []int64{1, 2}, seqs)
+}
@@ -0,0 +1,305 @@
+package spvchannels
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// GroupContentType is the content type of the messages holding a GroupEnvelope
+const GroupContentType = "application/vnd.spvchannels.group+json"
+
+// AlgGroupAESGCM is the group encryption algorithm: the content is encrypted
+// with AES-256-GCM and the content key is wrapped with AlgX25519AESGCM for
+// every member
+const AlgGroupAESGCM = "A256GCM+" + AlgX25519AESGCM
+
+// groupDescriptionPrefix prefixes the description of the tokens created for group members
+const groupDescriptionPrefix = "spvgroup:"
+
+// ErrNotGroupMember is returned when decrypting a group envelope not wrapping the content key for the decrypter key
+var ErrNotGroupMember = errors.New("not a member of the group")
+
+// GroupMember is a member of an encryption group, usually holding a read token of the channel
+type GroupMember struct {
+	Name      string
+	TokenID   string
+	PublicKey X25519PublicKey
+}
+
+// GroupEnvelope is the message content of a group encrypted message.
+//
+// The content is encrypted once with the content key of the group
+// generation, the content key is wrapped for each member in Recipients
+type GroupEnvelope struct {
+	Version     int                 `json:"v"`
+	Algorithm   string              `json:"alg"`
+	Generation  uint32              `json:"gen"`
+	Recipients  []EncryptedEnvelope `json:"recipients"`
+	ContentType string              `json:"cty,omitempty"`
+	Nonce       []byte              `json:"nonce"`
+	Ciphertext  []byte              `json:"ct"`
+}
+
+func (e GroupEnvelope) aad() []byte {
+	return []byte(fmt.Sprintf("%d|%s|%d|%s", e.Version, e.Algorithm, e.Generation, e.ContentType))
+}
+
+// GroupKey holds the members and the current content key of an encryption group.
+//
+// Any membership change rotates the content key, so a removed member can not
+// read the next messages and a new member can not read the previous ones.
+// It is safe for concurrent use
+type GroupKey struct {
+	mu         sync.Mutex
+	members    map[string]GroupMember
+	generation uint32
+	key        []byte
+	wrapped    []EncryptedEnvelope
+}
+
+// NewGroupKey create a group with the given members and a fresh content key
+func NewGroupKey(members ...GroupMember) (*GroupKey, error) {
+	g := &GroupKey{
+		members: make(map[string]GroupMember),
+	}
+	for _, m := range members {
+		g.members[KeyID(m.PublicKey.Bytes())] = m
+	}
+
+	if err := g.rotate(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// rotate generate a new content key and wraps it for every member
+func (g *GroupKey) rotate() error {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+
+	wrapped := make([]EncryptedEnvelope, 0, len(g.members))
+	for _, m := range g.members {
+		e, err := NewX25519Encrypter(m.PublicKey).Encrypt(key, "")
+		if err != nil {
+			return err
+		}
+		wrapped = append(wrapped, *e)
+	}
+	sort.Slice(wrapped, func(i, j int) bool {
+		return wrapped[i].KeyID < wrapped[j].KeyID
+	})
+
+	g.key = key
+	g.wrapped = wrapped
+	g.generation++
+	return nil
+}
+
+// Rotate generate a new content key
+func (g *GroupKey) Rotate() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rotate()
+}
+
+// Generation return the generation of the current content key
+func (g *GroupKey) Generation() uint32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.generation
+}
+
+// AddMember add a member to the group and rotates the content key
+func (g *GroupKey) AddMember(m GroupMember) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members[KeyID(m.PublicKey.Bytes())] = m
+	return g.rotate()
+}
+
+// RemoveMember remove the member with the key id kid and rotates the content key
+func (g *GroupKey) RemoveMember(kid string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.members[kid]; !ok {
+		return nil
+	}
+	delete(g.members, kid)
+	return g.rotate()
+}
+
+// Members return the group members sorted by name
+func (g *GroupKey) Members() []GroupMember {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	res := make([]GroupMember, 0, len(g.members))
+	for _, m := range g.members {
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// Encrypt return the group envelope of a message content
+func (g *GroupKey) Encrypt(plaintext []byte, contentType string) (*GroupEnvelope, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	e := &GroupEnvelope{
+		Version:     EncryptedEnvelopeVersion,
+		Algorithm:   AlgGroupAESGCM,
+		Generation:  g.generation,
+		Recipients:  g.wrapped,
+		ContentType: contentType,
+	}
+
+	var err error
+	if e.Nonce, e.Ciphertext, err = sealAESGCM(g.key, plaintext, e.aad()); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// DecryptGroup unwraps the content key of the envelope with dec and decrypts the content
+func DecryptGroup(e *GroupEnvelope, dec PayloadDecrypter) ([]byte, error) {
+	if e.Version != EncryptedEnvelopeVersion || e.Algorithm != AlgGroupAESGCM {
+		return nil, fmt.Errorf("unsupported envelope version %d algorithm %s", e.Version, e.Algorithm)
+	}
+
+	kid := dec.KeyID()
+	for i := range e.Recipients {
+		if e.Recipients[i].KeyID != kid {
+			continue
+		}
+
+		key, err := dec.Decrypt(&e.Recipients[i])
+		if err != nil {
+			return nil, err
+		}
+		return openAESGCM(key, e.Nonce, e.Ciphertext, e.aad())
+	}
+
+	return nil, ErrNotGroupMember
+}
+
+// MessageWriteGroup encrypts the message once for all the members of g and
+// writes the resulting GroupEnvelope to the channel.
+//
+// The envelope holds a wrapped key per member, so large groups leave less
+// room for the message itself
+func (c *Client) MessageWriteGroup(ctx context.Context, r MessageWriteRequest, g *GroupKey) (*MessageWriteReply, error) {
+	e, err := g.Encrypt([]byte(r.Message), r.ContentType)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt message : %w", err)
+	}
+	return c.writeSized(ctx, r.ChannelID, GroupContentType, e, "group message")
+}
+
+// GroupMemberDescription return the token description recording a group member
+func GroupMemberDescription(name string, pub X25519PublicKey) string {
+	return groupDescriptionPrefix + name + ":" + base64.RawURLEncoding.EncodeToString(pub.Bytes())
+}
+
+// parseGroupMemberDescription return the group member recorded in a token description
+func parseGroupMemberDescription(tokenID, description string) (*GroupMember, bool) {
+	if !strings.HasPrefix(description, groupDescriptionPrefix) {
+		return nil, false
+	}
+
+	desc := strings.TrimPrefix(description, groupDescriptionPrefix)
+	i := strings.LastIndex(desc, ":")
+	if i < 0 {
+		return nil, false
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(desc[i+1:])
+	if err != nil {
+		return nil, false
+	}
+	pub, err := ParseX25519PublicKey(raw)
+	if err != nil {
+		return nil, false
+	}
+
+	return &GroupMember{
+		Name:      desc[:i],
+		TokenID:   tokenID,
+		PublicKey: pub,
+	}, true
+}
+
+// Invite create a read token for a new member on the channel, recording its
+// name and public key in the token description, then adds it to the group
+func (g *GroupKey) Invite(ctx context.Context, c *Client, accountID int64, channelID, name string, pub X25519PublicKey) (*TokenCreateReply, error) {
+	reply, err := c.TokenCreate(ctx, TokenCreateRequest{
+		AccountID:   accountID,
+		ChannelID:   channelID,
+		Description: GroupMemberDescription(name, pub),
+		CanRead:     true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create member token : %w", err)
+	}
+
+	if err := g.AddMember(GroupMember{
+		Name:      name,
+		TokenID:   reply.ID,
+		PublicKey: pub,
+	}); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Revoke delete the token of the member with the key id kid and removes it from the group
+func (g *GroupKey) Revoke(ctx context.Context, c *Client, accountID int64, channelID, kid string) error {
+	g.mu.Lock()
+	m, ok := g.members[kid]
+	g.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if m.TokenID != "" {
+		if err := c.TokenDelete(ctx, TokenDeleteRequest{
+			AccountID: accountID,
+			ChannelID: channelID,
+			TokenID:   m.TokenID,
+		}); err != nil {
+			return fmt.Errorf("unable to delete member token : %w", err)
+		}
+	}
+
+	return g.RemoveMember(kid)
+}
+
+// LoadGroupKey create a group with the members recorded in the descriptions
+// of the channel tokens created by Invite
+func LoadGroupKey(ctx context.Context, c *Client, accountID int64, channelID string) (*GroupKey, error) {
+	tokens, err := c.Tokens(ctx, TokensRequest{
+		AccountID: accountID,
+		ChannelID: channelID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read tokens : %w", err)
+	}
+
+	members := []GroupMember{}
+	for _, t := range *tokens {
+		if m, ok := parseGroupMemberDescription(t.ID, t.Description); ok {
+			members = append(members, *m)
+		}
+	}
+	return NewGroupKey(members...)
+}
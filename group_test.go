@@ -0,0 +1,91 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitGroupKey(t *testing.T) {
+	alice, err := GenerateX25519Key()
+	assert.NoError(t, err)
+	bob, err := GenerateX25519Key()
+	assert.NoError(t, err)
+
+	g, err := NewGroupKey(
+		GroupMember{Name: "alice", PublicKey: alice.PublicKey()},
+		GroupMember{Name: "bob", PublicKey: bob.PublicKey()},
+	)
+	assert.NoError(t, err)
+
+	e, err := g.Encrypt([]byte("hello group"), "text/plain")
+	assert.NoError(t, err)
+	assert.Len(t, e.Recipients, 2)
+
+	for _, k := range []X25519PrivateKey{alice, bob} {
+		plaintext, err := DecryptGroup(e, NewX25519Decrypter(k))
+		assert.NoError(t, err)
+		assert.Equal(t, "hello group", string(plaintext))
+	}
+
+	// Removing a member rotates the key, the member can not read the next messages
+	generation := g.Generation()
+	assert.NoError(t, g.RemoveMember(KeyID(bob.PublicKey().Bytes())))
+	assert.Equal(t, generation+1, g.Generation())
+
+	e, err = g.Encrypt([]byte("without bob"), "text/plain")
+	assert.NoError(t, err)
+	_, err = DecryptGroup(e, NewX25519Decrypter(bob))
+	assert.True(t, errors.Is(err, ErrNotGroupMember))
+	plaintext, err := DecryptGroup(e, NewX25519Decrypter(alice))
+	assert.NoError(t, err)
+	assert.Equal(t, "without bob", string(plaintext))
+}
+
+func TestUnitGroupTokens(t *testing.T) {
+	alice, err := GenerateX25519Key()
+	assert.NoError(t, err)
+	bob, err := GenerateX25519Key()
+	assert.NoError(t, err)
+
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+
+	g, err := NewGroupKey()
+	assert.NoError(t, err)
+	_, err = g.Invite(ctx, client, 1, "channel", "alice", alice.PublicKey())
+	assert.NoError(t, err)
+	reply, err := g.Invite(ctx, client, 1, "channel", "bob", bob.PublicKey())
+	assert.NoError(t, err)
+	assert.True(t, reply.CanRead)
+	assert.False(t, reply.CanWrite)
+
+	// The members are restored from the token descriptions
+	loaded, err := LoadGroupKey(ctx, client, 1, "channel")
+	assert.NoError(t, err)
+	members := loaded.Members()
+	assert.Len(t, members, 2)
+	assert.Equal(t, "alice", members[0].Name)
+	assert.Equal(t, bob.PublicKey().Bytes(), members[1].PublicKey.Bytes())
+
+	_, err = client.MessageWriteGroup(ctx, MessageWriteRequest{
+		ChannelID:   "channel",
+		Message:     "hello group",
+		ContentType: "text/plain",
+	}, loaded)
+	assert.NoError(t, err)
+
+	msgs, err := client.MessagesDecrypted(ctx, MessagesRequest{ChannelID: "channel"}, NewX25519Decrypter(bob))
+	assert.NoError(t, err)
+	payload, err := msgs[0].DecodePayload()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello group", string(payload))
+	assert.Equal(t, "text/plain", msgs[0].ContentType)
+
+	assert.NoError(t, loaded.Revoke(ctx, client, 1, "channel", KeyID(bob.PublicKey().Bytes())))
+	assert.Len(t, loaded.Members(), 1)
+	assert.Len(t, s.tokens["channel"], 1)
+}
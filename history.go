@@ -0,0 +1,175 @@
+package spvchannels
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TimedMessage is a message with its parsed received time
+type TimedMessage struct {
+	MessageWriteReply
+	ReceivedAt time.Time
+}
+
+// MessagesBetween return the messages of a channel received from the time
+// from included to the time to excluded, in sequence order.
+//
+// The server can not filter by time, so the whole channel is streamed and
+// filtered on the client side
+func (c *Client) MessagesBetween(ctx context.Context, channelID string, from, to time.Time) ([]TimedMessage, error) {
+	return c.collect(ctx, channelID, MessageFilter{
+		Since: from,
+		Until: to,
+	})
+}
+
+// MessagesSince return the messages of a channel after the sequence seq, in
+// sequence order. Like MessagesBetween, the whole channel is streamed and
+// filtered on the client side
+func (c *Client) MessagesSince(ctx context.Context, channelID string, seq int64) ([]TimedMessage, error) {
+	return c.collect(ctx, channelID, MessageFilter{
+		FromSequence: seq + 1,
+	})
+}
+
+// collect streams the messages passing the filter and sorts them by sequence
+func (c *Client) collect(ctx context.Context, channelID string, f MessageFilter) ([]TimedMessage, error) {
+	it, err := c.MessageIterator(ctx, MessagesRequest{ChannelID: channelID}, f)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = it.Close()
+	}()
+
+	res := []TimedMessage{}
+	for it.Next() {
+		msg := it.Message()
+		received, err := time.Parse(time.RFC3339Nano, msg.Received)
+		if err != nil {
+			return nil, fmt.Errorf("message %d has an invalid received time : %w", msg.Sequence, err)
+		}
+		res = append(res, TimedMessage{
+			MessageWriteReply: msg,
+			ReceivedAt:        received,
+		})
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Sequence < res[j].Sequence
+	})
+	return res, nil
+}
+
+// MessageIndex keeps the history of a channel in memory, so repeated queries
+// are answered from the index.
+//
+// The server can not list the messages after a sequence, so every refresh
+// still downloads the whole channel: only the messages after the last indexed
+// sequence are kept, the filtering is done on the client side. The index
+// saves parsing and memory, not bandwidth.
+//
+// The server stamps the received time when a message is written, so the
+// received times ascend with the sequences and queries are binary searches.
+// Messages deleted or pruned from the channel after they were fetched stay
+// in the index until Forget is called. It is safe for concurrent use
+type MessageIndex struct {
+	mu        sync.Mutex
+	client    *Client
+	channelID string
+	msgs      []TimedMessage
+	last      int64
+}
+
+// NewMessageIndex create an empty index of the channel channelID
+func NewMessageIndex(client *Client, channelID string) *MessageIndex {
+	return &MessageIndex{
+		client:    client,
+		channelID: channelID,
+	}
+}
+
+// Refresh reads the channel, adds the messages after the last indexed
+// sequence and return their number
+func (x *MessageIndex) Refresh(ctx context.Context) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.refresh(ctx)
+}
+
+func (x *MessageIndex) refresh(ctx context.Context) (int, error) {
+	msgs, err := x.client.MessagesSince(ctx, x.channelID, x.last)
+	if err != nil {
+		return 0, err
+	}
+	if len(msgs) > 0 {
+		x.msgs = append(x.msgs, msgs...)
+		x.last = msgs[len(msgs)-1].Sequence
+	}
+	return len(msgs), nil
+}
+
+// Between refreshes the index and return the messages received from the
+// time from included to the time to excluded
+func (x *MessageIndex) Between(ctx context.Context, from, to time.Time) ([]TimedMessage, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if _, err := x.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	i := sort.Search(len(x.msgs), func(i int) bool {
+		return !x.msgs[i].ReceivedAt.Before(from)
+	})
+	j := sort.Search(len(x.msgs), func(i int) bool {
+		return !x.msgs[i].ReceivedAt.Before(to)
+	})
+	if j < i {
+		j = i
+	}
+	return append([]TimedMessage{}, x.msgs[i:j]...), nil
+}
+
+// Since refreshes the index and return the messages after the sequence seq
+func (x *MessageIndex) Since(ctx context.Context, seq int64) ([]TimedMessage, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if _, err := x.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	i := sort.Search(len(x.msgs), func(i int) bool {
+		return x.msgs[i].Sequence > seq
+	})
+	return append([]TimedMessage{}, x.msgs[i:]...), nil
+}
+
+// Forget removes the indexed messages up to the sequence seq included.
+// They are not fetched again
+func (x *MessageIndex) Forget(seq int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	i := sort.Search(len(x.msgs), func(i int) bool {
+		return x.msgs[i].Sequence > seq
+	})
+	x.msgs = append([]TimedMessage{}, x.msgs[i:]...)
+	if seq > x.last {
+		x.last = seq
+	}
+}
+
+// Len return the number of indexed messages
+func (x *MessageIndex) Len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.msgs)
+}
@@ -0,0 +1,83 @@
+package spvchannels
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newHistoryServer return a mock server holding n messages received an hour apart from base
+func newHistoryServer(n int, base time.Time) *mockServer {
+	s := newMockServer()
+	for i := 0; i < n; i++ {
+		s.add("channel", "text/plain", []byte("m"))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.channels["channel"] {
+		m.Received = base.Add(time.Duration(i) * time.Hour).Format(time.RFC3339Nano)
+	}
+	return s
+}
+
+func sequences(msgs []TimedMessage) []int64 {
+	res := []int64{}
+	for _, m := range msgs {
+		res = append(res, m.Sequence)
+	}
+	return res
+}
+
+func TestUnitMessagesBetweenSince(t *testing.T) {
+	base := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	client := newMockClient(newHistoryServer(5, base))
+	ctx := context.Background()
+
+	msgs, err := client.MessagesBetween(ctx, "channel", base.Add(time.Hour), base.Add(3*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2, 3}, sequences(msgs))
+	assert.Equal(t, base.Add(time.Hour), msgs[0].ReceivedAt)
+
+	msgs, err = client.MessagesSince(ctx, "channel", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{4, 5}, sequences(msgs))
+}
+
+func TestUnitMessageIndex(t *testing.T) {
+	base := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	s := newHistoryServer(4, base)
+	x := NewMessageIndex(newMockClient(s), "channel")
+	ctx := context.Background()
+
+	msgs, err := x.Between(ctx, base.Add(30*time.Minute), base.Add(3*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2, 3}, sequences(msgs))
+	assert.Equal(t, 4, x.Len())
+
+	// Deleted messages stay indexed, new ones are fetched
+	assert.NoError(t, newMockClient(s).MessageDelete(ctx, MessageDeleteRequest{ChannelID: "channel", Sequence: 1}))
+	s.add("channel", "text/plain", []byte("m"))
+	n, err := x.Refresh(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	msgs, err = x.Since(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, sequences(msgs))
+
+	x.Forget(2)
+	msgs, err = x.Since(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{3, 4, 5}, sequences(msgs))
+
+	msgs, err = x.Between(ctx, base.Add(5*time.Hour), base)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	s.failNext(http.MethodGet, 1)
+	_, err = x.Since(ctx, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,212 @@
+package spvchannels
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// iteratorMessageOverhead bounds the JSON encoding of a message besides its payload
+const iteratorMessageOverhead = 4096
+
+// MessageFilter selects the messages yielded by a MessageIterator.
+// Zero values disable the corresponding filter
+type MessageFilter struct {
+	// FromSequence skip the messages before this sequence
+	FromSequence int64
+	// Limit stop the iteration after this number of messages
+	Limit int
+	// Since skip the messages received before this time
+	Since time.Time
+	// Until skip the messages received at or after this time
+	Until time.Time
+}
+
+// match tells if a message passes the filter
+func (f MessageFilter) match(msg MessageWriteReply) (bool, error) {
+	if msg.Sequence < f.FromSequence {
+		return false, nil
+	}
+	if f.Since.IsZero() && f.Until.IsZero() {
+		return true, nil
+	}
+
+	received, err := time.Parse(time.RFC3339Nano, msg.Received)
+	if err != nil {
+		return false, fmt.Errorf("message %d has an invalid received time : %w", msg.Sequence, err)
+	}
+	if !f.Since.IsZero() && received.Before(f.Since) {
+		return false, nil
+	}
+	if !f.Until.IsZero() && !received.Before(f.Until) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// boundedReader fails when the bytes read but not yet decoded exceed max,
+// so the decoder buffer can not grow past about twice max
+type boundedReader struct {
+	r      io.Reader
+	read   int64
+	max    int64
+	offset func() int64
+}
+
+func (b *boundedReader) Read(p []byte) (int, error) {
+	if b.read-b.offset() > b.max {
+		return 0, fmt.Errorf("message larger than %d bytes : %w", b.max, ErrMessageTooLarge)
+	}
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// MessageIterator yields the messages of a channel one at a time, decoding
+// the server response as it is read instead of loading it whole.
+//
+// The memory used by a message is bounded by the maximum decompressed size
+// of the client. The iterator must be closed once done.
+//
+// Example of usage :
+//
+//	it, err := client.MessageIterator(ctx, spv.MessagesRequest{ChannelID: channelid}, spv.MessageFilter{
+//		FromSequence: 1000,
+//		Limit:        100,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		msg := it.Message()
+//		...
+//	}
+//	return it.Err()
+type MessageIterator struct {
+	ctx     context.Context
+	client  *Client
+	filter  MessageFilter
+	body    io.ReadCloser
+	dec     *json.Decoder
+	msg     MessageWriteReply
+	err     error
+	yielded int
+	done    bool
+}
+
+// MessageIterator get messages list as an iterator, yielding the messages passing the filter.
+//
+// The request should use bearer token authentification method.
+// The token is provided by the TokenCreate endpoint
+func (c *Client) MessageIterator(ctx context.Context, r MessagesRequest, f MessageFilter) (*MessageIterator, error) {
+	req, err := c.newMessagesRequest(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	it := &MessageIterator{
+		ctx:    ctx,
+		client: c,
+		filter: f,
+		body:   res.Body,
+	}
+	reader := &boundedReader{
+		r:   res.Body,
+		max: int64(base64.StdEncoding.EncodedLen(c.cfg.maxDecompressedSize)) + iteratorMessageOverhead,
+	}
+	it.dec = json.NewDecoder(reader)
+	reader.offset = it.dec.InputOffset
+
+	if err := it.expectDelim('['); err != nil {
+		_ = it.Close()
+		if errors.Is(err, io.EOF) {
+			return it, nil
+		}
+		return nil, err
+	}
+	return it, nil
+}
+
+// expectDelim read the next JSON token, which must be d
+func (it *MessageIterator) expectDelim(d json.Delim) error {
+	tok, err := it.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != d {
+		return fmt.Errorf("unexpected token %v in messages list", tok)
+	}
+	return nil
+}
+
+// Next decodes the next message passing the filter. It returns false at the
+// end of the list, when the limit is reached or on error
+func (it *MessageIterator) Next() bool {
+	for !it.done {
+		if err := it.ctx.Err(); err != nil {
+			return it.fail(err)
+		}
+		if it.filter.Limit > 0 && it.yielded >= it.filter.Limit {
+			return it.fail(nil)
+		}
+		if !it.dec.More() {
+			return it.fail(it.expectDelim(']'))
+		}
+
+		var msg MessageWriteReply
+		if err := it.dec.Decode(&msg); err != nil {
+			return it.fail(err)
+		}
+
+		ok, err := it.filter.match(msg)
+		if err != nil {
+			return it.fail(err)
+		}
+		if !ok {
+			continue
+		}
+
+		it.msg = it.client.decompressOrKeep(msg)
+		it.yielded++
+		return true
+	}
+	return false
+}
+
+// fail ends the iteration with err, if any
+func (it *MessageIterator) fail(err error) bool {
+	if err != nil && it.err == nil {
+		it.err = err
+	}
+	_ = it.Close()
+	return false
+}
+
+// Message return the current message
+func (it *MessageIterator) Message() MessageWriteReply {
+	return it.msg
+}
+
+// Err return the error which ended the iteration, if any
+func (it *MessageIterator) Err() error {
+	return it.err
+}
+
+// Close releases the response. It is safe to call it several times
+func (it *MessageIterator) Close() error {
+	if it.done {
+		return nil
+	}
+	it.done = true
+	return it.body.Close()
+}
@@ -0,0 +1,102 @@
+package spvchannels
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitMessageIterator(t *testing.T) {
+	s := newMockServer()
+	for i := 0; i < 10; i++ {
+		s.add("channel", "text/plain", []byte("m"))
+	}
+	s.mu.Lock()
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, m := range s.channels["channel"] {
+		m.Received = base.Add(time.Duration(i) * time.Hour).Format(time.RFC3339Nano)
+	}
+	s.mu.Unlock()
+
+	tests := map[string]struct {
+		filter  MessageFilter
+		expSeqs []int64
+	}{
+		"All": {
+			expSeqs: []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		},
+		"From sequence and limit": {
+			filter:  MessageFilter{FromSequence: 4, Limit: 3},
+			expSeqs: []int64{4, 5, 6},
+		},
+		"Received time": {
+			filter:  MessageFilter{Since: base.Add(2 * time.Hour), Until: base.Add(5 * time.Hour)},
+			expSeqs: []int64{3, 4, 5},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			it, err := newMockClient(s).MessageIterator(context.Background(), MessagesRequest{ChannelID: "channel"}, test.filter)
+			assert.NoError(t, err)
+			defer func() {
+				_ = it.Close()
+			}()
+
+			seqs := []int64{}
+			for it.Next() {
+				seqs = append(seqs, it.Message().Sequence)
+			}
+			assert.NoError(t, it.Err())
+			assert.Equal(t, test.expSeqs, seqs)
+		})
+	}
+}
+
+func TestUnitMessageIteratorEmpty(t *testing.T) {
+	it, err := newMockClient(newMockServer()).MessageIterator(context.Background(), MessagesRequest{ChannelID: "channel"}, MessageFilter{})
+	assert.NoError(t, err)
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Err())
+}
+
+func TestUnitMessageIteratorErrors(t *testing.T) {
+	s := newMockServer()
+	s.add("channel", "text/plain", []byte("small"))
+	s.add("channel", "text/plain", []byte("small"))
+	s.add("channel", "text/plain", []byte(strings.Repeat("x", 20000)))
+
+	t.Run("Server error", func(t *testing.T) {
+		s.failNext(http.MethodGet, 1)
+		_, err := newMockClient(s).MessageIterator(context.Background(), MessagesRequest{ChannelID: "channel"}, MessageFilter{})
+		assert.EqualError(t, err, "mock failure")
+	})
+
+	t.Run("Cancelled mid-stream", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		it, err := newMockClient(s).MessageIterator(ctx, MessagesRequest{ChannelID: "channel"}, MessageFilter{})
+		assert.NoError(t, err)
+		assert.True(t, it.Next())
+		cancel()
+		assert.False(t, it.Next())
+		assert.ErrorIs(t, it.Err(), context.Canceled)
+	})
+
+	t.Run("Message too large", func(t *testing.T) {
+		client := NewClient(WithBaseURL("somedomain"), WithMaxDecompressedSize(1024))
+		client.HTTPClient = s
+		it, err := client.MessageIterator(context.Background(), MessagesRequest{ChannelID: "channel"}, MessageFilter{})
+		assert.NoError(t, err)
+		n := 0
+		for it.Next() {
+			n++
+		}
+		assert.Equal(t, 2, n)
+		assert.ErrorIs(t, it.Err(), ErrMessageTooLarge)
+	})
+}
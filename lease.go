@@ -0,0 +1,265 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrLeaseExpired is returned when acknowledging or extending a message whose
+// lease expired or was released
+var ErrLeaseExpired = errors.New("message lease expired")
+
+// leaseKey identify a message in the coordinator
+type leaseKey struct {
+	channelID string
+	sequence  int64
+}
+
+// lease is held on a message until its deadline. An acked lease is a
+// tombstone hiding an acknowledged message from the workers which listed it
+// as unread before it was marked
+type lease struct {
+	token    uint64
+	deadline time.Time
+	acked    bool
+}
+
+// LeaseCoordinator is shared by the workers of a process to hide from each
+// other the messages they received, until they are acknowledged or their
+// visibility timeout expires. It is safe for concurrent use
+type LeaseCoordinator struct {
+	mu     sync.Mutex
+	leases map[leaseKey]lease
+	next   uint64
+}
+
+// NewLeaseCoordinator create an empty lease coordinator
+func NewLeaseCoordinator() *LeaseCoordinator {
+	return &LeaseCoordinator{
+		leases: map[leaseKey]lease{},
+	}
+}
+
+// acquire lease the message for d, it return false if it is already leased
+func (l *LeaseCoordinator) acquire(key leaseKey, d time.Duration) (lease, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if cur, ok := l.leases[key]; ok && now.Before(cur.deadline) {
+		return lease{}, false
+	}
+	l.next++
+	res := lease{token: l.next, deadline: now.Add(d)}
+	l.leases[key] = res
+	return res, true
+}
+
+// extend move the deadline of a held lease to d from now
+func (l *LeaseCoordinator) extend(key leaseKey, token uint64, d time.Duration) (time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cur, ok := l.leases[key]
+	if !ok || cur.acked || cur.token != token || !time.Now().Before(cur.deadline) {
+		return time.Time{}, ErrLeaseExpired
+	}
+	cur.deadline = time.Now().Add(d)
+	l.leases[key] = cur
+	return cur.deadline, nil
+}
+
+// ack replace a held lease with a tombstone kept for d, so a worker which
+// listed the message before it was marked as read can not acquire it
+func (l *LeaseCoordinator) ack(key leaseKey, token uint64, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cur, ok := l.leases[key]
+	if ok && !cur.acked && cur.token == token {
+		l.leases[key] = lease{deadline: time.Now().Add(d), acked: true}
+	}
+}
+
+// release drop a lease if it is still held
+func (l *LeaseCoordinator) release(key leaseKey, token uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cur, ok := l.leases[key]
+	if ok && !cur.acked && cur.token == token {
+		delete(l.leases, key)
+	}
+}
+
+// purge drop the expired leases and tombstones
+func (l *LeaseCoordinator) purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key, cur := range l.leases {
+		if !now.Before(cur.deadline) {
+			delete(l.leases, key)
+		}
+	}
+}
+
+// Leased tells if a message of a channel is currently leased
+func (l *LeaseCoordinator) Leased(channelID string, sequence int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cur, ok := l.leases[leaseKey{channelID: channelID, sequence: sequence}]
+	return ok && !cur.acked && time.Now().Before(cur.deadline)
+}
+
+// queueConfig hold configuration of a work queue
+type queueConfig struct {
+	visibility time.Duration
+	maxReceive int
+}
+
+// QueueConfigFunc set the work queue configuration
+type QueueConfigFunc func(c *queueConfig)
+
+// WithVisibilityTimeout set how long a received message stays hidden from
+// the other workers. Default is 30 seconds
+func WithVisibilityTimeout(d time.Duration) QueueConfigFunc {
+	return func(c *queueConfig) {
+		c.visibility = d
+	}
+}
+
+// WithMaxReceive set the maximum number of messages returned by Receive, 0 for no limit. Default is 10
+func WithMaxReceive(n int) QueueConfigFunc {
+	return func(c *queueConfig) {
+		c.maxReceive = n
+	}
+}
+
+// LeasedMessage is a message received from a WorkQueue. It must be
+// acknowledged once processed, or released with Nack
+type LeasedMessage struct {
+	MessageWriteReply
+	ChannelID string
+	Deadline  time.Time
+
+	queue *WorkQueue
+	token uint64
+}
+
+func (m *LeasedMessage) key() leaseKey {
+	return leaseKey{channelID: m.ChannelID, sequence: m.Sequence}
+}
+
+// Ack marks the message as read and ends its lease. The message stays
+// hidden for the visibility timeout, from the workers which listed it as
+// unread before it was marked. It fails with ErrLeaseExpired if the lease is
+// not held anymore, the message may then have been received by another worker
+func (m *LeasedMessage) Ack(ctx context.Context) error {
+	if _, err := m.queue.coord.extend(m.key(), m.token, m.queue.cfg.visibility); err != nil {
+		return err
+	}
+	if err := m.queue.client.MessageMark(ctx, MessageMarkRequest{
+		ChannelID: m.ChannelID,
+		Sequence:  m.Sequence,
+		Read:      true,
+	}); err != nil {
+		return err
+	}
+	m.queue.coord.ack(m.key(), m.token, m.queue.cfg.visibility)
+	return nil
+}
+
+// Nack releases the lease, the message is visible again to the other workers
+func (m *LeasedMessage) Nack() {
+	m.queue.coord.release(m.key(), m.token)
+}
+
+// Extend hide the message for d from now
+func (m *LeasedMessage) Extend(d time.Duration) error {
+	deadline, err := m.queue.coord.extend(m.key(), m.token, d)
+	if err != nil {
+		return err
+	}
+	m.Deadline = deadline
+	return nil
+}
+
+// WorkQueue distributes the unread messages of a channel between workers
+// sharing a LeaseCoordinator.
+//
+// A received message is hidden from the other workers for the visibility
+// timeout. Ack marks it as read, Nack or the expiry of the timeout makes it
+// visible again.
+//
+// Example of usage :
+//
+//	coord := spv.NewLeaseCoordinator()
+//	queue := spv.NewWorkQueue(client, channelid, coord, spv.WithVisibilityTimeout(time.Minute))
+//	msgs, err := queue.Receive(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	for _, msg := range msgs {
+//		if err := process(msg); err != nil {
+//			msg.Nack()
+//			continue
+//		}
+//		_ = msg.Ack(ctx)
+//	}
+type WorkQueue struct {
+	client    *Client
+	channelID string
+	coord     *LeaseCoordinator
+	cfg       *queueConfig
+}
+
+// NewWorkQueue create a work queue on the channel channelID
+func NewWorkQueue(client *Client, channelID string, coord *LeaseCoordinator, opts ...QueueConfigFunc) *WorkQueue {
+	cfg := &queueConfig{
+		visibility: 30 * time.Second,
+		maxReceive: 10,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return &WorkQueue{
+		client:    client,
+		channelID: channelID,
+		coord:     coord,
+		cfg:       cfg,
+	}
+}
+
+// Receive leases the unread messages of the channel not leased by another worker
+func (q *WorkQueue) Receive(ctx context.Context) ([]*LeasedMessage, error) {
+	msgs, err := q.client.Messages(ctx, MessagesRequest{ChannelID: q.channelID, UnRead: true})
+	if err != nil {
+		return nil, err
+	}
+	q.coord.purge()
+
+	res := []*LeasedMessage{}
+	for _, msg := range msgs {
+		if q.cfg.maxReceive > 0 && len(res) >= q.cfg.maxReceive {
+			break
+		}
+		l, ok := q.coord.acquire(leaseKey{channelID: q.channelID, sequence: msg.Sequence}, q.cfg.visibility)
+		if !ok {
+			continue
+		}
+		res = append(res, &LeasedMessage{
+			MessageWriteReply: msg,
+			ChannelID:         q.channelID,
+			Deadline:          l.deadline,
+			queue:             q,
+			token:             l.token,
+		})
+	}
+	return res, nil
+}
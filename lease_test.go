@@ -0,0 +1,129 @@
+package spvchannels
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func leasedSequences(msgs []*LeasedMessage) []int64 {
+	res := []int64{}
+	for _, m := range msgs {
+		res = append(res, m.Sequence)
+	}
+	return res
+}
+
+func TestUnitWorkQueue(t *testing.T) {
+	s := newMockServer()
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		s.add("channel", "text/plain", []byte("m"))
+	}
+	coord := NewLeaseCoordinator()
+	w1 := NewWorkQueue(newMockClient(s), "channel", coord, WithMaxReceive(2))
+	w2 := NewWorkQueue(newMockClient(s), "channel", coord)
+
+	msgs1, err := w1.Receive(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, leasedSequences(msgs1))
+	assert.True(t, coord.Leased("channel", 1))
+
+	// Leased messages are hidden from the other worker
+	msgs2, err := w2.Receive(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{3}, leasedSequences(msgs2))
+
+	// Ack marks the message read, Nack makes it visible again
+	assert.NoError(t, msgs1[0].Ack(ctx))
+	msgs1[1].Nack()
+	assert.False(t, coord.Leased("channel", 2))
+	assert.Equal(t, []int64{1}, readSequences(s, "channel"))
+
+	msgs2, err = w2.Receive(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{2}, leasedSequences(msgs2))
+
+	// The lease is lost, the message can not be acknowledged anymore
+	assert.ErrorIs(t, msgs1[1].Ack(ctx), ErrLeaseExpired)
+	assert.ErrorIs(t, msgs1[1].Extend(time.Minute), ErrLeaseExpired)
+}
+
+func TestUnitWorkQueueVisibilityTimeout(t *testing.T) {
+	s := newMockServer()
+	ctx := context.Background()
+	s.add("channel", "text/plain", []byte("m"))
+	coord := NewLeaseCoordinator()
+	w1 := NewWorkQueue(newMockClient(s), "channel", coord, WithVisibilityTimeout(20*time.Millisecond))
+	w2 := NewWorkQueue(newMockClient(s), "channel", coord)
+
+	msgs1, err := w1.Receive(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, msgs1, 1)
+
+	// A failed mark keeps the lease
+	s.failNext(http.MethodPost, 1)
+	assert.Error(t, msgs1[0].Ack(ctx))
+	assert.True(t, coord.Leased("channel", 1))
+
+	time.Sleep(30 * time.Millisecond)
+	msgs2, err := w2.Receive(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1}, leasedSequences(msgs2))
+	assert.ErrorIs(t, msgs1[0].Ack(ctx), ErrLeaseExpired)
+
+	assert.NoError(t, msgs2[0].Extend(time.Hour))
+	assert.True(t, msgs2[0].Deadline.After(time.Now().Add(time.Minute)))
+	assert.NoError(t, msgs2[0].Ack(ctx))
+	assert.Equal(t, []int64{1}, readSequences(s, "channel"))
+
+	msgs2, err = w2.Receive(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs2)
+}
+
+// staleReadClient forwards the requests to the mock server and calls after
+// once the reply of the next GET is built, as if the reply was slow to arrive
+type staleReadClient struct {
+	s     *mockServer
+	after func()
+}
+
+func (c *staleReadClient) Do(req *http.Request) (*http.Response, error) {
+	res, err := c.s.Do(req)
+	if req.Method == http.MethodGet && c.after != nil {
+		f := c.after
+		c.after = nil
+		f()
+	}
+	return res, err
+}
+
+func TestUnitWorkQueueStaleReceive(t *testing.T) {
+	s := newMockServer()
+	ctx := context.Background()
+	s.add("channel", "text/plain", []byte("m"))
+	coord := NewLeaseCoordinator()
+	w1 := NewWorkQueue(newMockClient(s), "channel", coord)
+	stale := &staleReadClient{s: s}
+	client := NewClient(WithBaseURL("somedomain"))
+	client.HTTPClient = stale
+	w2 := NewWorkQueue(client, "channel", coord)
+
+	msgs1, err := w1.Receive(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, msgs1, 1)
+
+	// w2 lists the message as unread, then w1 acknowledges it before w2 leases it
+	stale.after = func() {
+		assert.NoError(t, msgs1[0].Ack(ctx))
+	}
+	msgs2, err := w2.Receive(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs2)
+	assert.False(t, coord.Leased("channel", 1))
+	assert.ErrorIs(t, msgs1[0].Extend(time.Minute), ErrLeaseExpired)
+}
@@ -3,12 +3,25 @@ package spvchannels
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
 )
 
+// MaxMessageContentLength is the default maximum size of a message content
+// accepted by the SPV channels server
+const MaxMessageContentLength = 65536
+
+// ErrMessageTooLarge is returned when a message content exceeds the maximum
+// message size of the client
+var ErrMessageTooLarge = errors.New("message exceeds the maximum message size")
+
 func (c *Client) getMessageBaseEndpoint() string {
 	u := url.URL{
 		Scheme: c.cfg.httpScheme(),
@@ -25,9 +38,11 @@ type MessageHeadRequest struct {
 }
 
 // MessageWriteRequest hold data for write message request
+// ContentType is optional, it defaults to application/json
 type MessageWriteRequest struct {
-	ChannelID string `json:"channelid"`
-	Message   string `json:"message"`
+	ChannelID   string `json:"channelid"`
+	Message     string `json:"message"`
+	ContentType string `json:"content_type"`
 }
 
 // MessageWriteReply hold data for write message reply
@@ -41,6 +56,11 @@ type MessageWriteReply struct {
 	Payload     string `json:"payload"`
 }
 
+// DecodePayload return the base64 decoded content of the message
+func (m MessageWriteReply) DecodePayload() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(m.Payload)
+}
+
 // MessagesRequest hold data for get messages request
 type MessagesRequest struct {
 	ChannelID string `json:"channelid"`
@@ -87,11 +107,68 @@ func (c *Client) MessageHead(ctx context.Context, r MessageHeadRequest) error {
 	return c.sendRequest(req, nil)
 }
 
+// messageHeadSequence return the max sequence of a channel, sent by the
+// server in the ETag of the HEAD message reply
+func (c *Client) messageHeadSequence(ctx context.Context, channelID string) (int64, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodHead, fmt.Sprintf("%s/channel/%s", c.getMessageBaseEndpoint(), channelID),
+		nil,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := c.doRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = res.Body.Close()
+
+	etag := strings.Trim(strings.TrimPrefix(res.Header.Get("ETag"), "W/"), `"`)
+	seq, err := strconv.ParseInt(etag, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid channel head %q : %w", etag, err)
+	}
+	return seq, nil
+}
+
+// writeSized writes v encoded in JSON to the channel with the content type
+// cty. what names the content in the ErrMessageTooLarge error
+func (c *Client) writeSized(ctx context.Context, channelID, cty string, v interface{}, what string) (*MessageWriteReply, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.MessageWrite(ctx, MessageWriteRequest{
+		ChannelID:   channelID,
+		Message:     string(data),
+		ContentType: cty,
+	})
+	if errors.Is(err, ErrMessageTooLarge) {
+		return nil, fmt.Errorf("%s : %w", what, err)
+	}
+	return reply, err
+}
+
 // MessageWrite write a message to a particular channel
 //
+// The message is compressed if the client is configured WithCompression.
+// It returns ErrMessageTooLarge without calling the server if the content
+// still exceeds the maximum message size of the client.
+//
 // The request should use bearer token authentification method.
 // The token is provided by the TokenCreate endpoint
 func (c *Client) MessageWrite(ctx context.Context, r MessageWriteRequest) (*MessageWriteReply, error) {
+	r, err := c.compressMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Message) > c.cfg.maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes : %w", len(r.Message), ErrMessageTooLarge)
+	}
+
 	req, err := http.NewRequestWithContext(
 		ctx,
 		http.MethodPost,
@@ -102,6 +179,10 @@ func (c *Client) MessageWrite(ctx context.Context, r MessageWriteRequest) (*Mess
 		return nil, err
 	}
 
+	if r.ContentType != "" {
+		req.Header.Set("Content-Type", r.ContentType)
+	}
+
 	res := MessageWriteReply{}
 	if err := c.sendRequest(req, &res); err != nil {
 		return nil, err
@@ -112,9 +193,32 @@ func (c *Client) MessageWrite(ctx context.Context, r MessageWriteRequest) (*Mess
 
 // Messages get messages list. It can query read/unread messages.
 //
+// Compressed messages are decompressed and their content type restored. A
+// message which can not be decompressed is returned as is, see
+// WithDecompressErrorHandler.
+//
 // The request should use bearer token authentification method.
 // The token is provided by the TokenCreate endpoint
 func (c *Client) Messages(ctx context.Context, r MessagesRequest) (MessagesReply, error) {
+	req, err := c.newMessagesRequest(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	res := MessagesReply{}
+	if err := c.sendRequest(req, &res); err != nil {
+		return nil, err
+	}
+
+	for i, msg := range res {
+		res[i] = c.decompressOrKeep(msg)
+	}
+
+	return res, nil
+}
+
+// newMessagesRequest build the http request of the messages list
+func (c *Client) newMessagesRequest(ctx context.Context, r MessagesRequest) (*http.Request, error) {
 	req, err := http.NewRequestWithContext(
 		ctx,
 		http.MethodGet,
@@ -129,13 +233,7 @@ func (c *Client) Messages(ctx context.Context, r MessagesRequest) (MessagesReply
 	q := req.URL.Query()
 	q.Add("unread", fmt.Sprintf("%t", r.UnRead))
 	req.URL.RawQuery = q.Encode()
-
-	res := MessagesReply{}
-	if err := c.sendRequest(req, &res); err != nil {
-		return nil, err
-	}
-
-	return res, nil
+	return req, nil
 }
 
 // MessageMark mark a message
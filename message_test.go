@@ -257,3 +257,13 @@ func TestUnitMessageDelete(t *testing.T) {
 		})
 	}
 }
+
+func TestUnitMessageWriteTooLarge(t *testing.T) {
+	s := newMockServer()
+	client := NewClient(WithBaseURL("somedomain"), WithMaxMessageSize(8))
+	client.HTTPClient = s
+
+	_, err := client.MessageWrite(context.Background(), MessageWriteRequest{ChannelID: "channel", Message: "123456789"})
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+	assert.Empty(t, s.requests)
+}
@@ -0,0 +1,203 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// HandlerMiddleware wraps a NotificationHandlerFunc to add a behaviour
+// around it, such as recovery, logging, timeout or retry
+type HandlerMiddleware func(next NotificationHandlerFunc) NotificationHandlerFunc
+
+// Chain wraps the handler h with the middlewares m.
+//
+// The first middleware is the outermost one, i.e
+//
+//	Chain(h, Recovery(), Logging(l), Timeout(time.Second))
+//
+// executes Recovery, then Logging, then Timeout then h.
+func Chain(h NotificationHandlerFunc, m ...HandlerMiddleware) NotificationHandlerFunc {
+	for i := len(m) - 1; i >= 0; i-- {
+		h = m[i](h)
+	}
+	return h
+}
+
+// ErrHandlerPanic is returned when a notification handler panics.
+// It holds the recovered value and the stack trace of the panic
+type ErrHandlerPanic struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Error implements the error interface
+func (e ErrHandlerPanic) Error() string {
+	return fmt.Sprintf("notification handler panic: %v\n%s", e.Value, e.Stack)
+}
+
+// Recovery recovers a panicking handler and returns an ErrHandlerPanic,
+// which is then given to the ErrorHandlerFunc of the websocket client.
+// The websocket client keeps running.
+func Recovery() HandlerMiddleware {
+	return func(next NotificationHandlerFunc) NotificationHandlerFunc {
+		return func(ctx context.Context, t int, msg []byte, err error) (res error) {
+			defer func() {
+				if r := recover(); r != nil {
+					res = ErrHandlerPanic{
+						Value: r,
+						Stack: debug.Stack(),
+					}
+				}
+			}()
+			return next(ctx, t, msg, err)
+		}
+	}
+}
+
+// HandlerLogEntry hold the fields logged for each handled notification
+type HandlerLogEntry struct {
+	MessageType int
+	Message     string
+	Start       time.Time
+	Duration    time.Duration
+	Err         error
+}
+
+// HandlerLogFunc is a callback writing a HandlerLogEntry to a logger
+type HandlerLogFunc func(ctx context.Context, e HandlerLogEntry)
+
+// Logging calls l with a HandlerLogEntry after each handled notification
+func Logging(l HandlerLogFunc) HandlerMiddleware {
+	return func(next NotificationHandlerFunc) NotificationHandlerFunc {
+		return func(ctx context.Context, t int, msg []byte, err error) error {
+			start := time.Now()
+			res := next(ctx, t, msg, err)
+			l(ctx, HandlerLogEntry{
+				MessageType: t,
+				Message:     string(msg),
+				Start:       start,
+				Duration:    time.Since(start),
+				Err:         res,
+			})
+			return res
+		}
+	}
+}
+
+// Timeout bounds the context given to the handler with the duration d
+func Timeout(d time.Duration) HandlerMiddleware {
+	return func(next NotificationHandlerFunc) NotificationHandlerFunc {
+		return func(ctx context.Context, t int, msg []byte, err error) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			return next(ctx, t, msg, err)
+		}
+	}
+}
+
+// Retry calls the handler again when it returns an error, up to attempts
+// calls in total. The delay between 2 calls starts at backoff and doubles
+// after each attempt.
+//
+// Notification errors, ErrWSClose and a done context are not retried
+func Retry(attempts int, backoff time.Duration) HandlerMiddleware {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return func(next NotificationHandlerFunc) NotificationHandlerFunc {
+		return func(ctx context.Context, t int, msg []byte, err error) error {
+			if err != nil {
+				return next(ctx, t, msg, err)
+			}
+
+			delay := backoff
+			var res error
+			for i := 0; i < attempts; i++ {
+				if i > 0 {
+					select {
+					case <-ctx.Done():
+						return res
+					case <-time.After(delay):
+					}
+					delay *= 2
+				}
+
+				res = next(ctx, t, msg, nil)
+				if res == nil || errors.Is(res, ErrWSClose{}) {
+					return res
+				}
+			}
+			return res
+		}
+	}
+}
+
+// HandlerMetrics receive the measures of the handled notifications
+type HandlerMetrics interface {
+	// HandlerStarted is called before the handler
+	HandlerStarted()
+	// HandlerFinished is called after the handler with its duration and result
+	HandlerFinished(d time.Duration, err error)
+}
+
+// Metrics reports the handler calls to m
+func Metrics(m HandlerMetrics) HandlerMiddleware {
+	return func(next NotificationHandlerFunc) NotificationHandlerFunc {
+		return func(ctx context.Context, t int, msg []byte, err error) error {
+			m.HandlerStarted()
+			start := time.Now()
+			res := next(ctx, t, msg, err)
+			m.HandlerFinished(time.Since(start), res)
+			return res
+		}
+	}
+}
+
+// HandlerStats is a HandlerMetrics counting the handler calls.
+// It is safe for concurrent use
+type HandlerStats struct {
+	inFlight  int64
+	succeeded uint64
+	failed    uint64
+	totalTime int64
+}
+
+// HandlerStarted implements HandlerMetrics
+func (s *HandlerStats) HandlerStarted() {
+	atomic.AddInt64(&s.inFlight, 1)
+}
+
+// HandlerFinished implements HandlerMetrics
+func (s *HandlerStats) HandlerFinished(d time.Duration, err error) {
+	atomic.AddInt64(&s.inFlight, -1)
+	atomic.AddInt64(&s.totalTime, int64(d))
+	if err != nil {
+		atomic.AddUint64(&s.failed, 1)
+		return
+	}
+	atomic.AddUint64(&s.succeeded, 1)
+}
+
+// InFlight return the number of running handlers
+func (s *HandlerStats) InFlight() int64 {
+	return atomic.LoadInt64(&s.inFlight)
+}
+
+// Succeeded return the number of handler calls returning no error
+func (s *HandlerStats) Succeeded() uint64 {
+	return atomic.LoadUint64(&s.succeeded)
+}
+
+// Failed return the number of handler calls returning an error
+func (s *HandlerStats) Failed() uint64 {
+	return atomic.LoadUint64(&s.failed)
+}
+
+// TotalTime return the time spent in the handler
+func (s *HandlerStats) TotalTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.totalTime))
+}
@@ -0,0 +1,116 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitChain(t *testing.T) {
+	var calls []string
+	mw := func(name string) HandlerMiddleware {
+		return func(next NotificationHandlerFunc) NotificationHandlerFunc {
+			return func(ctx context.Context, t int, msg []byte, err error) error {
+				calls = append(calls, name)
+				return next(ctx, t, msg, err)
+			}
+		}
+	}
+
+	h := Chain(func(ctx context.Context, t int, msg []byte, err error) error {
+		calls = append(calls, "handler")
+		return nil
+	}, mw("first"), mw("second"))
+
+	assert.NoError(t, h(context.Background(), 1, nil, nil))
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+}
+
+func TestUnitRecovery(t *testing.T) {
+	h := Chain(func(ctx context.Context, t int, msg []byte, err error) error {
+		panic("boom")
+	}, Recovery())
+
+	err := h(context.Background(), 1, nil, nil)
+	var panicErr ErrHandlerPanic
+	assert.True(t, errors.As(err, &panicErr))
+	assert.Equal(t, "boom", panicErr.Value)
+	assert.NotEmpty(t, panicErr.Stack)
+}
+
+func TestUnitRetry(t *testing.T) {
+	tests := map[string]struct {
+		failures int
+		attempts int
+		notifErr error
+		calls    int
+		err      error
+	}{
+		"Succeed after retries": {
+			failures: 2,
+			attempts: 3,
+			calls:    3,
+		},
+		"Give up after attempts": {
+			failures: 5,
+			attempts: 3,
+			calls:    3,
+			err:      errors.New("handler failed"),
+		},
+		"Notification error is not retried": {
+			failures: 5,
+			attempts: 3,
+			notifErr: errors.New("read error"),
+			calls:    1,
+			err:      errors.New("handler failed"),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			h := Chain(func(ctx context.Context, _ int, msg []byte, err error) error {
+				calls++
+				if calls <= test.failures {
+					return errors.New("handler failed")
+				}
+				return nil
+			}, Retry(test.attempts, time.Millisecond))
+
+			err := h(context.Background(), 1, nil, test.notifErr)
+			assert.Equal(t, test.calls, calls)
+			if test.err != nil {
+				assert.EqualError(t, err, test.err.Error())
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestUnitLoggingTimeoutMetrics(t *testing.T) {
+	var entry HandlerLogEntry
+	stats := &HandlerStats{}
+
+	h := Chain(func(ctx context.Context, _ int, msg []byte, err error) error {
+		_, ok := ctx.Deadline()
+		assert.True(t, ok)
+		return errors.New("handler failed")
+	},
+		Metrics(stats),
+		Logging(func(ctx context.Context, e HandlerLogEntry) {
+			entry = e
+		}),
+		Timeout(time.Second),
+	)
+
+	assert.Error(t, h(context.Background(), 1, []byte("notification"), nil))
+	assert.Equal(t, "notification", entry.Message)
+	assert.EqualError(t, entry.Err, "handler failed")
+	assert.Equal(t, uint64(1), stats.Failed())
+	assert.Equal(t, uint64(0), stats.Succeeded())
+	assert.Equal(t, int64(0), stats.InFlight())
+}
@@ -0,0 +1,241 @@
+package spvchannels
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mockMessage is a message stored by the mockServer
+type mockMessage struct {
+	MessageWriteReply
+	read   bool
+	author string
+}
+
+// mockServer is an in memory SPV channels server used as HTTPClient
+type mockServer struct {
+	mu       sync.Mutex
+	channels map[string][]*mockMessage
+	heads    map[string]int64
+	tokens   map[string][]TokenReply
+	requests []string
+	auth     []string
+	failures map[string]int
+	// sequenced channels reject writes while other writers messages are unread
+	sequenced map[string]bool
+	// missing channels reject writes with 404 Not Found
+	missing map[string]bool
+}
+
+func newMockServer() *mockServer {
+	return &mockServer{
+		channels:  make(map[string][]*mockMessage),
+		heads:     make(map[string]int64),
+		tokens:    make(map[string][]TokenReply),
+		failures:  make(map[string]int),
+		sequenced: make(map[string]bool),
+		missing:   make(map[string]bool),
+	}
+}
+
+// newMockClient return a client sending its requests to s
+func newMockClient(s *mockServer) *Client {
+	client := NewClient(WithBaseURL("somedomain"))
+	client.HTTPClient = s
+	return client
+}
+
+// add append a message to a channel and return its sequence
+func (s *mockServer) add(channelID, contentType string, payload []byte) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addLocked(channelID, contentType, payload)
+}
+
+func (s *mockServer) addLocked(channelID, contentType string, payload []byte) int64 {
+	s.heads[channelID]++
+	seq := s.heads[channelID]
+	s.channels[channelID] = append(s.channels[channelID], &mockMessage{
+		MessageWriteReply: MessageWriteReply{
+			Sequence:    seq,
+			Received:    time.Now().UTC().Format(time.RFC3339Nano),
+			ContentType: contentType,
+			Payload:     base64.StdEncoding.EncodeToString(payload),
+		},
+	})
+	return seq
+}
+
+// messages return a copy of the messages of a channel
+func (s *mockServer) messages(channelID string) []mockMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := []mockMessage{}
+	for _, m := range s.channels[channelID] {
+		res = append(res, *m)
+	}
+	return res
+}
+
+// failNext make the next n requests with the given method fail
+func (s *mockServer) failNext(method string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method] = n
+}
+
+// Do implements HTTPClient
+func (s *mockServer) Do(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, req.Method+" "+req.URL.Path)
+	s.auth = append(s.auth, req.Header.Get("Authorization"))
+
+	if s.failures[req.Method] > 0 {
+		s.failures[req.Method]--
+		return s.reply(http.StatusInternalServerError, errorResponse{
+			Code:    http.StatusInternalServerError,
+			Message: "mock failure",
+		})
+	}
+
+	if strings.Contains(req.URL.Path, "/api-token") {
+		return s.doToken(req)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v1/channel/"), "/")
+	channelID := parts[0]
+	var seq int64
+	if len(parts) > 1 {
+		seq, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+
+	switch {
+	case req.Method == http.MethodHead:
+		res, err := s.reply(http.StatusOK, nil)
+		res.Header = http.Header{}
+		res.Header.Set("ETag", strconv.FormatInt(s.heads[channelID], 10))
+		return res, err
+
+	case req.Method == http.MethodGet:
+		unread := req.URL.Query().Get("unread") == "true"
+		res := MessagesReply{}
+		for _, m := range s.channels[channelID] {
+			if !unread || !m.read {
+				res = append(res, m.MessageWriteReply)
+			}
+		}
+		return s.reply(http.StatusOK, res)
+
+	case req.Method == http.MethodPost && len(parts) == 1:
+		if s.missing[channelID] {
+			return s.reply(http.StatusNotFound, errorResponse{
+				Code:    http.StatusNotFound,
+				Message: "channel not found",
+			})
+		}
+		author := req.Header.Get("Authorization")
+		if s.sequenced[channelID] {
+			for _, m := range s.channels[channelID] {
+				if !m.read && m.author != author {
+					return s.reply(http.StatusConflict, errorResponse{
+						Code:    http.StatusConflict,
+						Message: "Conflict",
+					})
+				}
+			}
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		s.addLocked(channelID, req.Header.Get("Content-Type"), body)
+		msgs := s.channels[channelID]
+		msgs[len(msgs)-1].author = author
+		return s.reply(http.StatusOK, msgs[len(msgs)-1].MessageWriteReply)
+
+	case req.Method == http.MethodPost:
+		var mark struct {
+			Read bool `json:"read"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&mark)
+		older := req.URL.Query().Get("older") == "true"
+		for _, m := range s.channels[channelID] {
+			if m.Sequence == seq || (older && m.Sequence < seq) {
+				m.read = mark.Read
+			}
+		}
+		return s.reply(http.StatusOK, nil)
+
+	case req.Method == http.MethodDelete:
+		msgs := s.channels[channelID]
+		for i, m := range msgs {
+			if m.Sequence == seq {
+				s.channels[channelID] = append(msgs[:i:i], msgs[i+1:]...)
+				return s.reply(http.StatusNoContent, nil)
+			}
+		}
+		return s.reply(http.StatusNotFound, errorResponse{
+			Code:    http.StatusNotFound,
+			Message: "message not found",
+		})
+	}
+
+	return s.reply(http.StatusOK, nil)
+}
+
+// doToken handles the token endpoints
+func (s *mockServer) doToken(req *http.Request) (*http.Response, error) {
+	parts := strings.Split(req.URL.Path, "/")
+	// /api/v1/account/{account}/channel/{channel}/api-token[/{token}]
+	channelID := parts[6]
+
+	switch req.Method {
+	case http.MethodGet:
+		tokens := TokensReply(s.tokens[channelID])
+		if tokens == nil {
+			tokens = TokensReply{}
+		}
+		return s.reply(http.StatusOK, tokens)
+
+	case http.MethodPost:
+		var r TokenCreateRequest
+		_ = json.NewDecoder(req.Body).Decode(&r)
+		t := TokenReply{
+			ID:          strconv.Itoa(len(s.tokens[channelID]) + 1),
+			Token:       "token-" + channelID + "-" + strconv.Itoa(len(s.tokens[channelID])+1),
+			Description: r.Description,
+			CanRead:     r.CanRead,
+			CanWrite:    r.CanWrite,
+		}
+		s.tokens[channelID] = append(s.tokens[channelID], t)
+		return s.reply(http.StatusOK, TokenCreateReply(t))
+
+	case http.MethodDelete:
+		tokens := s.tokens[channelID]
+		for i, t := range tokens {
+			if t.ID == parts[8] {
+				s.tokens[channelID] = append(tokens[:i:i], tokens[i+1:]...)
+			}
+		}
+		return s.reply(http.StatusNoContent, nil)
+	}
+
+	return s.reply(http.StatusOK, nil)
+}
+
+func (s *mockServer) reply(code int, body interface{}) (*http.Response, error) {
+	data := []byte{}
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	return &http.Response{
+		StatusCode: code,
+		Body:       ioutil.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
@@ -0,0 +1,530 @@
+package spvchannels
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrOutboxEntryNotFound is returned when purging an unknown or delivered outbox entry
+var ErrOutboxEntryNotFound = errors.New("outbox entry not found")
+
+// OutboxStatus is the delivery status of an outbox entry
+type OutboxStatus int
+
+const (
+	// OutboxPending the message waits for delivery
+	OutboxPending OutboxStatus = iota
+	// OutboxDelivered the message was written to its channel
+	OutboxDelivered
+	// OutboxPurged the message was removed before delivery
+	OutboxPurged
+)
+
+func (s OutboxStatus) String() string {
+	switch s {
+	case OutboxPending:
+		return "pending"
+	case OutboxDelivered:
+		return "delivered"
+	case OutboxPurged:
+		return "purged"
+	}
+	return fmt.Sprintf("OutboxStatus(%d)", int(s))
+}
+
+// OutboxEntry is a message accepted by the outbox
+type OutboxEntry struct {
+	ID          uint64
+	ChannelID   string
+	ContentType string
+	Message     []byte
+	CreatedAt   time.Time
+	Status      OutboxStatus
+	// Attempts is the number of failed delivery attempts
+	Attempts  int
+	LastError string
+	// Sequence is the channel sequence of the delivered message
+	Sequence int64
+}
+
+// outboxRecord is a line of the outbox write-ahead log
+type outboxRecord struct {
+	Op          string    `json:"op"`
+	ID          uint64    `json:"id"`
+	ChannelID   string    `json:"channel_id,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Message     []byte    `json:"message,omitempty"`
+	CreatedAt   time.Time `json:"created_at,omitempty"`
+	Sequence    int64     `json:"sequence,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// outbox write-ahead log operations
+const (
+	outboxOpNext      = "next"
+	outboxOpAdd       = "add"
+	outboxOpFail      = "fail"
+	outboxOpDelivered = "delivered"
+	outboxOpPurge     = "purge"
+)
+
+// outboxConfig hold configuration of an outbox
+type outboxConfig struct {
+	retryInterval time.Duration
+	maxBackoff    time.Duration
+	compactAfter  int
+}
+
+// OutboxConfigFunc set the outbox configuration
+type OutboxConfigFunc func(c *outboxConfig)
+
+// WithOutboxRetry set the delay before retrying a failed delivery, doubled
+// after each failure up to maxBackoff. Default is 1 second up to 1 minute
+func WithOutboxRetry(interval, maxBackoff time.Duration) OutboxConfigFunc {
+	return func(c *outboxConfig) {
+		c.retryInterval = interval
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// WithOutboxCompaction set the number of completed entries after which the
+// log is rewritten with the pending entries only. Default is 1000
+func WithOutboxCompaction(n int) OutboxConfigFunc {
+	return func(c *outboxConfig) {
+		c.compactAfter = n
+	}
+}
+
+func defaultOutboxConfig() *outboxConfig {
+	return &outboxConfig{
+		retryInterval: time.Second,
+		maxBackoff:    time.Minute,
+		compactAfter:  1000,
+	}
+}
+
+// Outbox accepts messages while the server is unreachable and delivers them
+// once it is back.
+//
+// Accepted messages are appended to a write-ahead log synced to disk, so
+// they survive a restart. Messages of a channel are delivered in the order
+// they were accepted: a failed delivery holds the following messages of its
+// channel until it succeeds or is purged, other channels are not affected.
+//
+// Delivered and purged entries are removed from the log when it is compacted,
+// their status is then no longer known. It is safe for concurrent use
+type Outbox struct {
+	mu        sync.Mutex
+	deliverMu sync.Mutex
+	cfg       *outboxConfig
+	client    *Client
+	path      string
+	f         *os.File
+	next      uint64
+	entries   map[uint64]*OutboxEntry
+	retryAt   map[string]time.Time
+	completed int
+	notify    chan struct{}
+}
+
+// NewOutbox create an outbox writing the messages with client, backed by the
+// log file at path. The pending entries of an existing log are loaded
+func NewOutbox(client *Client, path string, opts ...OutboxConfigFunc) (*Outbox, error) {
+	cfg := defaultOutboxConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	o := &Outbox{
+		cfg:     cfg,
+		client:  client,
+		path:    path,
+		next:    1,
+		entries: make(map[uint64]*OutboxEntry),
+		retryAt: make(map[string]time.Time),
+		notify:  make(chan struct{}, 1),
+	}
+
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	if err := o.compact(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// load replays the log
+func (o *Outbox) load() error {
+	data, err := ioutil.ReadFile(filepath.Clean(o.path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var r outboxRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			// The last line may be truncated by a crash during the append
+			if i == len(lines)-1 {
+				break
+			}
+			return fmt.Errorf("invalid outbox log line %d : %w", i+1, err)
+		}
+		o.apply(r)
+	}
+	return nil
+}
+
+// apply update the entries with a log record
+func (o *Outbox) apply(r outboxRecord) {
+	if r.ID >= o.next {
+		o.next = r.ID + 1
+	}
+
+	if r.Op == outboxOpAdd {
+		o.entries[r.ID] = &OutboxEntry{
+			ID:          r.ID,
+			ChannelID:   r.ChannelID,
+			ContentType: r.ContentType,
+			Message:     r.Message,
+			CreatedAt:   r.CreatedAt,
+		}
+		return
+	}
+
+	e, ok := o.entries[r.ID]
+	if !ok {
+		return
+	}
+	switch r.Op {
+	case outboxOpFail:
+		e.Attempts++
+		e.LastError = r.Error
+	case outboxOpDelivered:
+		e.Status = OutboxDelivered
+		e.Sequence = r.Sequence
+		o.completed++
+	case outboxOpPurge:
+		e.Status = OutboxPurged
+		o.completed++
+	}
+}
+
+// compact rewrites the log with the pending entries and keeps the new log
+// open for appending. The new log replaces the current one only once fully
+// written, so on failure the outbox keeps appending to the current log and
+// compaction is tried again on the next append
+func (o *Outbox) compact() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// Record the next id, so ids are not reused once the entries are compacted
+	if err := enc.Encode(outboxRecord{Op: outboxOpNext, ID: o.next - 1}); err != nil {
+		return err
+	}
+	var done []uint64
+	for _, e := range o.sorted("") {
+		if e.Status != OutboxPending {
+			done = append(done, e.ID)
+			continue
+		}
+		if err := enc.Encode(outboxRecord{
+			Op:          outboxOpAdd,
+			ID:          e.ID,
+			ChannelID:   e.ChannelID,
+			ContentType: e.ContentType,
+			Message:     e.Message,
+			CreatedAt:   e.CreatedAt,
+		}); err != nil {
+			return err
+		}
+		for i := 0; i < e.Attempts; i++ {
+			if err := enc.Encode(outboxRecord{Op: outboxOpFail, ID: e.ID, Error: e.LastError}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The handle on the temporary file remains valid once renamed
+	tmp := filepath.Clean(o.path + ".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to compact outbox : %w", err)
+	}
+	fail := func(err error) error {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to compact outbox : %w", err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		return fail(err)
+	}
+
+	if o.f != nil {
+		_ = o.f.Close()
+	}
+	o.f = f
+	for _, id := range done {
+		delete(o.entries, id)
+	}
+	o.completed = 0
+	return syncDir(o.path)
+}
+
+// append writes a record to the log and syncs it
+func (o *Outbox) append(r outboxRecord) error {
+	if o.f == nil {
+		return os.ErrClosed
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := o.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := o.f.Sync(); err != nil {
+		return err
+	}
+
+	// The record is written, a failed compaction is not an error
+	o.apply(r)
+	if o.completed >= o.cfg.compactAfter {
+		_ = o.compact()
+	}
+	return nil
+}
+
+// sorted return the entries of a channel, or all entries if channelID is empty, in id order
+func (o *Outbox) sorted(channelID string) []*OutboxEntry {
+	res := make([]*OutboxEntry, 0, len(o.entries))
+	for _, e := range o.entries {
+		if channelID == "" || e.ChannelID == channelID {
+			res = append(res, e)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+// Enqueue accepts a message for delivery and return its entry id.
+// It returns once the message is synced to the log
+func (o *Outbox) Enqueue(r MessageWriteRequest) (uint64, error) {
+	if len(r.Message) > o.client.cfg.maxMessageSize {
+		return 0, fmt.Errorf("message of %d bytes : %w", len(r.Message), ErrMessageTooLarge)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	id := o.next
+	if err := o.append(outboxRecord{
+		Op:          outboxOpAdd,
+		ID:          id,
+		ChannelID:   r.ChannelID,
+		ContentType: r.ContentType,
+		Message:     []byte(r.Message),
+		CreatedAt:   time.Now().UTC(),
+	}); err != nil {
+		return 0, fmt.Errorf("unable to write outbox log : %w", err)
+	}
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// Status return the entry of the id. It returns false if the id is unknown,
+// or its entry was delivered or purged then compacted
+func (o *Outbox) Status(id uint64) (OutboxEntry, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, ok := o.entries[id]
+	if !ok {
+		return OutboxEntry{}, false
+	}
+	return *e, true
+}
+
+// Pending return the pending entries of a channel, or of all channels if
+// channelID is empty, in delivery order
+func (o *Outbox) Pending(channelID string) []OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	res := []OutboxEntry{}
+	for _, e := range o.sorted(channelID) {
+		if e.Status == OutboxPending {
+			res = append(res, *e)
+		}
+	}
+	return res
+}
+
+// Purge removes a pending entry, so it is never delivered
+func (o *Outbox) Purge(id uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, ok := o.entries[id]
+	if !ok || e.Status != OutboxPending {
+		return ErrOutboxEntryNotFound
+	}
+	delete(o.retryAt, e.ChannelID)
+	return o.append(outboxRecord{Op: outboxOpPurge, ID: id})
+}
+
+// Deliver tries once to write the pending entries of every channel whose
+// retry delay is over. Delivery errors are recorded in the entries, it only
+// returns the errors writing the log
+func (o *Outbox) Deliver(ctx context.Context) error {
+	o.deliverMu.Lock()
+	defer o.deliverMu.Unlock()
+
+	o.mu.Lock()
+	channels := []string{}
+	seen := map[string]bool{}
+	for _, e := range o.sorted("") {
+		if e.Status == OutboxPending && !seen[e.ChannelID] {
+			seen[e.ChannelID] = true
+			channels = append(channels, e.ChannelID)
+		}
+	}
+	o.mu.Unlock()
+
+	for _, ch := range channels {
+		if err := o.deliverChannel(ctx, ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverChannel writes the pending entries of a channel in order, until one fails
+func (o *Outbox) deliverChannel(ctx context.Context, channelID string) error {
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		o.mu.Lock()
+		if time.Now().Before(o.retryAt[channelID]) {
+			o.mu.Unlock()
+			return nil
+		}
+		var next *OutboxEntry
+		for _, e := range o.sorted(channelID) {
+			if e.Status == OutboxPending {
+				next = e
+				break
+			}
+		}
+		if next == nil {
+			o.mu.Unlock()
+			return nil
+		}
+		e := *next
+		o.mu.Unlock()
+
+		reply, err := o.client.MessageWrite(ctx, MessageWriteRequest{
+			ChannelID:   e.ChannelID,
+			Message:     string(e.Message),
+			ContentType: e.ContentType,
+		})
+
+		if err != nil && ctx.Err() != nil {
+			return nil
+		}
+
+		o.mu.Lock()
+		if next.Status != OutboxPending {
+			// Purged while in flight
+			o.mu.Unlock()
+			continue
+		}
+		if err != nil {
+			backoff := o.cfg.retryInterval << uint(e.Attempts)
+			if backoff > o.cfg.maxBackoff || backoff <= 0 {
+				backoff = o.cfg.maxBackoff
+			}
+			o.retryAt[channelID] = time.Now().Add(backoff)
+			lerr := o.append(outboxRecord{Op: outboxOpFail, ID: e.ID, Error: err.Error()})
+			o.mu.Unlock()
+			return lerr
+		}
+
+		delete(o.retryAt, channelID)
+		lerr := o.append(outboxRecord{Op: outboxOpDelivered, ID: e.ID, Sequence: reply.Sequence})
+		o.mu.Unlock()
+		if lerr != nil {
+			return lerr
+		}
+	}
+}
+
+// Run delivers the entries as they are accepted and retries the failed ones,
+// until the context is done. Errors are given to errHandler if not nil.
+//
+// It returns ErrInvalidInterval if the retry interval set by WithOutboxRetry
+// is not positive
+func (o *Outbox) Run(ctx context.Context, errHandler ErrorHandlerFunc) error {
+	if o.cfg.retryInterval <= 0 {
+		return ErrInvalidInterval
+	}
+	ticker := time.NewTicker(o.cfg.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := o.Deliver(ctx); err != nil && errHandler != nil {
+			errHandler(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-o.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the log file
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.f == nil {
+		return nil
+	}
+	err := o.f.Close()
+	o.f = nil
+	return err
+}
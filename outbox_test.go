@@ -0,0 +1,205 @@
+package spvchannels
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitOutboxDelivery(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "outbox.log")
+
+	o, err := NewOutbox(client, path, WithOutboxRetry(time.Hour, time.Hour))
+	assert.NoError(t, err)
+
+	ids := []uint64{}
+	for _, m := range []struct{ ch, msg string }{{"a", "1"}, {"a", "2"}, {"b", "3"}} {
+		id, err := o.Enqueue(MessageWriteRequest{ChannelID: m.ch, Message: m.msg, ContentType: "text/plain"})
+		assert.NoError(t, err)
+		ids = append(ids, id)
+	}
+	assert.Equal(t, []uint64{1, 2, 3}, ids)
+
+	// The first write of channel a fails: a is held, b is delivered
+	s.failNext(http.MethodPost, 1)
+	assert.NoError(t, o.Deliver(ctx))
+	assert.Len(t, s.messages("a"), 0)
+	assert.Len(t, s.messages("b"), 1)
+
+	e, ok := o.Status(ids[0])
+	assert.True(t, ok)
+	assert.Equal(t, OutboxPending, e.Status)
+	assert.Equal(t, 1, e.Attempts)
+	assert.Equal(t, "mock failure", e.LastError)
+	e, _ = o.Status(ids[2])
+	assert.Equal(t, OutboxDelivered, e.Status)
+	assert.Equal(t, int64(1), e.Sequence)
+
+	// Retry delay not over
+	assert.NoError(t, o.Deliver(ctx))
+	assert.Len(t, s.messages("a"), 0)
+	assert.Len(t, o.Pending("a"), 2)
+	assert.NoError(t, o.Close())
+
+	// Restart: pending entries and attempts are loaded, the retry delay is not
+	o, err = NewOutbox(client, path)
+	assert.NoError(t, err)
+	defer func() {
+		_ = o.Close()
+	}()
+	pending := o.Pending("")
+	assert.Len(t, pending, 2)
+	assert.Equal(t, 1, pending[0].Attempts)
+
+	assert.NoError(t, o.Deliver(ctx))
+	msgs := s.messages("a")
+	assert.Len(t, msgs, 2)
+	for i, want := range []string{"1", "2"} {
+		payload, _ := msgs[i].DecodePayload()
+		assert.Equal(t, want, string(payload))
+		assert.Equal(t, "text/plain", msgs[i].ContentType)
+	}
+	assert.Len(t, o.Pending(""), 0)
+
+	id, err := o.Enqueue(MessageWriteRequest{ChannelID: "a", Message: "4"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), id)
+}
+
+func TestUnitOutboxPurge(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	path := filepath.Join(t.TempDir(), "outbox.log")
+
+	o, err := NewOutbox(client, path)
+	assert.NoError(t, err)
+	defer func() {
+		_ = o.Close()
+	}()
+
+	id, err := o.Enqueue(MessageWriteRequest{ChannelID: "a", Message: "stuck"})
+	assert.NoError(t, err)
+	_, err = o.Enqueue(MessageWriteRequest{ChannelID: "a", Message: "next"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, o.Purge(id))
+	assert.ErrorIs(t, o.Purge(id), ErrOutboxEntryNotFound)
+	e, _ := o.Status(id)
+	assert.Equal(t, OutboxPurged, e.Status)
+
+	assert.NoError(t, o.Deliver(context.Background()))
+	msgs := s.messages("a")
+	assert.Len(t, msgs, 1)
+	payload, _ := msgs[0].DecodePayload()
+	assert.Equal(t, "next", string(payload))
+
+	_, err = o.Enqueue(MessageWriteRequest{ChannelID: "a", Message: strings.Repeat("x", MaxMessageContentLength+1)})
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+}
+
+func TestUnitOutboxCompaction(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	path := filepath.Join(t.TempDir(), "outbox.log")
+
+	o, err := NewOutbox(client, path, WithOutboxCompaction(3))
+	assert.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err := o.Enqueue(MessageWriteRequest{ChannelID: "a", Message: "m"})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, o.Deliver(context.Background()))
+	assert.NoError(t, o.Close())
+
+	// next record, 4th add, 4th delivered
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(data), "\n"))
+
+	// A truncated last line is ignored
+	assert.NoError(t, os.WriteFile(path, append(data, []byte(`{"op":"add","id":9`)...), 0o600))
+	o, err = NewOutbox(client, path)
+	assert.NoError(t, err)
+	defer func() {
+		_ = o.Close()
+	}()
+	assert.Len(t, o.Pending(""), 0)
+	id, err := o.Enqueue(MessageWriteRequest{ChannelID: "a", Message: "m"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), id)
+}
+
+func TestUnitOutboxCompactionFailure(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	path := filepath.Join(t.TempDir(), "outbox.log")
+
+	o, err := NewOutbox(client, path, WithOutboxCompaction(1))
+	assert.NoError(t, err)
+	defer func() {
+		_ = o.Close()
+	}()
+
+	// The temporary log can not be created, the outbox keeps the current log
+	assert.NoError(t, os.Mkdir(path+".tmp", 0o700))
+	_, err = o.Enqueue(MessageWriteRequest{ChannelID: "a", Message: "m"})
+	assert.NoError(t, err)
+	assert.NoError(t, o.Deliver(context.Background()))
+	_, err = o.Enqueue(MessageWriteRequest{ChannelID: "a", Message: "m"})
+	assert.NoError(t, err)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(data), "\n"))
+
+	// next record, 2nd and 3rd add
+	assert.NoError(t, os.Remove(path+".tmp"))
+	_, err = o.Enqueue(MessageWriteRequest{ChannelID: "a", Message: "m"})
+	assert.NoError(t, err)
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(data), "\n"))
+	assert.Len(t, o.Pending(""), 2)
+	assert.Len(t, s.messages("a"), 1)
+}
+
+func TestUnitOutboxRun(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := NewOutbox(client, filepath.Join(t.TempDir(), "outbox.log"), WithOutboxRetry(5*time.Millisecond, 10*time.Millisecond))
+	assert.NoError(t, err)
+	defer func() {
+		_ = o.Close()
+	}()
+	go func() {
+		_ = o.Run(ctx, nil)
+	}()
+
+	s.failNext(http.MethodPost, 2)
+	_, err = o.Enqueue(MessageWriteRequest{ChannelID: "a", Message: "m"})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return len(s.messages("a")) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestUnitOutboxRunInvalidInterval(t *testing.T) {
+	o, err := NewOutbox(newMockClient(newMockServer()), filepath.Join(t.TempDir(), "outbox.log"), WithOutboxRetry(0, time.Second))
+	assert.NoError(t, err)
+	defer func() {
+		_ = o.Close()
+	}()
+	assert.ErrorIs(t, o.Run(context.Background(), nil), ErrInvalidInterval)
+}
@@ -0,0 +1,377 @@
+package spvchannels
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultPoisonAttempts is the number of failed deliveries quarantining a
+// message when poison detection is set without a valid maximum
+const defaultPoisonAttempts = 5
+
+// errAttemptDelayed stops a pull on a failed message waiting for its next attempt
+var errAttemptDelayed = errors.New("message attempt delayed")
+
+// AttemptRecord hold the failed deliveries of a message
+type AttemptRecord struct {
+	Attempts int       `json:"attempts"`
+	Last     time.Time `json:"last"`
+	Error    string    `json:"error"`
+	// Quarantined is set once the message is dead lettered or marked as
+	// read, until the quarantine hook succeeds and the record is deleted
+	Quarantined bool `json:"quarantined,omitempty"`
+}
+
+// AttemptStore persists the failed deliveries of the messages across pulls and restarts
+type AttemptStore interface {
+	// Load return the record of a message, a zero record if none
+	Load(ctx context.Context, channelID string, seq int64) (AttemptRecord, error)
+	// Save record the failed deliveries of a message
+	Save(ctx context.Context, channelID string, seq int64, rec AttemptRecord) error
+	// Delete drop the record of a message
+	Delete(ctx context.Context, channelID string, seq int64) error
+}
+
+// attemptKey identify a message in an attempt store
+func attemptKey(channelID string, seq int64) string {
+	return fmt.Sprintf("%s/%d", channelID, seq)
+}
+
+// MemoryAttemptStore is an AttemptStore keeping the records in memory.
+// Records are lost when the process exit
+type MemoryAttemptStore struct {
+	mu      sync.Mutex
+	records map[string]AttemptRecord
+}
+
+// NewMemoryAttemptStore create an empty in memory attempt store
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{
+		records: make(map[string]AttemptRecord),
+	}
+}
+
+// Load implements AttemptStore
+func (s *MemoryAttemptStore) Load(ctx context.Context, channelID string, seq int64) (AttemptRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[attemptKey(channelID, seq)], nil
+}
+
+// Save implements AttemptStore
+func (s *MemoryAttemptStore) Save(ctx context.Context, channelID string, seq int64, rec AttemptRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[attemptKey(channelID, seq)] = rec
+	return nil
+}
+
+// Delete implements AttemptStore
+func (s *MemoryAttemptStore) Delete(ctx context.Context, channelID string, seq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, attemptKey(channelID, seq))
+	return nil
+}
+
+// FileAttemptStore is an AttemptStore keeping the records in a JSON file,
+// rewritten atomically on every change like FileCheckpointStore
+type FileAttemptStore struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]AttemptRecord
+}
+
+// NewFileAttemptStore create an attempt store backed by the file at path,
+// loading the records it already holds
+func NewFileAttemptStore(path string) (*FileAttemptStore, error) {
+	s := &FileAttemptStore{
+		path:    path,
+		records: make(map[string]AttemptRecord),
+	}
+
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.records); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load implements AttemptStore
+func (s *FileAttemptStore) Load(ctx context.Context, channelID string, seq int64) (AttemptRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[attemptKey(channelID, seq)], nil
+}
+
+// Save implements AttemptStore
+func (s *FileAttemptStore) Save(ctx context.Context, channelID string, seq int64, rec AttemptRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := attemptKey(channelID, seq)
+	prev, ok := s.records[key]
+	s.records[key] = rec
+	if err := s.flush(); err != nil {
+		if ok {
+			s.records[key] = prev
+		} else {
+			delete(s.records, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete implements AttemptStore
+func (s *FileAttemptStore) Delete(ctx context.Context, channelID string, seq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := attemptKey(channelID, seq)
+	prev, ok := s.records[key]
+	if !ok {
+		return nil
+	}
+	delete(s.records, key)
+	if err := s.flush(); err != nil {
+		s.records[key] = prev
+		return err
+	}
+	return nil
+}
+
+// flush atomically replace the file content with the records
+func (s *FileAttemptStore) flush() error {
+	data, err := json.Marshal(s.records)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(s.path, data)
+}
+
+// PoisonMetrics receive the failed deliveries and quarantines of a consumer
+type PoisonMetrics interface {
+	// AttemptFailed is called when a delivery of a message failed
+	AttemptFailed(channelID string, seq int64, attempts int)
+	// MessageQuarantined is called when a message is quarantined
+	MessageQuarantined(channelID string, seq int64)
+}
+
+// PoisonStats is a PoisonMetrics counting the failed deliveries and the
+// quarantined messages. It is safe for concurrent use
+type PoisonStats struct {
+	failed      uint64
+	quarantined uint64
+}
+
+// AttemptFailed implements PoisonMetrics
+func (s *PoisonStats) AttemptFailed(channelID string, seq int64, attempts int) {
+	atomic.AddUint64(&s.failed, 1)
+}
+
+// MessageQuarantined implements PoisonMetrics
+func (s *PoisonStats) MessageQuarantined(channelID string, seq int64) {
+	atomic.AddUint64(&s.quarantined, 1)
+}
+
+// Failed return the number of failed deliveries
+func (s *PoisonStats) Failed() uint64 {
+	return atomic.LoadUint64(&s.failed)
+}
+
+// Quarantined return the number of quarantined messages
+func (s *PoisonStats) Quarantined() uint64 {
+	return atomic.LoadUint64(&s.quarantined)
+}
+
+// QuarantineFunc is called with a message quarantined after too many failed deliveries
+type QuarantineFunc func(ctx context.Context, channelID string, msg MessageWriteReply, rec AttemptRecord) error
+
+// poisonConfig hold the poison message detection of a consumer
+type poisonConfig struct {
+	store       AttemptStore
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	quarantine  QuarantineFunc
+	metrics     PoisonMetrics
+	now         func() time.Time
+}
+
+// WithPoisonDetection record the failed deliveries of each message in store
+// and quarantine a message after maxAttempts failed deliveries.
+//
+// A delivery is a pull calling the handler for the message, up to the
+// attempts set by WithMaxAttempts. Once a delivery failed, the next pulls
+// stop before the message until the backoff set by WithPoisonBackoff is
+// elapsed. A quarantined message is written to the dead letter channel if
+// set by WithDeadLetter or marked as read otherwise, the quarantine hook is
+// called and the consumer moves on.
+//
+// A nil store keeps the records in memory, a maxAttempts below 1 is replaced
+// by 5. The other poison options enable the detection with these defaults
+// when this one is not set
+func WithPoisonDetection(store AttemptStore, maxAttempts int) ConsumerConfigFunc {
+	return func(c *consumerConfig) {
+		p := c.ensurePoison()
+		p.store = store
+		p.maxAttempts = maxAttempts
+	}
+}
+
+// WithPoisonBackoff set the delay after the first failed delivery of a
+// message, doubled after each failure up to max. Default is 1 second up to 1 minute
+func WithPoisonBackoff(backoff, max time.Duration) ConsumerConfigFunc {
+	return func(c *consumerConfig) {
+		p := c.ensurePoison()
+		p.backoff = backoff
+		p.maxBackoff = max
+	}
+}
+
+// WithQuarantineHook call f for each quarantined message, once it is dead
+// lettered or marked as read. If f fails, or the attempt record can not be
+// deleted afterwards, f is called again on the next pull. The message is not
+// handled nor dead lettered again
+func WithQuarantineHook(f QuarantineFunc) ConsumerConfigFunc {
+	return func(c *consumerConfig) {
+		c.ensurePoison().quarantine = f
+	}
+}
+
+// WithPoisonMetrics reports the failed deliveries and quarantines to m
+func WithPoisonMetrics(m PoisonMetrics) ConsumerConfigFunc {
+	return func(c *consumerConfig) {
+		c.ensurePoison().metrics = m
+	}
+}
+
+// ensurePoison return the poison configuration, creating the default one
+func (c *consumerConfig) ensurePoison() *poisonConfig {
+	if c.poison == nil {
+		c.poison = &poisonConfig{
+			maxAttempts: defaultPoisonAttempts,
+			backoff:     time.Second,
+			maxBackoff:  time.Minute,
+			now:         time.Now,
+		}
+	}
+	return c.poison
+}
+
+// delay return the wait before the next delivery after attempts failures
+func (p *poisonConfig) delay(attempts int) time.Duration {
+	d := p.backoff
+	for i := 1; i < attempts && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return d
+}
+
+// poisonPending completes the quarantine of a message quarantined by a
+// previous pull and return true, or return errAttemptDelayed if the message
+// must wait before its next delivery
+func (c *Consumer) poisonPending(ctx context.Context, msg MessageWriteReply) (bool, error) {
+	rec, err := c.cfg.poison.store.Load(ctx, c.channelID, msg.Sequence)
+	if err != nil {
+		return false, fmt.Errorf("unable to load attempts : %w", err)
+	}
+	if rec.Quarantined {
+		return true, c.poisonRelease(ctx, msg, rec)
+	}
+	if rec.Attempts > 0 && c.cfg.poison.now().Sub(rec.Last) < c.cfg.poison.delay(rec.Attempts) {
+		return false, errAttemptDelayed
+	}
+	return false, nil
+}
+
+// poisonFailed records a failed delivery and quarantine the message after
+// the max attempts. Return true if the message was quarantined
+func (c *Consumer) poisonFailed(ctx context.Context, msg MessageWriteReply, handlerErr error, attempts int) (bool, error) {
+	p := c.cfg.poison
+	rec, err := p.store.Load(ctx, c.channelID, msg.Sequence)
+	if err != nil {
+		return false, fmt.Errorf("unable to load attempts : %w", err)
+	}
+	rec.Attempts++
+	rec.Last = p.now()
+	rec.Error = handlerErr.Error()
+	if p.metrics != nil {
+		p.metrics.AttemptFailed(c.channelID, msg.Sequence, rec.Attempts)
+	}
+
+	if err := p.store.Save(ctx, c.channelID, msg.Sequence, rec); err != nil {
+		return false, fmt.Errorf("unable to save attempts : %w", err)
+	}
+	if rec.Attempts < p.maxAttempts {
+		return false, handlerErr
+	}
+
+	if c.cfg.deadLetter != nil {
+		err = c.writeDeadLetter(ctx, msg, handlerErr, rec.Attempts*attempts)
+	} else {
+		err = c.client.MessageMark(ctx, MessageMarkRequest{
+			ChannelID: c.channelID,
+			Sequence:  msg.Sequence,
+			Read:      true,
+		})
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to quarantine message : %w", err)
+	}
+
+	// Record the quarantine so the next pulls only complete it
+	rec.Quarantined = true
+	if err := p.store.Save(ctx, c.channelID, msg.Sequence, rec); err != nil {
+		return false, fmt.Errorf("unable to save attempts : %w", err)
+	}
+	if p.metrics != nil {
+		p.metrics.MessageQuarantined(c.channelID, msg.Sequence)
+	}
+	return true, c.poisonRelease(ctx, msg, rec)
+}
+
+// poisonRelease calls the quarantine hook of a quarantined message and drops
+// its record
+func (c *Consumer) poisonRelease(ctx context.Context, msg MessageWriteReply, rec AttemptRecord) error {
+	p := c.cfg.poison
+	if p.quarantine != nil {
+		if err := p.quarantine(ctx, c.channelID, msg, rec); err != nil {
+			return fmt.Errorf("quarantine hook failed : %w", err)
+		}
+	}
+	if err := p.store.Delete(ctx, c.channelID, msg.Sequence); err != nil {
+		return fmt.Errorf("unable to delete attempts : %w", err)
+	}
+	return nil
+}
+
+// poisonSucceeded drop the failed deliveries of a processed message
+func (c *Consumer) poisonSucceeded(ctx context.Context, msg MessageWriteReply) error {
+	if c.cfg.poison == nil {
+		return nil
+	}
+	if err := c.cfg.poison.store.Delete(ctx, c.channelID, msg.Sequence); err != nil {
+		return fmt.Errorf("unable to delete attempts : %w", err)
+	}
+	return nil
+}
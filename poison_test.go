@@ -0,0 +1,189 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitConsumerPoisonQuarantine(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+	s.add("channel", "text/plain", []byte("poison"))
+	s.add("channel", "text/plain", []byte("good"))
+
+	store := NewMemoryAttemptStore()
+	stats := &PoisonStats{}
+	quarantined := []AttemptRecord{}
+	seqs := []int64{}
+	consumer := NewConsumer(client, "channel", func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		if payload, _ := msg.DecodePayload(); string(payload) == "poison" {
+			return errors.New("boom")
+		}
+		seqs = append(seqs, msg.Sequence)
+		return nil
+	},
+		WithPoisonDetection(store, 3),
+		WithPoisonBackoff(10*time.Millisecond, 15*time.Millisecond),
+		WithPoisonMetrics(stats),
+		WithQuarantineHook(func(ctx context.Context, channelID string, msg MessageWriteReply, rec AttemptRecord) error {
+			quarantined = append(quarantined, rec)
+			return nil
+		}),
+	)
+	now := time.Now()
+	consumer.cfg.poison.now = func() time.Time {
+		return now
+	}
+
+	assert.EqualError(t, consumer.Pull(ctx), "boom")
+	rec, err := store.Load(ctx, "channel", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rec.Attempts)
+	assert.Equal(t, "boom", rec.Error)
+
+	// The message waits for its backoff
+	assert.NoError(t, consumer.Pull(ctx))
+	assert.Equal(t, uint64(1), stats.Failed())
+
+	now = now.Add(10 * time.Millisecond)
+	assert.EqualError(t, consumer.Pull(ctx), "boom")
+	now = now.Add(10 * time.Millisecond)
+	assert.NoError(t, consumer.Pull(ctx))
+	now = now.Add(5 * time.Millisecond)
+
+	// Third failure quarantines the message and the consumer moves on
+	assert.NoError(t, consumer.Pull(ctx))
+	assert.Equal(t, []int64{2}, seqs)
+	assert.Equal(t, uint64(3), stats.Failed())
+	assert.Equal(t, uint64(1), stats.Quarantined())
+	assert.Len(t, quarantined, 1)
+	assert.Equal(t, 3, quarantined[0].Attempts)
+	assert.Equal(t, []int64{1}, readSequences(s, "channel"))
+
+	rec, err = store.Load(ctx, "channel", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, AttemptRecord{}, rec)
+}
+
+func TestUnitConsumerPoisonDeadLetter(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+	s.add("channel", "text/plain", []byte("poison"))
+
+	consumer := NewConsumer(client, "channel", func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		return errors.New("boom")
+	}, WithPoisonDetection(NewMemoryAttemptStore(), 1), WithDeadLetter(client, "dlq"))
+
+	assert.NoError(t, consumer.Pull(ctx))
+	assert.Len(t, s.messages("dlq"), 1)
+	assert.Equal(t, DeadLetterContentType, s.messages("dlq")[0].ContentType)
+	checkpoint, err := consumer.Checkpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), checkpoint)
+}
+
+func TestUnitConsumerPoisonHookFailure(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+	s.add("channel", "text/plain", []byte("poison"))
+
+	store := NewMemoryAttemptStore()
+	handled := 0
+	hooked := 0
+	consumer := NewConsumer(client, "channel", func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		handled++
+		return errors.New("boom")
+	},
+		WithPoisonDetection(store, 1),
+		WithDeadLetter(client, "dlq"),
+		WithQuarantineHook(func(ctx context.Context, channelID string, msg MessageWriteReply, rec AttemptRecord) error {
+			if hooked++; hooked == 1 {
+				return errors.New("hook down")
+			}
+			return nil
+		}),
+	)
+
+	assert.Error(t, consumer.Pull(ctx))
+	rec, err := store.Load(ctx, "channel", 1)
+	assert.NoError(t, err)
+	assert.True(t, rec.Quarantined)
+
+	// The next pull only calls the hook again
+	assert.NoError(t, consumer.Pull(ctx))
+	assert.Equal(t, 1, handled)
+	assert.Equal(t, 2, hooked)
+	assert.Len(t, s.messages("dlq"), 1)
+	checkpoint, err := consumer.Checkpoint(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), checkpoint)
+	rec, err = store.Load(ctx, "channel", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, AttemptRecord{}, rec)
+}
+
+func TestUnitConsumerPoisonOptionsWithoutStore(t *testing.T) {
+	h := func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		return nil
+	}
+
+	// Poison options alone enable the detection with the defaults
+	c := NewConsumer(newMockClient(newMockServer()), "channel", h, WithPoisonBackoff(time.Second, time.Minute))
+	assert.IsType(t, &MemoryAttemptStore{}, c.cfg.poison.store)
+	assert.Equal(t, defaultPoisonAttempts, c.cfg.poison.maxAttempts)
+
+	c = NewConsumer(newMockClient(newMockServer()), "channel", h, WithPoisonDetection(nil, 0))
+	assert.IsType(t, &MemoryAttemptStore{}, c.cfg.poison.store)
+	assert.Equal(t, defaultPoisonAttempts, c.cfg.poison.maxAttempts)
+}
+
+func TestUnitConsumerPoisonSuccessClears(t *testing.T) {
+	s := newMockServer()
+	ctx := context.Background()
+	s.add("channel", "text/plain", []byte("m"))
+
+	store := NewMemoryAttemptStore()
+	fail := true
+	consumer := NewConsumer(newMockClient(s), "channel", func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	}, WithPoisonDetection(store, 5), WithPoisonBackoff(0, 0))
+
+	assert.Error(t, consumer.Pull(ctx))
+	fail = false
+	assert.NoError(t, consumer.Pull(ctx))
+	rec, err := store.Load(ctx, "channel", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, rec.Attempts)
+}
+
+func TestUnitFileAttemptStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attempts.json")
+	ctx := context.Background()
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	store, err := NewFileAttemptStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Save(ctx, "channel", 1, AttemptRecord{Attempts: 2, Last: now, Error: "boom"}))
+	assert.NoError(t, store.Save(ctx, "channel", 2, AttemptRecord{Attempts: 1, Last: now}))
+	assert.NoError(t, store.Delete(ctx, "channel", 2))
+
+	store, err = NewFileAttemptStore(path)
+	assert.NoError(t, err)
+	rec, err := store.Load(ctx, "channel", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, AttemptRecord{Attempts: 2, Last: now, Error: "boom"}, rec)
+	rec, err = store.Load(ctx, "channel", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, AttemptRecord{}, rec)
+}
@@ -0,0 +1,215 @@
+package spvchannels
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoRoute is returned by the MessageRouter when a message match no handler
+// and no fallback handler is set
+var ErrNoRoute = errors.New("no handler for message")
+
+// ErrInvalidInterval is returned by the polling loops when the interval is not positive
+var ErrInvalidInterval = errors.New("polling interval must be positive")
+
+// MessageHandlerFunc is a callback to process a message pulled from a channel
+//
+//	ctx       : the handling context
+//	channelID : the channel the message belong to
+//	msg       : the message
+type MessageHandlerFunc func(ctx context.Context, channelID string, msg MessageWriteReply) error
+
+// MessageMatcher tells if a message should be processed by a handler.
+// payload is the base64 decoded content of the message
+type MessageMatcher func(msg MessageWriteReply, payload []byte) bool
+
+type route struct {
+	match   MessageMatcher
+	handler MessageHandlerFunc
+}
+
+// MessageRouter dispatch messages to handlers according to their
+// content type, a JSON field of their payload or a custom predicate.
+//
+// Routes are evaluated in their registration order, the first matching route
+// handles the message. Messages matching no route are given to the fallback
+// handler, which can forward them to a dead letter channel.
+//
+// Example of usage :
+//
+//	router := spv.NewMessageRouter()
+//	router.HandleContentType("text/plain", handleControl)
+//	router.HandleField("type", "merkleproof", handleProof)
+//	router.Fallback(handleUnknown)
+//
+//	ws, err := spv.NewWSClient(
+//		spv.WithChannelID(channelid),
+//		spv.WithToken(tok),
+//		spv.WithWebsocketCallBack(router.NotificationHandler(client, channelid)),
+//	)
+type MessageRouter struct {
+	mu       sync.RWMutex
+	routes   []route
+	fallback MessageHandlerFunc
+}
+
+// NewMessageRouter create an empty message router
+func NewMessageRouter() *MessageRouter {
+	return &MessageRouter{}
+}
+
+// HandleFunc register a handler for the messages matching the predicate m
+func (r *MessageRouter) HandleFunc(m MessageMatcher, h MessageHandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = append(r.routes, route{
+		match:   m,
+		handler: h,
+	})
+}
+
+// HandleContentType register a handler for the messages of content type ct.
+// Content type parameters, such as charset, are ignored
+func (r *MessageRouter) HandleContentType(ct string, h MessageHandlerFunc) {
+	r.HandleFunc(MatchContentType(ct), h)
+}
+
+// HandleField register a handler for the JSON messages having the string
+// field name equal to value
+func (r *MessageRouter) HandleField(name, value string, h MessageHandlerFunc) {
+	r.HandleFunc(MatchField(name, value), h)
+}
+
+// Fallback set the handler processing the messages matching no route
+func (r *MessageRouter) Fallback(h MessageHandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = h
+}
+
+// Route dispatch a message to its handler
+func (r *MessageRouter) Route(ctx context.Context, channelID string, msg MessageWriteReply) error {
+	payload, err := msg.DecodePayload()
+	if err != nil {
+		return fmt.Errorf("unable to decode message %d : %w", msg.Sequence, err)
+	}
+
+	r.mu.RLock()
+	h := r.fallback
+	for _, rt := range r.routes {
+		if rt.match(msg, payload) {
+			h = rt.handler
+			break
+		}
+	}
+	r.mu.RUnlock()
+
+	if h == nil {
+		return fmt.Errorf("message %d : %w", msg.Sequence, ErrNoRoute)
+	}
+	return h(ctx, channelID, msg)
+}
+
+// PullUnread pull the unread messages of a channel, dispatch them to their
+// handler and mark them as read.
+//
+// It stops at the first handler error, leaving the failed message and the
+// following ones unread
+func (r *MessageRouter) PullUnread(ctx context.Context, c *Client, channelID string) error {
+	msgs, err := c.Messages(ctx, MessagesRequest{
+		ChannelID: channelID,
+		UnRead:    true,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read new messages : %w", err)
+	}
+
+	for _, msg := range msgs {
+		if err := r.Route(ctx, channelID, msg); err != nil {
+			return err
+		}
+
+		if err := c.MessageMark(ctx, MessageMarkRequest{
+			ChannelID: channelID,
+			Sequence:  msg.Sequence,
+			Read:      true,
+		}); err != nil {
+			return fmt.Errorf("unable mark message as read : %w", err)
+		}
+	}
+
+	return nil
+}
+
+// NotificationHandler return a websocket callback pulling and dispatching
+// the unread messages of a channel on every notification
+func (r *MessageRouter) NotificationHandler(c *Client, channelID string) NotificationHandlerFunc {
+	return func(ctx context.Context, t int, msg []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		return r.PullUnread(ctx, c, channelID)
+	}
+}
+
+// Poll pull and dispatch the unread messages of a channel every interval,
+// until the context is done. Errors are given to errHandler if not nil.
+// It returns ErrInvalidInterval if interval is not positive
+func (r *MessageRouter) Poll(ctx context.Context, c *Client, channelID string, interval time.Duration, errHandler ErrorHandlerFunc) error {
+	if interval <= 0 {
+		return ErrInvalidInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.PullUnread(ctx, c, channelID); err != nil && errHandler != nil {
+			errHandler(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// MatchContentType match the messages of content type ct, ignoring parameters
+func MatchContentType(ct string) MessageMatcher {
+	want := mediaType(ct)
+	return func(msg MessageWriteReply, payload []byte) bool {
+		return mediaType(msg.ContentType) == want
+	}
+}
+
+// MatchField match the JSON messages having the string field name equal to value
+func MatchField(name, value string) MessageMatcher {
+	return func(msg MessageWriteReply, payload []byte) bool {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return false
+		}
+
+		var v string
+		if err := json.Unmarshal(fields[name], &v); err != nil {
+			return false
+		}
+		return v == value
+	}
+}
+
+// mediaType return the lower case media type of a content type, without parameters
+func mediaType(ct string) string {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(ct))
+	}
+	return mt
+}
@@ -0,0 +1,134 @@
+package spvchannels
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitMessageRouterRoute(t *testing.T) {
+	tests := map[string]struct {
+		msg      MessageWriteReply
+		fallback bool
+		expected string
+		err      error
+	}{
+		"Route by content type": {
+			msg: MessageWriteReply{
+				ContentType: "text/plain; charset=utf-8",
+				Payload:     "Y2xvc2U=",
+			},
+			expected: "text",
+		},
+		"Route by JSON field": {
+			msg: MessageWriteReply{
+				ContentType: "application/json",
+				Payload:     "eyJ0eXBlIjoibWVya2xlcHJvb2YifQ==",
+			},
+			expected: "proof",
+		},
+		"Route by predicate": {
+			msg: MessageWriteReply{
+				Sequence:    42,
+				ContentType: "application/octet-stream",
+				Payload:     "AQID",
+			},
+			expected: "predicate",
+		},
+		"Route to fallback": {
+			msg: MessageWriteReply{
+				ContentType: "application/json",
+				Payload:     "eyJ0eXBlIjoib3RoZXIifQ==",
+			},
+			fallback: true,
+			expected: "fallback",
+		},
+		"No route": {
+			msg: MessageWriteReply{
+				Sequence:    3,
+				ContentType: "application/json",
+				Payload:     "eyJ0eXBlIjoib3RoZXIifQ==",
+			},
+			err: errors.New("message 3 : no handler for message"),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got string
+			handler := func(name string) MessageHandlerFunc {
+				return func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+					got = name
+					return nil
+				}
+			}
+
+			r := NewMessageRouter()
+			r.HandleContentType("text/plain", handler("text"))
+			r.HandleField("type", "merkleproof", handler("proof"))
+			r.HandleFunc(func(msg MessageWriteReply, payload []byte) bool {
+				return msg.Sequence == 42
+			}, handler("predicate"))
+			if test.fallback {
+				r.Fallback(handler("fallback"))
+			}
+
+			err := r.Route(context.Background(), "channel", test.msg)
+			if test.err != nil {
+				assert.EqualError(t, err, test.err.Error())
+				assert.True(t, errors.Is(err, ErrNoRoute))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestUnitMessageRouterPullUnread(t *testing.T) {
+	reply := `[
+		{"sequence": 1, "received": "2021-08-31T18:43:07.855547Z", "content_type": "text/plain", "payload": "b25l"},
+		{"sequence": 2, "received": "2021-08-31T18:43:08.855547Z", "content_type": "text/plain", "payload": "dHdv"}
+	]`
+
+	var marked []string
+	client := NewClient(WithBaseURL("somedomain"))
+	client.HTTPClient = &MockClient{
+		MockDo: func(req *http.Request) (*http.Response, error) {
+			body := ""
+			if req.Method == http.MethodGet {
+				body = reply
+			} else {
+				marked = append(marked, req.URL.Path)
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(body))),
+			}, nil
+		},
+	}
+
+	var payloads []string
+	r := NewMessageRouter()
+	r.HandleContentType("text/plain", func(ctx context.Context, channelID string, msg MessageWriteReply) error {
+		payload, err := msg.DecodePayload()
+		assert.NoError(t, err)
+		payloads = append(payloads, string(payload))
+		return nil
+	})
+
+	h := r.NotificationHandler(client, "channel")
+	assert.NoError(t, h(context.Background(), 1, []byte("New message arrived"), nil))
+	assert.Equal(t, []string{"one", "two"}, payloads)
+	assert.Equal(t, []string{"/api/v1/channel/channel/1", "/api/v1/channel/channel/2"}, marked)
+}
+
+func TestUnitMessageRouterPollInvalidInterval(t *testing.T) {
+	err := NewMessageRouter().Poll(context.Background(), NewClient(), "channel", 0, nil)
+	assert.ErrorIs(t, err, ErrInvalidInterval)
+}
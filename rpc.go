@@ -0,0 +1,434 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderReplyToken is the envelope header holding the token granting write
+	// access to the reply-to channel
+	HeaderReplyToken = "reply-token"
+	// HeaderRPCError is the envelope header holding the error returned by the RPC handler
+	HeaderRPCError = "rpc-error"
+)
+
+// ErrRemoteCall is returned by Call when the remote handler failed
+type ErrRemoteCall struct {
+	Message string
+}
+
+func (e ErrRemoteCall) Error() string {
+	return fmt.Sprintf("remote call failed : %s", e.Message)
+}
+
+// ErrReplyDropped is returned by RPCServer when the reply to a request could
+// not be written and the request was marked as read without reply
+type ErrReplyDropped struct {
+	Sequence int64
+	Err      error
+}
+
+func (e ErrReplyDropped) Error() string {
+	return fmt.Sprintf("reply to request %d dropped : %s", e.Sequence, e.Err)
+}
+
+// Unwrap return the reply write error
+func (e ErrReplyDropped) Unwrap() error {
+	return e.Err
+}
+
+// rpcConfig hold configuration of a RPC client
+type rpcConfig struct {
+	pollInterval time.Duration
+	timeout      time.Duration
+}
+
+// RPCConfigFunc set the RPC client configuration
+type RPCConfigFunc func(c *rpcConfig)
+
+// WithRPCPollInterval set how often the reply channel is read while waiting
+// for replies. Default is 1 second.
+//
+// Zero or a negative value disables polling, the replies are then read when
+// the websocket notifies the reply channel, through NotificationHandler
+func WithRPCPollInterval(d time.Duration) RPCConfigFunc {
+	return func(c *rpcConfig) {
+		c.pollInterval = d
+	}
+}
+
+// WithRPCTimeout set how long Call waits for the reply. Default is 30 seconds
+func WithRPCTimeout(d time.Duration) RPCConfigFunc {
+	return func(c *rpcConfig) {
+		c.timeout = d
+	}
+}
+
+func defaultRPCConfig() *rpcConfig {
+	return &rpcConfig{
+		pollInterval: time.Second,
+		timeout:      30 * time.Second,
+	}
+}
+
+// RPCClient sends requests to a counterparty and waits for the replies on
+// its own reply channel.
+//
+// The reply channel should be dedicated to the RPC client: every message
+// read from it is marked as read, replies to calls which timed out are dropped
+type RPCClient struct {
+	mu             sync.Mutex
+	pollMu         sync.Mutex
+	cfg            *rpcConfig
+	requests       *Client
+	replies        *Client
+	replyChannelID string
+	replyToken     string
+	pending        map[string]chan EnvelopedMessage
+}
+
+// NewRPCClient create a RPC client writing the requests with requests and
+// reading the replies from replyChannelID with replies.
+//
+// replyToken, if not empty, is sent along with each request so the server
+// can write the reply to the reply channel with it
+func NewRPCClient(requests, replies *Client, replyChannelID, replyToken string, opts ...RPCConfigFunc) *RPCClient {
+	cfg := defaultRPCConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return &RPCClient{
+		cfg:            cfg,
+		requests:       requests,
+		replies:        replies,
+		replyChannelID: replyChannelID,
+		replyToken:     replyToken,
+		pending:        make(map[string]chan EnvelopedMessage),
+	}
+}
+
+// Call writes an envelope of payload to the request channel and waits for
+// the reply with the matching correlation id, until the context is done or
+// the RPC timeout expires.
+//
+// It returns ErrRemoteCall if the remote handler failed
+func (r *RPCClient) Call(ctx context.Context, requestChannelID string, payload []byte, contentType string) (*EnvelopedMessage, error) {
+	e, err := NewEnvelope(payload, contentType)
+	if err != nil {
+		return nil, err
+	}
+	e.ReplyTo = r.replyChannelID
+	if r.replyToken != "" {
+		e.SetHeader(HeaderReplyToken, r.replyToken)
+	}
+
+	ch := make(chan EnvelopedMessage, 1)
+	r.mu.Lock()
+	r.pending[e.ID] = ch
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, e.ID)
+		r.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.timeout)
+	defer cancel()
+
+	if _, err := r.requests.MessageWriteEnvelope(ctx, requestChannelID, e); err != nil {
+		return nil, fmt.Errorf("unable to write request : %w", err)
+	}
+
+	var tick <-chan time.Time
+	if r.cfg.pollInterval > 0 {
+		ticker := time.NewTicker(r.cfg.pollInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case reply := <-ch:
+			if msg := reply.Envelope.Header(HeaderRPCError); msg != "" {
+				return &reply, ErrRemoteCall{Message: msg}
+			}
+			return &reply, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-tick:
+			if err := r.Poll(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Poll reads the unread messages of the reply channel, delivers the replies
+// to the pending calls and marks the messages as read
+func (r *RPCClient) Poll(ctx context.Context) error {
+	r.pollMu.Lock()
+	defer r.pollMu.Unlock()
+
+	msgs, err := r.replies.MessagesEnveloped(ctx, MessagesRequest{
+		ChannelID: r.replyChannelID,
+		UnRead:    true,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read replies : %w", err)
+	}
+
+	for _, msg := range msgs {
+		if msg.Envelope != nil {
+			r.mu.Lock()
+			ch, ok := r.pending[msg.Envelope.CorrelationID]
+			r.mu.Unlock()
+			if ok {
+				select {
+				case ch <- msg:
+				default:
+				}
+			}
+		}
+
+		if err := r.replies.MessageMark(ctx, MessageMarkRequest{
+			ChannelID: r.replyChannelID,
+			Sequence:  msg.Sequence,
+			Read:      true,
+		}); err != nil {
+			return fmt.Errorf("unable mark reply as read : %w", err)
+		}
+	}
+
+	return nil
+}
+
+// NotificationHandler return a websocket callback reading the replies on
+// every notification of the reply channel
+func (r *RPCClient) NotificationHandler() NotificationHandlerFunc {
+	return func(ctx context.Context, t int, msg []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		return r.Poll(ctx)
+	}
+}
+
+// RPCHandlerFunc is a callback answering a request. It returns the reply
+// payload and content type
+type RPCHandlerFunc func(ctx context.Context, req EnvelopedMessage) ([]byte, string, error)
+
+// rpcServerConfig hold configuration of a RPC server
+type rpcServerConfig struct {
+	replyAttempts int
+}
+
+// RPCServerConfigFunc set the RPC server configuration
+type RPCServerConfigFunc func(c *rpcServerConfig)
+
+// WithRPCReplyAttempts set how many times the server tries to write the
+// reply to a request when the failure may be temporary. Default is 3
+func WithRPCReplyAttempts(n int) RPCServerConfigFunc {
+	return func(c *rpcServerConfig) {
+		c.replyAttempts = n
+	}
+}
+
+func defaultRPCServerConfig() *rpcServerConfig {
+	return &rpcServerConfig{
+		replyAttempts: 3,
+	}
+}
+
+// RPCServer reads the requests of a channel and writes the replies of its
+// handler to their reply-to channel
+type RPCServer struct {
+	mu        sync.Mutex
+	cfg       *rpcServerConfig
+	client    *Client
+	channelID string
+	handler   RPCHandlerFunc
+	pending   map[int64]*pendingReply
+}
+
+// pendingReply hold the reply to a request until the request is marked as
+// read, so a failed write is retried without calling the handler again
+type pendingReply struct {
+	envelope *Envelope
+	failures int
+	written  bool
+}
+
+// NewRPCServer create a RPC server answering the requests of channelID with h
+func NewRPCServer(client *Client, channelID string, h RPCHandlerFunc, opts ...RPCServerConfigFunc) *RPCServer {
+	cfg := defaultRPCServerConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return &RPCServer{
+		cfg:       cfg,
+		client:    client,
+		channelID: channelID,
+		handler:   h,
+		pending:   make(map[int64]*pendingReply),
+	}
+}
+
+// Process answers the unread requests of the channel and marks them as read.
+//
+// A handler error is sent back to the caller in the reply. Messages which are
+// not envelopes, or have no reply-to channel, are marked as read without reply.
+//
+// When a reply can not be written, Process stops and leaves the request unread
+// so the next call writes it again, up to the attempts set by
+// WithRPCReplyAttempts. The handler is called once per request, its reply is
+// kept until the request is marked as read.
+// A reply rejected by the server (4xx status) or too large is not retried.
+// Once given up, the request is marked as read and the following requests are
+// processed, Process then returns ErrReplyDropped
+func (s *RPCServer) Process(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs, err := s.client.MessagesEnveloped(ctx, MessagesRequest{
+		ChannelID: s.channelID,
+		UnRead:    true,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read requests : %w", err)
+	}
+
+	var dropped error
+	for _, msg := range msgs {
+		if msg.Envelope != nil && msg.Envelope.ReplyTo != "" {
+			if err := s.reply(ctx, msg); err != nil {
+				p := s.pending[msg.Sequence]
+				if p != nil && !permanentReplyError(err) && p.failures < s.cfg.replyAttempts {
+					return err
+				}
+				if dropped == nil {
+					dropped = ErrReplyDropped{Sequence: msg.Sequence, Err: err}
+				}
+			}
+		}
+
+		if err := s.client.MessageMark(ctx, MessageMarkRequest{
+			ChannelID: s.channelID,
+			Sequence:  msg.Sequence,
+			Read:      true,
+		}); err != nil {
+			return fmt.Errorf("unable mark request as read : %w", err)
+		}
+		delete(s.pending, msg.Sequence)
+	}
+
+	return dropped
+}
+
+// permanentReplyError tells if writing a reply failed for a reason retrying
+// will not fix: the server rejected the request or the reply is too large
+func permanentReplyError(err error) bool {
+	if errors.Is(err, ErrMessageTooLarge) {
+		return true
+	}
+	var status ErrHTTPStatus
+	if !errors.As(err, &status) {
+		return false
+	}
+	switch status.Code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return status.Code >= http.StatusBadRequest && status.Code < http.StatusInternalServerError
+}
+
+// reply writes the reply to a request, calling the handler unless the reply
+// of a previous attempt is pending. A write failure is counted in the
+// pending reply, a reply which can not be built is not pending
+func (s *RPCServer) reply(ctx context.Context, msg EnvelopedMessage) error {
+	p, ok := s.pending[msg.Sequence]
+	if !ok {
+		payload, cty, err := s.handler(ctx, msg)
+
+		e, rerr := msg.Envelope.Reply(payload, cty)
+		if rerr != nil {
+			return rerr
+		}
+		if err != nil {
+			e.Body = nil
+			e.ContentType = ""
+			e.SetHeader(HeaderRPCError, err.Error())
+		}
+
+		p = &pendingReply{
+			envelope: e,
+		}
+		s.pending[msg.Sequence] = p
+	}
+	if p.written {
+		return nil
+	}
+
+	client := s.client
+	if token := msg.Envelope.Header(HeaderReplyToken); token != "" {
+		client = s.client.withToken(token)
+	}
+
+	if _, err := client.MessageWriteEnvelope(ctx, msg.Envelope.ReplyTo, p.envelope); err != nil {
+		p.failures++
+		return fmt.Errorf("unable to write reply : %w", err)
+	}
+	p.written = true
+	return nil
+}
+
+// NotificationHandler return a websocket callback answering the requests on
+// every notification of the channel
+func (s *RPCServer) NotificationHandler() NotificationHandlerFunc {
+	return func(ctx context.Context, t int, msg []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		return s.Process(ctx)
+	}
+}
+
+// Serve answers the requests every interval, until the context is done.
+// Errors are given to errHandler if not nil.
+//
+// It returns ErrInvalidInterval if interval is not positive
+func (s *RPCServer) Serve(ctx context.Context, interval time.Duration, errHandler ErrorHandlerFunc) error {
+	if interval <= 0 {
+		return ErrInvalidInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Process(ctx); err != nil && errHandler != nil {
+			errHandler(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// withToken return a copy of the client authenticated with the bearer token
+func (c *Client) withToken(token string) *Client {
+	cfg := *c.cfg
+	cfg.token = token
+	return &Client{
+		cfg:        &cfg,
+		HTTPClient: c.HTTPClient,
+	}
+}
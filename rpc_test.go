@@ -0,0 +1,182 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitRPC(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewRPCServer(client, "requests", func(ctx context.Context, req EnvelopedMessage) ([]byte, string, error) {
+		payload, err := req.DecodePayload()
+		if err != nil {
+			return nil, "", err
+		}
+		if string(payload) == "fail" {
+			return nil, "", errors.New("boom")
+		}
+		return []byte(strings.ToUpper(string(payload))), "text/plain", nil
+	})
+	go func() {
+		_ = server.Serve(ctx, 5*time.Millisecond, nil)
+	}()
+
+	rpc := NewRPCClient(client, client, "replies", "reply-token", WithRPCPollInterval(5*time.Millisecond))
+
+	t.Run("Reply", func(t *testing.T) {
+		reply, err := rpc.Call(ctx, "requests", []byte("hello"), "text/plain")
+		assert.NoError(t, err)
+		payload, err := reply.DecodePayload()
+		assert.NoError(t, err)
+		assert.Equal(t, "HELLO", string(payload))
+		assert.Equal(t, "text/plain", reply.ContentType)
+		assert.NotEmpty(t, reply.Envelope.CorrelationID)
+	})
+
+	t.Run("Concurrent calls", func(t *testing.T) {
+		words := []string{"a", "b", "c", "d"}
+		errs := make(chan error, len(words))
+		for _, w := range words {
+			go func(w string) {
+				reply, err := rpc.Call(ctx, "requests", []byte(w), "text/plain")
+				if err == nil {
+					payload, _ := reply.DecodePayload()
+					if string(payload) != strings.ToUpper(w) {
+						err = errors.New("wrong reply " + string(payload))
+					}
+				}
+				errs <- err
+			}(w)
+		}
+		for range words {
+			assert.NoError(t, <-errs)
+		}
+	})
+
+	t.Run("Remote error", func(t *testing.T) {
+		_, err := rpc.Call(ctx, "requests", []byte("fail"), "text/plain")
+		var remote ErrRemoteCall
+		assert.True(t, errors.As(err, &remote))
+		assert.Equal(t, "boom", remote.Message)
+	})
+
+	t.Run("Reply written with the reply token", func(t *testing.T) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		found := false
+		for i, r := range s.requests {
+			if r == "POST /api/v1/channel/replies" {
+				assert.Equal(t, "Bearer reply-token", s.auth[i])
+				found = true
+			}
+		}
+		assert.True(t, found)
+	})
+
+	for _, m := range s.messages("replies") {
+		assert.True(t, m.read)
+	}
+	for _, m := range s.messages("requests") {
+		assert.True(t, m.read)
+	}
+}
+
+func TestUnitRPCTimeout(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	rpc := NewRPCClient(client, client, "replies", "", WithRPCPollInterval(5*time.Millisecond), WithRPCTimeout(30*time.Millisecond))
+
+	_, err := rpc.Call(context.Background(), "requests", []byte("hello"), "text/plain")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	e, err := OpenEnvelope(s.messages("requests")[0].MessageWriteReply)
+	assert.NoError(t, err)
+	assert.Equal(t, "replies", e.ReplyTo)
+	assert.Empty(t, e.Header(HeaderReplyToken))
+}
+
+func TestUnitRPCNotificationHandler(t *testing.T) {
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+
+	server := NewRPCServer(client, "requests", func(ctx context.Context, req EnvelopedMessage) ([]byte, string, error) {
+		return []byte("pong"), "text/plain", nil
+	})
+	rpc := NewRPCClient(client, client, "replies", "", WithRPCPollInterval(0))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := rpc.Call(ctx, "requests", []byte("ping"), "text/plain")
+		done <- err
+	}()
+
+	assert.Eventually(t, func() bool {
+		return len(s.messages("requests")) == 1
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, server.NotificationHandler()(ctx, 0, nil, nil))
+	assert.NoError(t, rpc.NotificationHandler()(ctx, 0, nil, nil))
+	assert.NoError(t, <-done)
+}
+
+func TestUnitRPCServerReplyFailure(t *testing.T) {
+	s := newMockServer()
+	s.missing["gone"] = true
+	client := newMockClient(s)
+	ctx := context.Background()
+
+	calls := 0
+	server := NewRPCServer(client, "requests", func(ctx context.Context, req EnvelopedMessage) ([]byte, string, error) {
+		calls++
+		return []byte("pong"), "text/plain", nil
+	}, WithRPCReplyAttempts(2))
+	request := func(replyTo string) {
+		e, err := NewEnvelope([]byte("ping"), "text/plain")
+		assert.NoError(t, err)
+		e.ReplyTo = replyTo
+		_, err = client.MessageWriteEnvelope(ctx, "requests", e)
+		assert.NoError(t, err)
+	}
+
+	// An invalid reply-to channel is not retried, the next requests are answered
+	request("gone")
+	request("replies")
+	var dropped ErrReplyDropped
+	assert.True(t, errors.As(server.Process(ctx), &dropped))
+	assert.Equal(t, int64(1), dropped.Sequence)
+	assert.Equal(t, []int64{1, 2}, readSequences(s, "requests"))
+	assert.Len(t, s.messages("replies"), 1)
+
+	// A temporary failure is retried on the next call, without calling the handler again
+	request("replies")
+	s.failNext(http.MethodPost, 1)
+	assert.Error(t, server.Process(ctx))
+	assert.Equal(t, []int64{1, 2}, readSequences(s, "requests"))
+	assert.NoError(t, server.Process(ctx))
+	assert.Len(t, s.messages("replies"), 2)
+	assert.Equal(t, 3, calls)
+
+	// Up to the reply attempts
+	request("replies")
+	s.failNext(http.MethodPost, 2)
+	assert.Error(t, server.Process(ctx))
+	assert.True(t, errors.As(server.Process(ctx), &dropped))
+	assert.Equal(t, int64(4), dropped.Sequence)
+	assert.Equal(t, []int64{1, 2, 3, 4}, readSequences(s, "requests"))
+	assert.Len(t, s.messages("replies"), 2)
+}
+
+func TestUnitRPCServerServeInvalidInterval(t *testing.T) {
+	server := NewRPCServer(newMockClient(newMockServer()), "requests", nil)
+	assert.ErrorIs(t, server.Serve(context.Background(), 0, nil), ErrInvalidInterval)
+}
@@ -0,0 +1,145 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// ErrWriteConflict is returned by SequencedWriter when the write is still
+// rejected after the maximum attempts
+type ErrWriteConflict struct {
+	Attempts int
+	Err      error
+}
+
+func (e ErrWriteConflict) Error() string {
+	return fmt.Sprintf("write conflict after %d attempts : %s", e.Attempts, e.Err)
+}
+
+// Unwrap return the last conflict error
+func (e ErrWriteConflict) Unwrap() error {
+	return e.Err
+}
+
+// ErrMergeAborted is returned by SequencedWriter when the merge function rejects the write
+type ErrMergeAborted struct {
+	Err error
+}
+
+func (e ErrMergeAborted) Error() string {
+	return fmt.Sprintf("merge aborted the write : %s", e.Err)
+}
+
+// Unwrap return the merge function error
+func (e ErrMergeAborted) Unwrap() error {
+	return e.Err
+}
+
+// IsConflict tells if err is a 409 Conflict reply, returned by a sequenced
+// channel when the writer has unread messages
+func IsConflict(err error) bool {
+	var status ErrHTTPStatus
+	return errors.As(err, &status) && status.Code == http.StatusConflict
+}
+
+// MergeFunc is called by SequencedWriter with the pending write and the
+// unread messages which made the server reject it. It return the request to
+// write instead, or an error to abort the write
+type MergeFunc func(ctx context.Context, r MessageWriteRequest, unread MessagesReply) (MessageWriteRequest, error)
+
+// SequencedWriter writes to a channel created with Sequenced set, using
+// optimistic concurrency.
+//
+// When the server rejects a write because the writer has unread messages,
+// the unread messages are read and given to the merge function, marked as
+// read, then the write returned by the merge function is retried
+type SequencedWriter struct {
+	client    *Client
+	channelID string
+	merge     MergeFunc
+	attempts  int
+}
+
+// NewSequencedWriter create a sequenced writer of the channel channelID
+// trying each write up to attempts times. A nil merge function retries the
+// write unchanged
+func NewSequencedWriter(client *Client, channelID string, merge MergeFunc, attempts int) *SequencedWriter {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &SequencedWriter{
+		client:    client,
+		channelID: channelID,
+		merge:     merge,
+		attempts:  attempts,
+	}
+}
+
+// Write writes a message, resolving the conflicts with the merge function.
+//
+// It returns ErrMergeAborted if the merge function fails, and ErrWriteConflict
+// if the write is still rejected after the maximum attempts
+func (w *SequencedWriter) Write(ctx context.Context, r MessageWriteRequest) (*MessageWriteReply, error) {
+	r.ChannelID = w.channelID
+
+	var err error
+	for attempt := 1; attempt <= w.attempts; attempt++ {
+		var reply *MessageWriteReply
+		if reply, err = w.client.MessageWrite(ctx, r); err == nil {
+			return reply, nil
+		}
+		if !IsConflict(err) {
+			return nil, err
+		}
+		if attempt == w.attempts {
+			break
+		}
+
+		if r, err = w.resolve(ctx, r); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, ErrWriteConflict{
+		Attempts: w.attempts,
+		Err:      err,
+	}
+}
+
+// resolve reads the unread messages, merges them and marks them as read
+func (w *SequencedWriter) resolve(ctx context.Context, r MessageWriteRequest) (MessageWriteRequest, error) {
+	unread, err := w.client.Messages(ctx, MessagesRequest{
+		ChannelID: w.channelID,
+		UnRead:    true,
+	})
+	if err != nil {
+		return r, fmt.Errorf("unable to read unread messages : %w", err)
+	}
+	sort.Slice(unread, func(i, j int) bool {
+		return unread[i].Sequence < unread[j].Sequence
+	})
+
+	if w.merge != nil {
+		merged, err := w.merge(ctx, r, unread)
+		if err != nil {
+			return r, ErrMergeAborted{Err: err}
+		}
+		merged.ChannelID = w.channelID
+		r = merged
+	}
+
+	if len(unread) > 0 {
+		if err := w.client.MessageMark(ctx, MessageMarkRequest{
+			ChannelID: w.channelID,
+			Sequence:  unread[len(unread)-1].Sequence,
+			Older:     true,
+			Read:      true,
+		}); err != nil {
+			return r, fmt.Errorf("unable mark messages as read : %w", err)
+		}
+	}
+	return r, nil
+}
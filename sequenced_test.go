@@ -0,0 +1,103 @@
+package spvchannels
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitSequencedWriter(t *testing.T) {
+	ctx := context.Background()
+
+	tests := map[string]struct {
+		others   int
+		attempts int
+		merge    MergeFunc
+		expErr   error
+		expMsg   string
+	}{
+		"No conflict": {
+			attempts: 3,
+			expMsg:   "mine",
+		},
+		"Conflict merged": {
+			others:   2,
+			attempts: 3,
+			merge: func(ctx context.Context, r MessageWriteRequest, unread MessagesReply) (MessageWriteRequest, error) {
+				r.Message += " after " + unread[0].Payload
+				return r, nil
+			},
+			expMsg: "mine after b3RoZXI=",
+		},
+		"Conflict retried unchanged": {
+			others:   1,
+			attempts: 2,
+			expMsg:   "mine",
+		},
+		"Merge aborted": {
+			others:   1,
+			attempts: 3,
+			merge: func(ctx context.Context, r MessageWriteRequest, unread MessagesReply) (MessageWriteRequest, error) {
+				return r, errors.New("incompatible")
+			},
+			expErr: ErrMergeAborted{},
+		},
+		"Attempts exhausted": {
+			others:   1,
+			attempts: 1,
+			expErr:   ErrWriteConflict{},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newMockServer()
+			s.sequenced["channel"] = true
+			for i := 0; i < test.others; i++ {
+				s.add("channel", "text/plain", []byte("other"))
+			}
+
+			client := NewClient(WithBaseURL("somedomain"), WithToken("writer"))
+			client.HTTPClient = s
+			w := NewSequencedWriter(client, "channel", test.merge, test.attempts)
+
+			reply, err := w.Write(ctx, MessageWriteRequest{Message: "mine", ContentType: "text/plain"})
+			switch test.expErr.(type) {
+			case ErrMergeAborted:
+				var aborted ErrMergeAborted
+				assert.True(t, errors.As(err, &aborted))
+				assert.EqualError(t, aborted.Err, "incompatible")
+				return
+			case ErrWriteConflict:
+				var conflict ErrWriteConflict
+				assert.True(t, errors.As(err, &conflict))
+				assert.Equal(t, test.attempts, conflict.Attempts)
+				assert.True(t, IsConflict(err))
+				return
+			}
+
+			assert.NoError(t, err)
+			payload, _ := reply.DecodePayload()
+			assert.Equal(t, test.expMsg, string(payload))
+			for _, m := range s.messages("channel") {
+				assert.True(t, m.read || m.Sequence == reply.Sequence)
+			}
+		})
+	}
+}
+
+func TestUnitSequencedWriterOtherError(t *testing.T) {
+	s := newMockServer()
+	s.failNext(http.MethodPost, 1)
+	w := NewSequencedWriter(newMockClient(s), "channel", nil, 3)
+
+	_, err := w.Write(context.Background(), MessageWriteRequest{Message: "mine"})
+	var status ErrHTTPStatus
+	assert.True(t, errors.As(err, &status))
+	assert.Equal(t, http.StatusInternalServerError, status.Code)
+	assert.False(t, IsConflict(err))
+	assert.Len(t, s.messages("channel"), 0)
+}
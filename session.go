@@ -0,0 +1,366 @@
+package spvchannels
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HandshakeContentType is the content type of the signed handshake messages
+const HandshakeContentType = "application/vnd.spvchannels.handshake+json"
+
+// SessionContentType is the content type of the messages encrypted by a SecureSession
+const SessionContentType = "application/vnd.spvchannels.session+json"
+
+// SessionEnvelopeVersion is the version of the SessionEnvelope format
+const SessionEnvelopeVersion = 1
+
+// maxEpochSkip bounds the number of keys derived to catch up with the sender epoch
+const maxEpochSkip = 1024
+
+// ErrUnknownEpoch is returned when a session message is encrypted with a key
+// the session no longer holds, or is too far ahead
+var ErrUnknownEpoch = errors.New("unknown session epoch")
+
+// ChannelPair identifies the 2 channels used by a peer to talk to another peer.
+// The peer reads the local channel and writes the remote channel, which is
+// the local channel of the other peer
+type ChannelPair struct {
+	Local           *Client
+	LocalChannelID  string
+	Remote          *Client
+	RemoteChannelID string
+}
+
+// handshakeMessage is the signed payload posted by each peer
+type handshakeMessage struct {
+	Version      int    `json:"v"`
+	EphemeralKey []byte `json:"epk"`
+}
+
+// SessionEnvelope is the message content of a message encrypted by a SecureSession.
+// Binary fields are base64 encoded in JSON
+type SessionEnvelope struct {
+	Version     int    `json:"v"`
+	SessionID   string `json:"sid"`
+	Epoch       uint32 `json:"epoch"`
+	ContentType string `json:"cty,omitempty"`
+	Nonce       []byte `json:"nonce"`
+	Ciphertext  []byte `json:"ct"`
+}
+
+func (e SessionEnvelope) aad() []byte {
+	return []byte(fmt.Sprintf("%d|%s|%d|%s", e.Version, e.SessionID, e.Epoch, e.ContentType))
+}
+
+// sessionConfig hold configuration of a secure session
+type sessionConfig struct {
+	pollInterval  time.Duration
+	rekeyMessages int
+	rekeyInterval time.Duration
+}
+
+// SessionConfigFunc set the secure session configuration
+type SessionConfigFunc func(c *sessionConfig)
+
+// WithHandshakePollInterval set how often the local channel is read while
+// waiting for the peer handshake. Default is 1 second
+func WithHandshakePollInterval(d time.Duration) SessionConfigFunc {
+	return func(c *sessionConfig) {
+		c.pollInterval = d
+	}
+}
+
+// WithRekey derives a new sending key after n messages or after the duration d,
+// whichever comes first. Zero disables the corresponding limit
+func WithRekey(n int, d time.Duration) SessionConfigFunc {
+	return func(c *sessionConfig) {
+		c.rekeyMessages = n
+		c.rekeyInterval = d
+	}
+}
+
+func defaultSessionConfig() *sessionConfig {
+	return &sessionConfig{
+		pollInterval:  time.Second,
+		rekeyMessages: 1000,
+		rekeyInterval: time.Hour,
+	}
+}
+
+// SecureSession encrypts the messages exchanged with a peer with the keys
+// agreed by Handshake.
+//
+// Each direction uses its own key chain. The sender moves to the next key
+// (epoch) after the configured number of messages or time, the receiver
+// follows the epoch recorded in the messages. Old keys are forgotten, so a
+// compromised key does not reveal the previous epochs.
+type SecureSession struct {
+	mu        sync.Mutex
+	cfg       *sessionConfig
+	pair      ChannelPair
+	id        string
+	sendKey   []byte
+	sendEpoch uint32
+	sent      int
+	epochAt   time.Time
+	recvKeys  map[uint32][]byte
+	recvEpoch uint32
+}
+
+// Handshake agrees a SecureSession with the peer at the other end of the channel pair.
+//
+// It posts an ephemeral X25519 public key signed by signer to the remote
+// channel, then waits for the peer ephemeral key on the local channel. The
+// peer message must verify with v, which should trust the peer identity key
+// only. Both peers derive the same shared secret from the 2 ephemeral keys.
+func Handshake(ctx context.Context, p ChannelPair, signer MessageSigner, v *Verifier, opts ...SessionConfigFunc) (*SecureSession, error) {
+	cfg := defaultSessionConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	eph, err := GenerateX25519Key()
+	if err != nil {
+		return nil, err
+	}
+
+	hs, err := json.Marshal(handshakeMessage{
+		Version:      SessionEnvelopeVersion,
+		EphemeralKey: eph.PublicKey().Bytes(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := p.Remote.MessageWriteSigned(ctx, MessageWriteRequest{
+		ChannelID:   p.RemoteChannelID,
+		Message:     string(hs),
+		ContentType: HandshakeContentType,
+	}, signer); err != nil {
+		return nil, fmt.Errorf("unable to send handshake : %w", err)
+	}
+
+	peer, err := waitHandshake(ctx, p, v, cfg.pollInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	peerKey, err := ParseX25519PublicKey(peer.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	own := eph.PublicKey().Bytes()
+	salt := append(append([]byte{}, own...), peer.EphemeralKey...)
+	if bytes.Compare(own, peer.EphemeralKey) > 0 {
+		salt = append(append([]byte{}, peer.EphemeralKey...), own...)
+	}
+
+	s := &SecureSession{
+		cfg:      cfg,
+		pair:     p,
+		id:       KeyID(salt),
+		sendKey:  hkdfSHA256(shared, salt, append([]byte("spvchannels-session|"), own...), 32),
+		epochAt:  time.Now(),
+		recvKeys: make(map[uint32][]byte),
+	}
+	s.recvKeys[0] = hkdfSHA256(shared, salt, append([]byte("spvchannels-session|"), peer.EphemeralKey...), 32)
+	return s, nil
+}
+
+// waitHandshake poll the local channel until a verified handshake message is read
+func waitHandshake(ctx context.Context, p ChannelPair, v *Verifier, interval time.Duration) (*handshakeMessage, error) {
+	for {
+		msgs, err := p.Local.Messages(ctx, MessagesRequest{
+			ChannelID: p.LocalChannelID,
+			UnRead:    true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to read handshake : %w", err)
+		}
+
+		var found *handshakeMessage
+		for _, msg := range msgs {
+			if mediaType(msg.ContentType) != SignedContentType {
+				continue
+			}
+
+			vm, err := v.Verify(p.LocalChannelID, msg)
+			if err != nil || vm.ContentType != HandshakeContentType {
+				continue
+			}
+
+			payload, err := vm.DecodePayload()
+			if err != nil {
+				continue
+			}
+			var hs handshakeMessage
+			if err := json.Unmarshal(payload, &hs); err != nil || hs.Version != SessionEnvelopeVersion {
+				continue
+			}
+
+			if err := p.Local.MessageMark(ctx, MessageMarkRequest{
+				ChannelID: p.LocalChannelID,
+				Sequence:  msg.Sequence,
+				Read:      true,
+			}); err != nil {
+				return nil, fmt.Errorf("unable mark handshake as read : %w", err)
+			}
+			found = &hs
+		}
+
+		if found != nil {
+			return found, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// nextKey derives the key of the next epoch from the current one
+func nextKey(key []byte) []byte {
+	return hkdfSHA256(key, nil, []byte("spvchannels-rekey"), 32)
+}
+
+// ID return the session id, shared by both peers
+func (s *SecureSession) ID() string {
+	return s.id
+}
+
+// Encrypt return the session envelope of a message content
+func (s *SecureSession) Encrypt(plaintext []byte, contentType string) (*SessionEnvelope, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if (s.cfg.rekeyMessages > 0 && s.sent >= s.cfg.rekeyMessages) ||
+		(s.cfg.rekeyInterval > 0 && time.Since(s.epochAt) >= s.cfg.rekeyInterval) {
+		s.sendKey = nextKey(s.sendKey)
+		s.sendEpoch++
+		s.sent = 0
+		s.epochAt = time.Now()
+	}
+
+	e := &SessionEnvelope{
+		Version:     SessionEnvelopeVersion,
+		SessionID:   s.id,
+		Epoch:       s.sendEpoch,
+		ContentType: contentType,
+	}
+
+	var err error
+	if e.Nonce, e.Ciphertext, err = sealAESGCM(s.sendKey, plaintext, e.aad()); err != nil {
+		return nil, err
+	}
+	s.sent++
+	return e, nil
+}
+
+// Decrypt return the content of a session envelope written by the peer
+func (s *SecureSession) Decrypt(e *SessionEnvelope) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e.Version != SessionEnvelopeVersion || e.SessionID != s.id {
+		return nil, fmt.Errorf("envelope of session %s : %w", e.SessionID, ErrUnknownEpoch)
+	}
+
+	if e.Epoch <= s.recvEpoch {
+		key, ok := s.recvKeys[e.Epoch]
+		if !ok {
+			return nil, ErrUnknownEpoch
+		}
+		return openAESGCM(key, e.Nonce, e.Ciphertext, e.aad())
+	}
+
+	if e.Epoch-s.recvEpoch > maxEpochSkip {
+		return nil, ErrUnknownEpoch
+	}
+	keys := make(map[uint32][]byte)
+	key := s.recvKeys[s.recvEpoch]
+	for epoch := s.recvEpoch; epoch < e.Epoch; epoch++ {
+		keys[epoch] = key
+		key = nextKey(key)
+	}
+	keys[e.Epoch] = key
+
+	// The ratchet only moves forward once the envelope is authenticated,
+	// a forged epoch must not drop the keys of the current one
+	plaintext, err := openAESGCM(key, e.Nonce, e.Ciphertext, e.aad())
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the previous epoch key for the messages still in flight
+	s.recvKeys[e.Epoch-1] = keys[e.Epoch-1]
+	s.recvKeys[e.Epoch] = key
+	for epoch := range s.recvKeys {
+		if epoch+1 < e.Epoch {
+			delete(s.recvKeys, epoch)
+		}
+	}
+	s.recvEpoch = e.Epoch
+	return plaintext, nil
+}
+
+// Write encrypts a message content and writes it to the remote channel
+func (s *SecureSession) Write(ctx context.Context, payload []byte, contentType string) (*MessageWriteReply, error) {
+	e, err := s.Encrypt(payload, contentType)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt message : %w", err)
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.pair.Remote.MessageWrite(ctx, MessageWriteRequest{
+		ChannelID:   s.pair.RemoteChannelID,
+		Message:     string(data),
+		ContentType: SessionContentType,
+	})
+}
+
+// Open decrypts a message of the local channel. Its payload and content
+// type are replaced by the original ones
+func (s *SecureSession) Open(msg MessageWriteReply) (MessageWriteReply, error) {
+	payload, err := msg.DecodePayload()
+	if err != nil {
+		return msg, err
+	}
+
+	var e SessionEnvelope
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return msg, err
+	}
+
+	plaintext, err := s.Decrypt(&e)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.Payload = base64.StdEncoding.EncodeToString(plaintext)
+	msg.ContentType = e.ContentType
+	return msg, nil
+}
+
+// Epoch return the current sending epoch
+func (s *SecureSession) Epoch() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sendEpoch
+}
@@ -0,0 +1,145 @@
+package spvchannels
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// handshakePeers run the handshake between alice and bob over a mock server
+func handshakePeers(t *testing.T, opts ...SessionConfigFunc) (*SecureSession, *SecureSession, *mockServer) {
+	alicePub, aliceKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	bobPub, bobKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	s := newMockServer()
+	client := newMockClient(s)
+
+	aliceVerifier := NewVerifier(time.Minute)
+	aliceVerifier.Trust("bob", AlgEd25519, bobPub)
+	bobVerifier := NewVerifier(time.Minute)
+	bobVerifier.Trust("alice", AlgEd25519, alicePub)
+
+	opts = append(opts, WithHandshakePollInterval(time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var bob *SecureSession
+	var bobErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bob, bobErr = Handshake(ctx, ChannelPair{
+			Local:           client,
+			LocalChannelID:  "bob",
+			Remote:          client,
+			RemoteChannelID: "alice",
+		}, NewEd25519Signer(bobKey), bobVerifier, opts...)
+	}()
+
+	alice, err := Handshake(ctx, ChannelPair{
+		Local:           client,
+		LocalChannelID:  "alice",
+		Remote:          client,
+		RemoteChannelID: "bob",
+	}, NewEd25519Signer(aliceKey), aliceVerifier, opts...)
+	assert.NoError(t, err)
+	<-done
+	assert.NoError(t, bobErr)
+	return alice, bob, s
+}
+
+func TestUnitHandshake(t *testing.T) {
+	alice, bob, s := handshakePeers(t)
+	assert.Equal(t, alice.ID(), bob.ID())
+
+	_, err := alice.Write(context.Background(), []byte("hello bob"), "text/plain")
+	assert.NoError(t, err)
+
+	msgs := s.messages("bob")
+	last := msgs[len(msgs)-1]
+	assert.Equal(t, SessionContentType, last.ContentType)
+
+	msg, err := bob.Open(last.MessageWriteReply)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", msg.ContentType)
+	payload, err := msg.DecodePayload()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello bob", string(payload))
+
+	// Alice can not read her own messages, each direction has its own key
+	_, err = alice.Open(last.MessageWriteReply)
+	assert.Error(t, err)
+}
+
+func TestUnitHandshakeRejectsUntrustedPeer(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	_, mallory, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	s := newMockServer()
+	client := newMockClient(s)
+	_, err = client.MessageWriteSigned(context.Background(), MessageWriteRequest{
+		ChannelID:   "alice",
+		Message:     `{"v":1,"epk":"AAAA"}`,
+		ContentType: HandshakeContentType,
+	}, NewEd25519Signer(mallory))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = Handshake(ctx, ChannelPair{
+		Local:           client,
+		LocalChannelID:  "alice",
+		Remote:          client,
+		RemoteChannelID: "bob",
+	}, NewEd25519Signer(key), NewVerifier(time.Minute), WithHandshakePollInterval(time.Millisecond))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestUnitSessionRekey(t *testing.T) {
+	alice, bob, _ := handshakePeers(t, WithRekey(2, 0))
+
+	var envelopes []*SessionEnvelope
+	for i := 0; i < 5; i++ {
+		e, err := alice.Encrypt([]byte("message"), "text/plain")
+		assert.NoError(t, err)
+		envelopes = append(envelopes, e)
+	}
+	assert.Equal(t, uint32(2), alice.Epoch())
+
+	// Messages of the current and previous epoch can be decrypted
+	for _, e := range envelopes[2:] {
+		plaintext, err := bob.Decrypt(e)
+		assert.NoError(t, err)
+		assert.Equal(t, "message", string(plaintext))
+	}
+
+	// Keys of older epochs are forgotten
+	_, err := bob.Decrypt(envelopes[0])
+	assert.True(t, errors.Is(err, ErrUnknownEpoch))
+}
+
+func TestUnitSessionForgedEpoch(t *testing.T) {
+	alice, bob, _ := handshakePeers(t)
+
+	e, err := alice.Encrypt([]byte("message"), "text/plain")
+	assert.NoError(t, err)
+
+	// A forged envelope of a later epoch does not move the ratchet
+	forged := *e
+	forged.Epoch = 5
+	_, err = bob.Decrypt(&forged)
+	assert.Error(t, err)
+
+	plaintext, err := bob.Decrypt(e)
+	assert.NoError(t, err)
+	assert.Equal(t, "message", string(plaintext))
+}
@@ -0,0 +1,381 @@
+package spvchannels
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SignedContentType is the content type of the messages holding a SignedEnvelope
+const SignedContentType = "application/vnd.spvchannels.signed+json"
+
+// SignedEnvelopeVersion is the version of the SignedEnvelope format
+const SignedEnvelopeVersion = 1
+
+// AlgEd25519 is the ed25519 signature algorithm
+const AlgEd25519 = "Ed25519"
+
+var (
+	// ErrUntrustedSigner is returned when a message is signed by a key absent of the trusted keys
+	ErrUntrustedSigner = errors.New("untrusted signer")
+	// ErrInvalidSignature is returned when a message signature does not verify
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrChannelMismatch is returned when a message was signed for another channel
+	ErrChannelMismatch = errors.New("message signed for another channel")
+	// ErrStaleMessage is returned when a message timestamp is outside the verifier
+	// time window around the time the server received the message
+	ErrStaleMessage = errors.New("message timestamp outside the time window")
+	// ErrReplay is returned when a signature already verified at another
+	// sequence or channel is seen again
+	ErrReplay = errors.New("message replayed")
+)
+
+// SignedEnvelope is the message content of a signed message.
+//
+// The signature covers the version, algorithm, channel id, timestamp,
+// content type and payload. Binary fields are base64 encoded in JSON
+type SignedEnvelope struct {
+	Version     int    `json:"v"`
+	Algorithm   string `json:"alg"`
+	PublicKey   []byte `json:"pub"`
+	ChannelID   string `json:"channel_id"`
+	Timestamp   int64  `json:"ts"`
+	ContentType string `json:"cty,omitempty"`
+	Payload     []byte `json:"payload"`
+	Signature   []byte `json:"sig"`
+}
+
+// digest return the sha256 hash of the signed fields, each field is
+// prefixed by its length so the encoding is unambiguous
+func (e SignedEnvelope) digest() []byte {
+	h := sha256.New()
+	field := func(b []byte) {
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(len(b)))
+		_, _ = h.Write(l[:])
+		_, _ = h.Write(b)
+	}
+
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(e.Timestamp))
+
+	field([]byte(fmt.Sprintf("%d", e.Version)))
+	field([]byte(e.Algorithm))
+	field(e.PublicKey)
+	field([]byte(e.ChannelID))
+	field(ts[:])
+	field([]byte(e.ContentType))
+	field(e.Payload)
+	return h.Sum(nil)
+}
+
+// MessageSigner signs message digests with a private key.
+//
+// The ed25519 implementation is provided by NewEd25519Signer, other schemes
+// such as ECDSA over secp256k1 can be plugged by implementing this interface
+// and registering the verification function with Verifier.AddAlgorithm
+type MessageSigner interface {
+	Algorithm() string
+	PublicKey() []byte
+	Sign(digest []byte) ([]byte, error)
+}
+
+// SignatureVerifyFunc verifies the signature of a digest with a public key
+type SignatureVerifyFunc func(pub, digest, sig []byte) bool
+
+// ed25519Signer is a MessageSigner using AlgEd25519
+type ed25519Signer struct {
+	key ed25519.PrivateKey
+}
+
+// NewEd25519Signer create a MessageSigner for an ed25519 private key
+func NewEd25519Signer(key ed25519.PrivateKey) MessageSigner {
+	return &ed25519Signer{
+		key: key,
+	}
+}
+
+// Algorithm implements MessageSigner
+func (s *ed25519Signer) Algorithm() string {
+	return AlgEd25519
+}
+
+// PublicKey implements MessageSigner
+func (s *ed25519Signer) PublicKey() []byte {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// Sign implements MessageSigner
+func (s *ed25519Signer) Sign(digest []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, digest), nil
+}
+
+// verifyEd25519 is the SignatureVerifyFunc of AlgEd25519
+func verifyEd25519(pub, digest, sig []byte) bool {
+	if len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(pub, digest, sig)
+}
+
+// SignMessage return the signed envelope of a message content for a channel
+func SignMessage(s MessageSigner, channelID, contentType string, payload []byte) (*SignedEnvelope, error) {
+	e := &SignedEnvelope{
+		Version:     SignedEnvelopeVersion,
+		Algorithm:   s.Algorithm(),
+		PublicKey:   s.PublicKey(),
+		ChannelID:   channelID,
+		Timestamp:   time.Now().UnixNano(),
+		ContentType: contentType,
+		Payload:     payload,
+	}
+
+	sig, err := s.Sign(e.digest())
+	if err != nil {
+		return nil, err
+	}
+	e.Signature = sig
+	return e, nil
+}
+
+// MessageWriteSigned signs the message with s and writes the resulting
+// SignedEnvelope to the channel
+func (c *Client) MessageWriteSigned(ctx context.Context, r MessageWriteRequest, s MessageSigner) (*MessageWriteReply, error) {
+	e, err := SignMessage(s, r.ChannelID, r.ContentType, []byte(r.Message))
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign message : %w", err)
+	}
+	return c.writeSized(ctx, r.ChannelID, SignedContentType, e, "signed message")
+}
+
+// VerifiedMessage is a message whose signature was verified.
+// Its payload and content type are the signed ones
+type VerifiedMessage struct {
+	MessageWriteReply
+	Signer    string
+	KeyID     string
+	Timestamp time.Time
+}
+
+// Verifier checks the signed messages against a set of trusted keys.
+//
+// A message is accepted if it is signed by a trusted key for the channel it
+// is read from, with a timestamp within the time window around the time the
+// server received it, and the same signed content was not already accepted
+// at another sequence. Reading the same message again is not a replay, so history can be
+// verified long after it was written. It is safe for concurrent use
+type Verifier struct {
+	mu         sync.Mutex
+	window     time.Duration
+	trusted    map[string]trustedKey
+	algorithms map[string]SignatureVerifyFunc
+	seen       map[string]seenSignature
+	latest     time.Time
+	pruned     time.Time
+	now        func() time.Time
+}
+
+// seenSignature locate the message a signed digest was accepted for
+type seenSignature struct {
+	channelID string
+	sequence  int64
+	received  time.Time
+}
+
+type trustedKey struct {
+	identity  string
+	algorithm string
+	publicKey []byte
+}
+
+// NewVerifier create a verifier accepting messages with a timestamp within
+// window of their received time, or of the current time for messages without
+// one. It verifies AlgEd25519 signatures
+func NewVerifier(window time.Duration) *Verifier {
+	return &Verifier{
+		window:  window,
+		trusted: make(map[string]trustedKey),
+		algorithms: map[string]SignatureVerifyFunc{
+			AlgEd25519: verifyEd25519,
+		},
+		seen: make(map[string]seenSignature),
+		now:  time.Now,
+	}
+}
+
+// Trust add a public key of the algorithm alg to the trusted keys.
+// identity is the signer identity reported in VerifiedMessage
+func (v *Verifier) Trust(identity, alg string, pub []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.trusted[KeyID(pub)] = trustedKey{
+		identity:  identity,
+		algorithm: alg,
+		publicKey: pub,
+	}
+}
+
+// Revoke remove a public key from the trusted keys
+func (v *Verifier) Revoke(pub []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.trusted, KeyID(pub))
+}
+
+// AddAlgorithm register the verification function of a signature algorithm
+func (v *Verifier) AddAlgorithm(alg string, f SignatureVerifyFunc) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.algorithms[alg] = f
+}
+
+// Verify checks the signature of a message read from the channel channelID
+func (v *Verifier) Verify(channelID string, msg MessageWriteReply) (*VerifiedMessage, error) {
+	payload, err := msg.DecodePayload()
+	if err != nil {
+		return nil, err
+	}
+
+	var e SignedEnvelope
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	kid := KeyID(e.PublicKey)
+	key, ok := v.trusted[kid]
+	if !ok || key.algorithm != e.Algorithm {
+		return nil, ErrUntrustedSigner
+	}
+
+	verify, ok := v.algorithms[e.Algorithm]
+	if !ok || e.Version != SignedEnvelopeVersion || !verify(key.publicKey, e.digest(), e.Signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	if e.ChannelID != channelID {
+		return nil, ErrChannelMismatch
+	}
+
+	received := v.now()
+	if msg.Received != "" {
+		if received, err = time.Parse(time.RFC3339Nano, msg.Received); err != nil {
+			return nil, fmt.Errorf("invalid received time : %w", err)
+		}
+	}
+	ts := time.Unix(0, e.Timestamp)
+	if ts.Before(received.Add(-v.window)) || ts.After(received.Add(v.window)) {
+		return nil, ErrStaleMessage
+	}
+
+	// A replayed copy is received within the window of the signed timestamp,
+	// so within two windows of the original. Older entries are swept once
+	// per window, keeping them a bit longer is harmless
+	if received.After(v.latest) {
+		v.latest = received
+	}
+	if v.latest.Sub(v.pruned) >= v.window {
+		for id, s := range v.seen {
+			if s.received.Before(v.latest.Add(-2 * v.window)) {
+				delete(v.seen, id)
+			}
+		}
+		v.pruned = v.latest
+	}
+
+	// Signatures such as ECDSA ones are malleable, a replay is detected on
+	// the signed content instead
+	id := kid + ":" + hex.EncodeToString(e.digest())
+	if s, ok := v.seen[id]; ok && (s.channelID != channelID || s.sequence != msg.Sequence) {
+		return nil, ErrReplay
+	}
+	v.seen[id] = seenSignature{
+		channelID: channelID,
+		sequence:  msg.Sequence,
+		received:  received,
+	}
+
+	vm := &VerifiedMessage{
+		MessageWriteReply: msg,
+		Signer:            key.identity,
+		KeyID:             kid,
+		Timestamp:         ts,
+	}
+	vm.Payload = base64.StdEncoding.EncodeToString(e.Payload)
+	vm.ContentType = e.ContentType
+	return vm, nil
+}
+
+// VerifyAll checks the signature of the messages read from the channel channelID.
+//
+// It returns the verified messages, and ErrRejected holding the error of
+// each rejected one
+func (v *Verifier) VerifyAll(channelID string, msgs MessagesReply) ([]VerifiedMessage, error) {
+	res := []VerifiedMessage{}
+	errs := make(map[int64]error)
+	for _, msg := range msgs {
+		vm, err := v.Verify(channelID, msg)
+		if err != nil {
+			errs[msg.Sequence] = err
+			continue
+		}
+		res = append(res, *vm)
+	}
+	if len(errs) > 0 {
+		return res, ErrRejected{Errors: errs}
+	}
+	return res, nil
+}
+
+// ErrRejected is returned by VerifyAll and MessagesAssembled when some
+// messages were rejected
+type ErrRejected struct {
+	// Errors map the sequence of each rejected message to its error
+	Errors map[int64]error
+}
+
+func (e ErrRejected) Error() string {
+	seqs := make([]int64, 0, len(e.Errors))
+	for seq := range e.Errors {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	msgs := make([]string, 0, len(seqs))
+	for _, seq := range seqs {
+		msgs = append(msgs, fmt.Sprintf("message %d : %s", seq, e.Errors[seq]))
+	}
+	return fmt.Sprintf("%d messages rejected : %s", len(seqs), strings.Join(msgs, ", "))
+}
+
+// Is tells if any rejected message failed with target
+func (e ErrRejected) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// MessagesVerified get messages list and verifies them with v.
+// See Verifier.VerifyAll
+func (c *Client) MessagesVerified(ctx context.Context, r MessagesRequest, v *Verifier) ([]VerifiedMessage, error) {
+	msgs, err := c.Messages(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	return v.VerifyAll(r.ChannelID, msgs)
+}
@@ -0,0 +1,203 @@
+package spvchannels
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitVerifier(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	_, untrusted, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	signed := func(k ed25519.PrivateKey, channelID string, change func(e *SignedEnvelope)) MessageWriteReply {
+		e, err := SignMessage(NewEd25519Signer(k), channelID, "text/plain", []byte("hello"))
+		assert.NoError(t, err)
+		if change != nil {
+			change(e)
+		}
+		data, err := json.Marshal(e)
+		assert.NoError(t, err)
+		return MessageWriteReply{
+			Sequence:    1,
+			ContentType: SignedContentType,
+			Payload:     base64.StdEncoding.EncodeToString(data),
+		}
+	}
+
+	tests := map[string]struct {
+		msg MessageWriteReply
+		err error
+	}{
+		"Valid message": {
+			msg: signed(key, "channel", nil),
+		},
+		"Untrusted signer": {
+			msg: signed(untrusted, "channel", nil),
+			err: ErrUntrustedSigner,
+		},
+		"Tampered payload": {
+			msg: signed(key, "channel", func(e *SignedEnvelope) {
+				e.Payload = []byte("bye")
+			}),
+			err: ErrInvalidSignature,
+		},
+		"Other channel": {
+			msg: signed(key, "other", nil),
+			err: ErrChannelMismatch,
+		},
+		"Old message": {
+			msg: signed(key, "channel", func(e *SignedEnvelope) {
+				e.Timestamp = time.Now().Add(-time.Hour).UnixNano()
+				e.Signature, _ = NewEd25519Signer(key).Sign(e.digest())
+			}),
+			err: ErrStaleMessage,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			v := NewVerifier(time.Minute)
+			v.Trust("alice", AlgEd25519, pub)
+
+			vm, err := v.Verify("channel", test.msg)
+			if test.err != nil {
+				assert.True(t, errors.Is(err, test.err), err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "alice", vm.Signer)
+			assert.Equal(t, "text/plain", vm.ContentType)
+			payload, err := vm.DecodePayload()
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(payload))
+
+			// Reading the message again is not a replay, a copy at another sequence is
+			_, err = v.Verify("channel", test.msg)
+			assert.NoError(t, err)
+			replayed := test.msg
+			replayed.Sequence = 2
+			_, err = v.Verify("channel", replayed)
+			assert.True(t, errors.Is(err, ErrReplay))
+		})
+	}
+}
+
+func TestUnitVerifierReceivedTime(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	v := NewVerifier(time.Minute)
+	v.Trust("alice", AlgEd25519, pub)
+
+	signedAt := time.Now().Add(-24 * time.Hour)
+	e, err := SignMessage(NewEd25519Signer(key), "channel", "text/plain", []byte("hello"))
+	assert.NoError(t, err)
+	e.Timestamp = signedAt.UnixNano()
+	e.Signature, err = NewEd25519Signer(key).Sign(e.digest())
+	assert.NoError(t, err)
+	data, err := json.Marshal(e)
+	assert.NoError(t, err)
+	msg := MessageWriteReply{
+		Sequence:    1,
+		Received:    signedAt.Add(time.Second).UTC().Format(time.RFC3339Nano),
+		ContentType: SignedContentType,
+		Payload:     base64.StdEncoding.EncodeToString(data),
+	}
+
+	// An old message is checked against the time the server received it
+	_, err = v.Verify("channel", msg)
+	assert.NoError(t, err)
+
+	// Written again later, the copy is stale
+	replayed := msg
+	replayed.Sequence = 2
+	replayed.Received = time.Now().UTC().Format(time.RFC3339Nano)
+	_, err = v.Verify("channel", replayed)
+	assert.True(t, errors.Is(err, ErrStaleMessage))
+
+	// Written again within the window, the copy is a replay
+	replayed.Received = signedAt.Add(30 * time.Second).UTC().Format(time.RFC3339Nano)
+	_, err = v.Verify("channel", replayed)
+	assert.True(t, errors.Is(err, ErrReplay))
+
+	msg.Received = "yesterday"
+	_, err = v.Verify("channel", msg)
+	assert.Error(t, err)
+}
+
+func TestUnitVerifierMalleableSignature(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	v := NewVerifier(time.Minute)
+	v.Trust("alice", "malleable", pub)
+	v.AddAlgorithm("malleable", func(pub, digest, sig []byte) bool {
+		// Any trailing byte is accepted, like the s or n-s of an ECDSA signature
+		return len(sig) > 0 && verifyEd25519(pub, digest, sig[:len(sig)-1])
+	})
+
+	e, err := SignMessage(NewEd25519Signer(key), "channel", "text/plain", []byte("hello"))
+	assert.NoError(t, err)
+	e.Algorithm = "malleable"
+	e.Signature, err = NewEd25519Signer(key).Sign(e.digest())
+	assert.NoError(t, err)
+
+	message := func(sequence int64, last byte) MessageWriteReply {
+		c := *e
+		c.Signature = append(append([]byte{}, e.Signature...), last)
+		data, err := json.Marshal(c)
+		assert.NoError(t, err)
+		return MessageWriteReply{
+			Sequence:    sequence,
+			ContentType: SignedContentType,
+			Payload:     base64.StdEncoding.EncodeToString(data),
+		}
+	}
+
+	_, err = v.Verify("channel", message(1, 0))
+	assert.NoError(t, err)
+	_, err = v.Verify("channel", message(2, 1))
+	assert.True(t, errors.Is(err, ErrReplay))
+}
+
+func TestUnitMessagesVerified(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	s := newMockServer()
+	client := newMockClient(s)
+	ctx := context.Background()
+
+	_, err = client.MessageWriteSigned(ctx, MessageWriteRequest{
+		ChannelID:   "channel",
+		Message:     "signed",
+		ContentType: "text/plain",
+	}, NewEd25519Signer(key))
+	assert.NoError(t, err)
+	s.add("channel", "text/plain", []byte("anonymous"))
+
+	v := NewVerifier(time.Minute)
+	v.Trust("alice", AlgEd25519, pub)
+
+	msgs, err := client.MessagesVerified(ctx, MessagesRequest{ChannelID: "channel"}, v)
+	var rejected ErrRejected
+	assert.True(t, errors.As(err, &rejected))
+	assert.Len(t, rejected.Errors, 1)
+	assert.Error(t, rejected.Errors[2])
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, int64(1), msgs[0].Sequence)
+	assert.Equal(t, "alice", msgs[0].Signer)
+
+	// The channel can be read again
+	msgs, err = client.MessagesVerified(ctx, MessagesRequest{ChannelID: "channel"}, v)
+	assert.Error(t, err)
+	assert.Len(t, msgs, 1)
+}